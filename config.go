@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+
+	"github.com/saracen/navigator/server"
+)
+
+// config is the YAML configuration file format. Server settings correspond to
+// command line flags, which take precedence when set.
+type config struct {
+	Server       serverConfig       `json:"server"`
+	Indexes      []indexConfig      `json:"indexes"`
+	Repositories []repositoryConfig `json:"repositories"`
+	Access       []accessConfig     `json:"access"`
+}
+
+type serverConfig struct {
+	HTTPAddr              string   `json:"httpAddr"`
+	DataDir               string   `json:"dataDir"`
+	Interval              duration `json:"interval"`
+	UpdateConcurrency     int      `json:"updateConcurrency"`
+	WebhookSecretFile     string   `json:"webhookSecretFile"`
+	AdminTokenFile        string   `json:"adminTokenFile"`
+	ShutdownTimeout       duration `json:"shutdownTimeout"`
+	TLSCertFile           string   `json:"tlsCertFile"`
+	TLSKeyFile            string   `json:"tlsKeyFile"`
+	TLSClientCAFile       string   `json:"tlsClientCAFile"`
+	MetricsAddr           string   `json:"metricsAddr"`
+	AuthHtpasswdFile      string   `json:"authHtpasswdFile"`
+	AuthTokensFile        string   `json:"authTokensFile"`
+	AuthJWKSFile          string   `json:"authJWKSFile"`
+	AuthJWTIssuer         string   `json:"authJWTIssuer"`
+	AuthJWTAudience       string   `json:"authJWTAudience"`
+	SignKeyring           string   `json:"signKeyring"`
+	SignKey               string   `json:"signKey"`
+	SignPassphraseFile    string   `json:"signPassphraseFile"`
+	ProvenancePassthrough bool     `json:"provenancePassthrough"`
+	CacheSize             *int     `json:"cacheSize"`
+	CacheDir              string   `json:"cacheDir"`
+	CacheDirSize          int      `json:"cacheDirSize"`
+}
+
+// indexConfig declares a chart index. When indexes are declared, refs and
+// directories can only be mapped to declared indexes.
+type indexConfig struct {
+	Name string `json:"name"`
+}
+
+type repositoryConfig struct {
+	URL         string            `json:"url"`
+	Interval    duration          `json:"interval"`
+	Refs        []refConfig       `json:"refs"`
+	Directories []directoryConfig `json:"directories"`
+	Auth        authConfig        `json:"auth"`
+}
+
+type refConfig struct {
+	Name  string `json:"name"`
+	Index string `json:"index"`
+}
+
+type directoryConfig struct {
+	Path  string `json:"path"`
+	Index string `json:"index"`
+}
+
+// authConfig are the credentials of a private repository. Secrets are read
+// from files or environment variables, so that they're not stored in the
+// configuration file.
+type authConfig struct {
+	Username          string `json:"username"`
+	PasswordFile      string `json:"passwordFile"`
+	PasswordEnv       string `json:"passwordEnv"`
+	TokenFile         string `json:"tokenFile"`
+	TokenEnv          string `json:"tokenEnv"`
+	SSHKey            string `json:"sshKey"`
+	SSHPassphraseFile string `json:"sshPassphraseFile"`
+	SSHPassphraseEnv  string `json:"sshPassphraseEnv"`
+	KnownHosts        string `json:"knownHosts"`
+}
+
+// accessConfig allows users and groups to read indexes, and the chart
+// packages they reference. Indexes are glob patterns.
+type accessConfig struct {
+	Indexes []string `json:"indexes"`
+	Users   []string `json:"users"`
+	Groups  []string `json:"groups"`
+}
+
+// duration is a time.Duration unmarshaled from a string such as "5m"
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("invalid duration %s", data)
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if parsed <= 0 {
+		return fmt.Errorf("duration %v is not positive", parsed)
+	}
+
+	*d = duration(parsed)
+	return nil
+}
+
+// loadConfig reads and validates a configuration file
+func loadConfig(filename string) (*config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := parseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return cfg, nil
+}
+
+// parseConfig parses and validates a configuration. Unknown fields are
+// rejected, so that misspelt options aren't silently ignored.
+func parseConfig(data []byte) (*config, error) {
+	data, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg config
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&cfg); err != nil {
+		return nil, err
+	}
+
+	return &cfg, cfg.validate()
+}
+
+func (c *config) validate() error {
+	if c.Server.UpdateConcurrency < 0 {
+		return errors.New("server.updateConcurrency must not be negative")
+	}
+	if c.Server.CacheSize != nil && *c.Server.CacheSize < 0 {
+		return errors.New("server.cacheSize must not be negative")
+	}
+	if c.Server.CacheDirSize < 0 {
+		return errors.New("server.cacheDirSize must not be negative")
+	}
+
+	indexes := make(map[string]bool)
+	for i, index := range c.Indexes {
+		if index.Name == "" {
+			return fmt.Errorf("indexes[%d]: name is required", i)
+		}
+		if indexes[index.Name] {
+			return fmt.Errorf("indexes[%d]: index %q is declared more than once", i, index.Name)
+		}
+		indexes[index.Name] = true
+	}
+
+	declared := func(name string) bool {
+		return name == "" || len(indexes) == 0 || indexes[name]
+	}
+
+	urls := make(map[string]bool)
+	for i, repo := range c.Repositories {
+		if repo.URL == "" {
+			return fmt.Errorf("repositories[%d]: url is required", i)
+		}
+		if urls[repo.URL] {
+			return fmt.Errorf("repositories[%d]: repository %q is configured more than once", i, repo.URL)
+		}
+		urls[repo.URL] = true
+
+		for j, ref := range repo.Refs {
+			if ref.Name == "" {
+				return fmt.Errorf("repositories[%d].refs[%d]: name is required", i, j)
+			}
+			if !declared(ref.Index) {
+				return fmt.Errorf("repositories[%d].refs[%d]: index %q is not declared", i, j, ref.Index)
+			}
+		}
+
+		for j, directory := range repo.Directories {
+			if !declared(directory.Index) {
+				return fmt.Errorf("repositories[%d].directories[%d]: index %q is not declared", i, j, directory.Index)
+			}
+		}
+
+		if err := repo.Auth.validate(); err != nil {
+			return fmt.Errorf("repositories[%d].auth: %v", i, err)
+		}
+	}
+
+	for i, access := range c.Access {
+		if len(access.Indexes) == 0 {
+			return fmt.Errorf("access[%d]: indexes are required", i)
+		}
+		if len(access.Users) == 0 && len(access.Groups) == 0 {
+			return fmt.Errorf("access[%d]: users or groups are required", i)
+		}
+
+		for j, pattern := range access.Indexes {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("access[%d].indexes[%d]: %v", i, j, err)
+			}
+			if !strings.ContainsAny(pattern, `*?[\`) && !declared(pattern) {
+				return fmt.Errorf("access[%d].indexes[%d]: index %q is not declared", i, j, pattern)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (a authConfig) validate() error {
+	pairs := [][2]string{
+		{a.PasswordFile, a.PasswordEnv},
+		{a.TokenFile, a.TokenEnv},
+		{a.SSHPassphraseFile, a.SSHPassphraseEnv},
+	}
+	for _, pair := range pairs {
+		if pair[0] != "" && pair[1] != "" {
+			return errors.New("a secret can be read from either a file or an environment variable, not both")
+		}
+	}
+
+	methods := 0
+	if a.SSHKey != "" {
+		methods++
+	}
+	if a.TokenFile != "" || a.TokenEnv != "" {
+		methods++
+	}
+	if a.PasswordFile != "" || a.PasswordEnv != "" {
+		methods++
+	}
+	if methods > 1 {
+		return errors.New("only one of sshKey, token or password can be configured")
+	}
+
+	return nil
+}
+
+// flags returns the command line flag values of the server settings that have
+// been configured.
+func (c serverConfig) flags() map[string]string {
+	flags := make(map[string]string)
+	if c.HTTPAddr != "" {
+		flags["http-addr"] = c.HTTPAddr
+	}
+	if c.DataDir != "" {
+		flags["data-dir"] = c.DataDir
+	}
+	if c.Interval > 0 {
+		flags["interval"] = time.Duration(c.Interval).String()
+	}
+	if c.UpdateConcurrency > 0 {
+		flags["update-concurrency"] = strconv.Itoa(c.UpdateConcurrency)
+	}
+	if c.WebhookSecretFile != "" {
+		flags["webhook-secret-file"] = c.WebhookSecretFile
+	}
+	if c.AdminTokenFile != "" {
+		flags["admin-token-file"] = c.AdminTokenFile
+	}
+	if c.ShutdownTimeout > 0 {
+		flags["shutdown-timeout"] = time.Duration(c.ShutdownTimeout).String()
+	}
+	if c.TLSCertFile != "" {
+		flags["tls-cert-file"] = c.TLSCertFile
+	}
+	if c.TLSKeyFile != "" {
+		flags["tls-key-file"] = c.TLSKeyFile
+	}
+	if c.TLSClientCAFile != "" {
+		flags["tls-client-ca-file"] = c.TLSClientCAFile
+	}
+	if c.MetricsAddr != "" {
+		flags["metrics-addr"] = c.MetricsAddr
+	}
+	if c.AuthHtpasswdFile != "" {
+		flags["auth-htpasswd-file"] = c.AuthHtpasswdFile
+	}
+	if c.AuthTokensFile != "" {
+		flags["auth-tokens-file"] = c.AuthTokensFile
+	}
+	if c.AuthJWKSFile != "" {
+		flags["auth-jwks-file"] = c.AuthJWKSFile
+	}
+	if c.AuthJWTIssuer != "" {
+		flags["auth-jwt-issuer"] = c.AuthJWTIssuer
+	}
+	if c.AuthJWTAudience != "" {
+		flags["auth-jwt-audience"] = c.AuthJWTAudience
+	}
+	if c.SignKeyring != "" {
+		flags["sign-keyring"] = c.SignKeyring
+	}
+	if c.SignKey != "" {
+		flags["sign-key"] = c.SignKey
+	}
+	if c.SignPassphraseFile != "" {
+		flags["sign-passphrase-file"] = c.SignPassphraseFile
+	}
+	if c.ProvenancePassthrough {
+		flags["provenance-passthrough"] = "true"
+	}
+	if c.CacheSize != nil {
+		flags["cache-size"] = strconv.Itoa(*c.CacheSize)
+	}
+	if c.CacheDir != "" {
+		flags["cache-dir"] = c.CacheDir
+	}
+	if c.CacheDirSize > 0 {
+		flags["cache-dir-size"] = strconv.Itoa(c.CacheDirSize)
+	}
+	return flags
+}
+
+// repositoryURLs returns the configured repositories in the same form as
+// repositories configured with the -url flag, reading their secrets.
+func (c *config) repositoryURLs() (repositoryURLs, error) {
+	var urls repositoryURLs
+	for _, repo := range c.Repositories {
+		rurl := repositoryURL{
+			URL:      repo.URL,
+			Interval: time.Duration(repo.Interval),
+		}
+
+		for _, ref := range repo.Refs {
+			rurl.Refs = append(rurl.Refs, server.WithIndex(ref.Name, ref.Index))
+		}
+		for _, directory := range repo.Directories {
+			rurl.Directories = append(rurl.Directories, server.WithIndex(directory.Path, directory.Index))
+		}
+
+		auth := repo.Auth
+		rurl.Credentials.Username = auth.Username
+		rurl.Credentials.SSHKeyFile = auth.SSHKey
+		rurl.Credentials.SSHKnownHostsFile = auth.KnownHosts
+
+		secrets := []struct {
+			option, value string
+			secret        *string
+		}{
+			{"password-file", auth.PasswordFile, &rurl.Credentials.Password},
+			{"password-env", auth.PasswordEnv, &rurl.Credentials.Password},
+			{"token-file", auth.TokenFile, &rurl.Credentials.Token},
+			{"token-env", auth.TokenEnv, &rurl.Credentials.Token},
+			{"ssh-passphrase-file", auth.SSHPassphraseFile, &rurl.Credentials.SSHKeyPassphrase},
+			{"ssh-passphrase-env", auth.SSHPassphraseEnv, &rurl.Credentials.SSHKeyPassphrase},
+		}
+		for _, secret := range secrets {
+			if secret.value == "" {
+				continue
+			}
+
+			var err error
+			if *secret.secret, err = readSecret(secret.option, secret.value); err != nil {
+				return nil, fmt.Errorf("%s: %v", repo.URL, err)
+			}
+		}
+
+		urls = append(urls, rurl)
+	}
+
+	return urls, nil
+}
+
+// indexNames returns the names of the declared indexes
+func (c *config) indexNames() []string {
+	names := make([]string, 0, len(c.Indexes))
+	for _, index := range c.Indexes {
+		names = append(names, index.Name)
+	}
+	return names
+}
+
+// applyServerFlags sets the flags of any configured server settings that
+// weren't set on the command line.
+func applyServerFlags(fs *flag.FlagSet, cfg *config) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	for name, value := range cfg.Server.flags() {
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("server: %v", err)
+		}
+	}
+	return nil
+}
+
+// newServerConfig returns the indexes and repositories to serve, from the
+// configuration file, if any, followed by the repositories of -url flags.
+func newServerConfig(cfg *config, urls repositoryURLs) (server.Config, error) {
+	var serverConfig server.Config
+	if cfg != nil {
+		configured, err := cfg.repositoryURLs()
+		if err != nil {
+			return serverConfig, err
+		}
+
+		for _, rurl := range urls {
+			for _, crurl := range configured {
+				if rurl.URL == crurl.URL {
+					return serverConfig, fmt.Errorf("repository %q is configured with -url and in the configuration file", rurl.URL)
+				}
+			}
+		}
+
+		serverConfig.Indexes = cfg.indexNames()
+		for _, access := range cfg.Access {
+			serverConfig.Access = append(serverConfig.Access, server.AccessRule{
+				Indexes: access.Indexes,
+				Users:   access.Users,
+				Groups:  access.Groups,
+			})
+		}
+		urls = append(configured, urls...)
+	}
+
+	for _, rurl := range urls {
+		serverConfig.Repositories = append(serverConfig.Repositories, server.RepositoryConfig{
+			URL:         rurl.URL,
+			Credentials: rurl.Credentials,
+			Interval:    rurl.Interval,
+			Refs:        rurl.Refs,
+			Directories: rurl.Directories,
+		})
+	}
+
+	return serverConfig, nil
+}
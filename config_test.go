@@ -0,0 +1,207 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/saracen/navigator/repository"
+	"github.com/saracen/navigator/server"
+)
+
+const testConfig = `
+server:
+  httpAddr: ":4444"
+  interval: 10m
+  updateConcurrency: 2
+indexes:
+  - name: stable
+  - name: releases
+repositories:
+  - url: ./.git
+    interval: 1m
+    refs:
+      - name: master
+      - name: tags/v*
+        index: releases
+    directories:
+      - path: repository/testdata/charts
+        index: stable
+  - url: testdata/private.git
+    auth:
+      username: navigator
+      tokenEnv: NAVIGATOR_TEST_TOKEN
+`
+
+type ConfigTestSuite struct {
+	suite.Suite
+}
+
+func (suite *ConfigTestSuite) writeConfig(data string) string {
+	f, err := ioutil.TempFile("", "navigator-config")
+	suite.Require().NoError(err)
+	defer f.Close()
+
+	_, err = f.WriteString(data)
+	suite.Require().NoError(err)
+
+	return f.Name()
+}
+
+func (suite *ConfigTestSuite) TestRepositoryURLs() {
+	os.Setenv("NAVIGATOR_TEST_TOKEN", "token")
+	defer os.Unsetenv("NAVIGATOR_TEST_TOKEN")
+
+	cfg, err := parseConfig([]byte(testConfig))
+	if !suite.NoError(err) {
+		return
+	}
+
+	suite.Equal([]string{"stable", "releases"}, cfg.indexNames())
+
+	urls, err := cfg.repositoryURLs()
+	if suite.NoError(err) && suite.Len(urls, 2) {
+		suite.Equal(repositoryURL{
+			URL:         "./.git",
+			Interval:    time.Minute,
+			Refs:        []string{"master", "tags/v*@releases"},
+			Directories: []string{"repository/testdata/charts@stable"},
+		}, urls[0])
+
+		suite.Equal("testdata/private.git", urls[1].URL)
+		suite.Equal(repository.Credentials{Username: "navigator", Token: "token"}, urls[1].Credentials)
+	}
+
+	os.Unsetenv("NAVIGATOR_TEST_TOKEN")
+	_, err = cfg.repositoryURLs()
+	suite.Error(err)
+}
+
+func (suite *ConfigTestSuite) TestValidation() {
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{"server: {updateConcurrency: -1}", "server.updateConcurrency must not be negative"},
+		{"server: {cacheSize: -1}", "server.cacheSize must not be negative"},
+		{"server: {cacheDirSize: -1}", "server.cacheDirSize must not be negative"},
+		{"server: {interval: soon}", "invalid duration"},
+		{"server: {interval: -5m}", "not positive"},
+		{"server: {httpAdr: ':80'}", `unknown field "httpAdr"`},
+		{"indexes: [{name: stable}, {name: stable}]", `indexes[1]: index "stable" is declared more than once`},
+		{"indexes: [{}]", "indexes[0]: name is required"},
+		{"repositories: [{refs: [{name: master}]}]", "repositories[0]: url is required"},
+		{"repositories: [{url: ./.git}, {url: ./.git}]", `repositories[1]: repository "./.git" is configured more than once`},
+		{"repositories: [{url: ./.git, refs: [{index: stable}]}]", "repositories[0].refs[0]: name is required"},
+		{"indexes: [{name: stable}]\nrepositories: [{url: ./.git, directories: [{path: charts, index: stabel}]}]", `repositories[0].directories[0]: index "stabel" is not declared`},
+		{"repositories: [{url: ./.git, auth: {tokenFile: token, tokenEnv: TOKEN}}]", "repositories[0].auth: a secret can be read from either a file or an environment variable, not both"},
+		{"repositories: [{url: ./.git, auth: {sshKey: id_rsa, tokenEnv: TOKEN}}]", "repositories[0].auth: only one of sshKey, token or password can be configured"},
+		{"access: [{users: [alice]}]", "access[0]: indexes are required"},
+		{"access: [{indexes: [stable]}]", "access[0]: users or groups are required"},
+		{"access: [{indexes: ['[stable'], users: [alice]}]", "access[0].indexes[0]: syntax error in pattern"},
+		{"indexes: [{name: stable}]\naccess: [{indexes: [stabel], groups: [ops]}]", `access[0].indexes[0]: index "stabel" is not declared`},
+	}
+
+	for idx, test := range tests {
+		_, err := parseConfig([]byte(test.config))
+		if suite.Error(err, "test index: %v", idx) {
+			suite.Contains(err.Error(), test.err, "test index: %v", idx)
+		}
+	}
+}
+
+func (suite *ConfigTestSuite) TestServerFlags() {
+	cfg, err := parseConfig([]byte("server: {cacheSize: 0, cacheDir: /tmp/cache, provenancePassthrough: true}"))
+	if !suite.NoError(err) {
+		return
+	}
+
+	// a cache size of 0 is set, as it disables the cache
+	suite.Equal(map[string]string{
+		"cache-size":             "0",
+		"cache-dir":              "/tmp/cache",
+		"provenance-passthrough": "true",
+	}, cfg.Server.flags())
+}
+
+func (suite *ConfigTestSuite) TestConfigure() {
+	filename := suite.writeConfig(testConfig)
+	defer os.Remove(filename)
+
+	os.Setenv("NAVIGATOR_TEST_TOKEN", "token")
+	defer os.Unsetenv("NAVIGATOR_TEST_TOKEN")
+
+	// flags take precedence over the configuration file
+	app := configure([]string{"--config", filename, "--interval", "2m", "--url", "./.git/#repository/testdata/charts"})
+	suite.Equal(":4444", app.srv.Addr)
+	suite.Equal(2*time.Minute, app.navigator.PollInterval())
+
+	// repositories from both the configuration file and flags are added
+	err := app.navigator.UpdateRepositories()
+	if suite.IsType(server.UpdateErrors{}, err) {
+		suite.Len(err, 1)
+		suite.Contains(err.(server.UpdateErrors), "testdata/private.git")
+	}
+
+	res := httptest.NewRecorder()
+	app.srv.Handler.ServeHTTP(res, httptest.NewRequest("GET", "/stable/index.yaml", nil))
+	suite.Equal(http.StatusOK, res.Code)
+	suite.Contains(res.Body.String(), "mychart")
+
+	res = httptest.NewRecorder()
+	app.srv.Handler.ServeHTTP(res, httptest.NewRequest("GET", "/default/index.yaml", nil))
+	suite.Equal(http.StatusOK, res.Code)
+	suite.Contains(res.Body.String(), "mychart")
+
+	// declared indexes are served even if empty
+	res = httptest.NewRecorder()
+	app.srv.Handler.ServeHTTP(res, httptest.NewRequest("GET", "/releases/index.yaml", nil))
+	suite.Equal(http.StatusOK, res.Code)
+}
+
+func (suite *ConfigTestSuite) TestDuplicateRepository() {
+	cfg, err := parseConfig([]byte("repositories: [{url: ./.git}]"))
+	if !suite.NoError(err) {
+		return
+	}
+
+	var urls repositoryURLs
+	suite.NoError(urls.Set("./.git#repository/testdata/charts"))
+
+	_, err = newServerConfig(cfg, urls)
+	if suite.Error(err) {
+		suite.Contains(err.Error(), `repository "./.git" is configured with -url and in the configuration file`)
+	}
+}
+
+func (suite *ConfigTestSuite) TestAccess() {
+	cfg, err := parseConfig([]byte(`
+indexes: [{name: stable}, {name: team-a}]
+access:
+  - indexes: [stable]
+    users: ["*"]
+  - indexes: [team-*]
+    users: [alice]
+    groups: [team-a]
+`))
+	if !suite.NoError(err) {
+		return
+	}
+
+	serverConfig, err := newServerConfig(cfg, nil)
+	if suite.NoError(err) {
+		suite.Equal([]server.AccessRule{
+			{Indexes: []string{"stable"}, Users: []string{"*"}},
+			{Indexes: []string{"team-*"}, Users: []string{"alice"}, Groups: []string{"team-a"}},
+		}, serverConfig.Access)
+	}
+}
+
+func TestConfigTestSuite(t *testing.T) {
+	suite.Run(t, new(ConfigTestSuite))
+}
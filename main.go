@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/saracen/navigator/repository"
 	"github.com/saracen/navigator/server"
 
 	"github.com/go-kit/kit/log"
@@ -17,6 +24,9 @@ import (
 
 type repositoryURL struct {
 	URL         string
+	Credentials repository.Credentials
+	Interval    time.Duration
+	Refs        []string
 	Directories []string
 }
 
@@ -34,7 +44,18 @@ func (i *repositoryURLs) Set(value string) error {
 
 	rurl := repositoryURL{}
 	if len(uri.Fragment) > 0 {
-		rurl.Directories = strings.Split(uri.Fragment, ",")
+		for _, part := range strings.Split(uri.Fragment, ",") {
+			if err = rurl.setOption(part); err != nil {
+				return err
+			}
+		}
+	}
+
+	// move basic auth credentials out of the url so that they're never logged
+	if password, ok := uri.User.Password(); ok {
+		rurl.Credentials.Username = uri.User.Username()
+		rurl.Credentials.Password = password
+		uri.User = nil
 	}
 
 	uri.Fragment = ""
@@ -45,13 +66,125 @@ func (i *repositoryURLs) Set(value string) error {
 	return nil
 }
 
-func configure(args []string) (*server.Server, time.Duration, *http.Server) {
+// setOption sets a repository option from the fragment part of the url. Parts
+// not in the form <option>:<value> are directories to index, and unknown
+// options are an error, so that misspelt options aren't mistaken for
+// directories.
+func (u *repositoryURL) setOption(part string) (err error) {
+	kv := strings.SplitN(part, ":", 2)
+	if len(kv) != 2 {
+		u.Directories = append(u.Directories, part)
+		return nil
+	}
+
+	option, value := kv[0], kv[1]
+	switch option {
+	case "ref":
+		u.Refs = append(u.Refs, value)
+	case "interval":
+		u.Interval, err = time.ParseDuration(value)
+		if err == nil && u.Interval <= 0 {
+			err = fmt.Errorf("interval: %v is not positive", u.Interval)
+		}
+	case "username":
+		u.Credentials.Username = value
+	case "ssh-key":
+		u.Credentials.SSHKeyFile = value
+	case "known-hosts":
+		u.Credentials.SSHKnownHostsFile = value
+	case "password-file", "password-env":
+		u.Credentials.Password, err = readSecret(option, value)
+	case "token-file", "token-env":
+		u.Credentials.Token, err = readSecret(option, value)
+	case "ssh-passphrase-file", "ssh-passphrase-env":
+		u.Credentials.SSHKeyPassphrase, err = readSecret(option, value)
+	default:
+		err = fmt.Errorf("unknown option %q", option)
+	}
+
+	return err
+}
+
+// readSecret reads a secret from a file (options suffixed with -file) or an
+// environment variable (options suffixed with -env).
+func readSecret(option, value string) (string, error) {
+	if strings.HasSuffix(option, "-env") {
+		secret, ok := os.LookupEnv(value)
+		if !ok {
+			return "", fmt.Errorf("%s: environment variable %q is not set", option, value)
+		}
+		return secret, nil
+	}
+
+	secret, err := ioutil.ReadFile(value)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", option, err)
+	}
+	return strings.TrimSpace(string(secret)), nil
+}
+
+// readRequiredSecret reads a secret that must not be empty, such as a secret
+// requests are verified with
+func readRequiredSecret(option, value string) (string, error) {
+	secret, err := readSecret(option, value)
+	if err == nil && secret == "" {
+		err = fmt.Errorf("%s: secret is empty", option)
+	}
+	return secret, err
+}
+
+// application is a configured navigator server and the HTTP servers it's
+// served by
+type application struct {
+	navigator *server.Server
+	reloader  *configReloader
+
+	// srv serves charts and the APIs. metricsSrv, if configured, serves
+	// metrics and health checks over plaintext HTTP.
+	srv        *http.Server
+	metricsSrv *http.Server
+
+	shutdownTimeout time.Duration
+}
+
+// servers returns the HTTP servers to listen on
+func (app *application) servers() []*http.Server {
+	if app.metricsSrv == nil {
+		return []*http.Server{app.srv}
+	}
+	return []*http.Server{app.srv, app.metricsSrv}
+}
+
+func configure(args []string) *application {
 	fs := flag.NewFlagSet("navigator", flag.ExitOnError)
 
 	var (
-		httpAddr = fs.String("http-addr", ":8080", "HTTP listen address")
-		interval = fs.Duration("interval", time.Minute*5, "Poll interval for git repository updates")
-		urls     repositoryURLs
+		httpAddr    = fs.String("http-addr", ":8080", "HTTP listen address")
+		interval    = fs.Duration("interval", time.Minute*5, "Default poll interval for git repository updates")
+		dataDir     = fs.String("data-dir", "", "Directory to store git repositories in (default in-memory)")
+		concurrency = fs.Int("update-concurrency", 4, "Maximum number of git repositories updated concurrently")
+		secretFile  = fs.String("webhook-secret-file", "", "File containing the secret used to verify push webhooks (webhooks are disabled if not set)")
+		tokenFile   = fs.String("admin-token-file", "", "File containing the bearer token of the admin API (the admin API is disabled if not set)")
+		configFile  = fs.String("config", "", "YAML configuration file of server settings, indexes and repositories")
+		shutdown    = fs.Duration("shutdown-timeout", 30*time.Second, "Maximum time to wait for in-flight requests and updates to complete on shutdown")
+		configWatch = fs.Duration("config-watch-interval", 0, "Interval to check the configuration file for changes (default only reloaded on SIGHUP)")
+		tlsCert     = fs.String("tls-cert-file", "", "PEM encoded TLS certificate file, reloaded when modified (default plaintext HTTP)")
+		tlsKey      = fs.String("tls-key-file", "", "PEM encoded TLS private key file, reloaded when modified")
+		tlsClientCA = fs.String("tls-client-ca-file", "", "PEM encoded CA certificates that client certificates must be signed by (default client certificates are not required)")
+		htpasswd    = fs.String("auth-htpasswd-file", "", "htpasswd file of bcrypt hashed passwords for basic auth to chart indexes and packages")
+		tokensFile  = fs.String("auth-tokens-file", "", "File of bearer tokens for chart indexes and packages, one \"<token> <name> [<group>,...]\" per line")
+		jwksFile    = fs.String("auth-jwks-file", "", "JWKS file of keys that bearer tokens (JWTs) for chart indexes and packages are signed by")
+		jwtIssuer   = fs.String("auth-jwt-issuer", "", "Required issuer of JWT bearer tokens")
+		jwtAudience = fs.String("auth-jwt-audience", "", "Required audience of JWT bearer tokens")
+		signKeyring = fs.String("sign-keyring", "", "OpenPGP keyring of the private key that generated provenance files are signed with (provenance files are not generated if not set)")
+		signKey     = fs.String("sign-key", "", "Name of the key in -sign-keyring to sign with (default the first private key)")
+		signPass    = fs.String("sign-passphrase-file", "", "File containing the passphrase of an encrypted signing key")
+		passthrough = fs.Bool("provenance-passthrough", false, "Serve provenance files committed alongside charts, in preference to generating them")
+		cacheSize   = fs.Int("cache-size", 64, "Maximum size in MiB of generated chart packages cached in memory (0 disables the in-memory cache)")
+		cacheDir    = fs.String("cache-dir", "", "Directory to cache generated chart packages in (default not cached on disk)")
+		cacheDirSz  = fs.Int("cache-dir-size", 1024, "Maximum size in MiB of generated chart packages cached in -cache-dir")
+		metricsAddr = fs.String("metrics-addr", "", "Plaintext HTTP listen address for /metrics, /health and /ready (default served on -http-addr)")
+		urls        repositoryURLs
 	)
 
 	fs.Var(&urls, "url", "Git repository to index")
@@ -64,44 +197,302 @@ func configure(args []string) (*server.Server, time.Duration, *http.Server) {
 		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
 	}
 
-	navigator := server.New(logger)
+	var cfg *config
+	if *configFile != "" {
+		var err error
+		if cfg, err = loadConfig(*configFile); err == nil {
+			err = applyServerFlags(fs, cfg)
+		}
+		if err != nil {
+			level.Error(logger).Log("event", "configure", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	authenticators, err := newAuthenticators(*htpasswd, *tokensFile, *jwksFile, *jwtIssuer, *jwtAudience)
+	if err != nil {
+		level.Error(logger).Log("event", "configure", "err", err)
+		os.Exit(1)
+	}
 
-	for _, url := range urls {
-		navigator.AddGitBackedRepository(url.URL, url.Directories)
+	signer, err := newSigner(*signKeyring, *signKey, *signPass)
+	if err != nil {
+		level.Error(logger).Log("event", "configure", "err", err)
+		os.Exit(1)
+	}
+
+	cache, err := newArchiveCache(logger, *cacheSize, *cacheDir, *cacheDirSz)
+	if err != nil {
+		level.Error(logger).Log("event", "configure", "err", err)
+		os.Exit(1)
+	}
+
+	options := []server.Option{
+		server.DataDir(*dataDir),
+		server.PollInterval(*interval),
+		server.UpdateConcurrency(*concurrency),
+		server.Authentication(authenticators...),
+		server.PassthroughProvenance(*passthrough),
+	}
+	if signer != nil {
+		options = append(options, server.Sign(signer))
+	}
+	if cache != nil {
+		options = append(options, server.Cache(cache))
+	}
+	navigator := server.New(logger, options...)
+
+	serverConfig, err := newServerConfig(cfg, urls)
+	if err != nil {
+		level.Error(logger).Log("event", "configure", "err", err)
+		os.Exit(1)
+	}
+	if len(serverConfig.Access) > 0 && len(authenticators) == 0 {
+		level.Warn(logger).Log("event", "configure", "msg", "access rules require authentication, every index is denied to anonymous clients")
+	}
+	navigator.Reconfigure(serverConfig)
+
+	if err := navigator.RestoreSnapshot(); err != nil {
+		level.Error(logger).Log("event", "restore", "dir", *dataDir, "err", err)
+	}
+
+	var reloader *configReloader
+	if *configFile != "" {
+		reloader = &configReloader{
+			navigator: navigator,
+			filename:  *configFile,
+			urls:      urls,
+			interval:  *configWatch,
+		}
+	}
+
+	tlsConfig, err := newTLSConfig(logger, *tlsCert, *tlsKey, *tlsClientCA)
+	if err != nil {
+		level.Error(logger).Log("event", "configure", "err", err)
+		os.Exit(1)
 	}
 
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", prometheus.Handler())
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+
+	// metrics and health checks are served on their own plaintext listener if
+	// configured, so that they're reachable without a client certificate
+	probes := mux
+	var metricsSrv *http.Server
+	if *metricsAddr != "" {
+		probes = http.NewServeMux()
+		metricsSrv = newHTTPServer(*metricsAddr, probes)
+	}
+
+	probes.Handle("/metrics", prometheus.Handler())
+	probes.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("ok"))
 	})
+	probes.HandleFunc("/ready", navigator.ServeReady)
+	mux.HandleFunc("/api/status", navigator.ServeStatus)
+
+	if *secretFile != "" {
+		secret, err := readRequiredSecret("webhook-secret-file", *secretFile)
+		if err != nil {
+			level.Error(logger).Log("event", "configure", "err", err)
+			os.Exit(1)
+		}
+		mux.Handle("/hooks/", navigator.WebhookHandler([]byte(secret)))
+	}
+
+	if *tokenFile != "" {
+		token, err := readRequiredSecret("admin-token-file", *tokenFile)
+		if err != nil {
+			level.Error(logger).Log("event", "configure", "err", err)
+			os.Exit(1)
+		}
+
+		admin := navigator.AdminHandler([]byte(token))
+		mux.Handle("/api/repositories", admin)
+		mux.Handle("/api/repositories/", admin)
+	}
 	mux.Handle("/", server.MetricMiddleware(navigator))
 
-	return navigator, *interval, &http.Server{
-		Addr:         *httpAddr,
+	srv := newHTTPServer(*httpAddr, mux)
+	srv.TLSConfig = tlsConfig
+
+	return &application{
+		navigator:       navigator,
+		reloader:        reloader,
+		srv:             srv,
+		metricsSrv:      metricsSrv,
+		shutdownTimeout: *shutdown,
+	}
+}
+
+// newAuthenticators returns the authenticators of chart indexes and packages.
+// If none are configured, requests are not authenticated.
+func newAuthenticators(htpasswdFile, tokensFile, jwksFile, jwtIssuer, jwtAudience string) ([]server.Authenticator, error) {
+	var authenticators []server.Authenticator
+
+	if htpasswdFile != "" {
+		authenticator, err := server.NewHtpasswdAuthenticator(htpasswdFile)
+		if err != nil {
+			return nil, fmt.Errorf("auth-htpasswd-file: %v", err)
+		}
+		authenticators = append(authenticators, authenticator)
+	}
+
+	if tokensFile != "" {
+		authenticator, err := server.NewTokenAuthenticator(tokensFile)
+		if err != nil {
+			return nil, fmt.Errorf("auth-tokens-file: %v", err)
+		}
+		authenticators = append(authenticators, authenticator)
+	}
+
+	if jwksFile != "" {
+		authenticator, err := server.NewJWTAuthenticator(jwksFile, jwtIssuer, jwtAudience)
+		if err != nil {
+			return nil, fmt.Errorf("auth-jwks-file: %v", err)
+		}
+		authenticators = append(authenticators, authenticator)
+	} else if jwtIssuer != "" || jwtAudience != "" {
+		return nil, errors.New("auth-jwt-issuer and auth-jwt-audience require auth-jwks-file")
+	}
+
+	return authenticators, nil
+}
+
+// newSigner returns the signer of generated provenance files, or nil if
+// provenance files are not generated.
+func newSigner(keyring, key, passphraseFile string) (*repository.Signer, error) {
+	if keyring == "" {
+		if key != "" || passphraseFile != "" {
+			return nil, errors.New("sign-key and sign-passphrase-file require sign-keyring")
+		}
+		return nil, nil
+	}
+
+	var passphrase string
+	if passphraseFile != "" {
+		var err error
+		if passphrase, err = readSecret("sign-passphrase-file", passphraseFile); err != nil {
+			return nil, err
+		}
+	}
+
+	signer, err := repository.NewSigner(keyring, key, []byte(passphrase))
+	if err != nil {
+		return nil, fmt.Errorf("sign-keyring: %v", err)
+	}
+	return signer, nil
+}
+
+// newArchiveCache returns the cache of generated chart packages, or nil if
+// packages are not cached. Sizes are in MiB.
+func newArchiveCache(logger log.Logger, size int, dir string, dirSize int) (*server.ArchiveCache, error) {
+	switch {
+	case size < 0:
+		return nil, errors.New("cache-size must not be negative")
+	case dirSize < 0:
+		return nil, errors.New("cache-dir-size must not be negative")
+	case size == 0 && dir == "":
+		return nil, nil
+	}
+
+	cache, err := server.NewArchiveCache(logger, int64(size)<<20, dir, int64(dirSize)<<20)
+	if err != nil {
+		return nil, fmt.Errorf("cache-dir: %v", err)
+	}
+	return cache, nil
+}
+
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         addr,
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  120 * time.Second,
-		Handler:      mux,
+		Handler:      handler,
+	}
+}
+
+// listen serves srv, using TLS if configured
+func listen(srv *http.Server) error {
+	if srv.TLSConfig != nil {
+		// the certificate is provided by the TLS configuration
+		return srv.ListenAndServeTLS("", "")
 	}
+	return srv.ListenAndServe()
 }
 
 func main() {
-	navigator, interval, srv := configure(os.Args[1:])
+	app := configure(os.Args[1:])
+	navigator := app.navigator
+	logger := navigator.Logger()
+
+	type listenErr struct {
+		srv *http.Server
+		err error
+	}
 
-	// initial update
-	if err := navigator.UpdateRepositories(); err != nil {
-		panic(err)
+	servers := app.servers()
+	errc := make(chan listenErr, len(servers))
+	for _, srv := range servers {
+		transport := "HTTP"
+		if srv.TLSConfig != nil {
+			transport = "HTTPS"
+		}
+		level.Info(logger).Log("event", "listening", "transport", transport, "addr", srv.Addr)
+
+		go func(srv *http.Server) {
+			errc <- listenErr{srv, listen(srv)}
+		}(srv)
+	}
+
+	if app.reloader != nil {
+		go app.reloader.Run()
+	}
+
+	// repositories are updated immediately, and charts are served as they
+	// become ready
+	stop := make(chan struct{})
+	go navigator.Run(stop)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	select {
+	case lerr := <-errc:
+		level.Error(logger).Log("event", "listening", "addr", lerr.srv.Addr, "err", lerr.err)
+		os.Exit(1)
+	case sig := <-signals:
+		level.Info(logger).Log("event", "shutdown", "signal", sig, "timeout", app.shutdownTimeout)
 	}
 
-	level.Info(navigator.Logger()).Log("event", "listening", "transport", "HTTP", "addr", srv.Addr)
+	// stop scheduling updates, and wait for in-flight requests and updates
+	close(stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), app.shutdownTimeout)
+	defer cancel()
 
-	go func() {
-		panic(srv.ListenAndServe())
-	}()
+	shutdowns := []func(context.Context) error{navigator.Shutdown}
+	for _, srv := range servers {
+		shutdowns = append(shutdowns, srv.Shutdown)
+	}
+	errs := make(chan error, len(shutdowns))
+	for _, shutdown := range shutdowns {
+		go func(shutdown func(context.Context) error) {
+			errs <- shutdown(ctx)
+		}(shutdown)
+	}
 
-	for range time.Tick(interval) {
-		navigator.UpdateRepositories()
+	failed := false
+	for range shutdowns {
+		if err := <-errs; err != nil {
+			level.Error(logger).Log("event", "shutdown", "err", err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
 	}
+
+	level.Info(logger).Log("event", "shutdown", "status", "complete")
 }
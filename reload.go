@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/saracen/navigator/server"
+)
+
+// configReloader reconfigures the server's indexes and repositories from the
+// configuration file on SIGHUP and, if interval is set, whenever the file
+// changes. Server settings are only read at startup.
+type configReloader struct {
+	navigator *server.Server
+	filename  string
+	urls      repositoryURLs
+	interval  time.Duration
+}
+
+// Reload reads the configuration file and reconfigures the server. The server
+// is left unchanged if the configuration is invalid.
+func (r *configReloader) Reload() error {
+	cfg, err := loadConfig(r.filename)
+	if err != nil {
+		return err
+	}
+
+	serverConfig, err := newServerConfig(cfg, r.urls)
+	if err != nil {
+		return err
+	}
+
+	r.navigator.Reconfigure(serverConfig)
+	return nil
+}
+
+// Run reloads the configuration on SIGHUP or file changes, and never returns
+func (r *configReloader) Run() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var changed <-chan time.Time
+	if r.interval > 0 {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		changed = ticker.C
+	}
+
+	modified := r.modified()
+	for {
+		select {
+		case <-hup:
+		case <-changed:
+			current := r.modified()
+			if current.Equal(modified) {
+				continue
+			}
+			modified = current
+		}
+
+		logger := r.navigator.Logger()
+		if err := r.Reload(); err != nil {
+			level.Error(logger).Log("event", "reload", "config", r.filename, "err", err)
+			continue
+		}
+		level.Info(logger).Log("event", "reload", "config", r.filename)
+	}
+}
+
+// modified returns the modification time of the configuration file, or the
+// zero time if it can't be read
+func (r *configReloader) modified() time.Time {
+	fi, err := os.Stat(r.filename)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ReloadTestSuite struct {
+	suite.Suite
+}
+
+func (suite *ReloadTestSuite) TestReload() {
+	f, err := ioutil.TempFile("", "navigator-config")
+	suite.Require().NoError(err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	suite.Require().NoError(ioutil.WriteFile(f.Name(), []byte("indexes: [{name: stable}]"), 0644))
+
+	app := configure([]string{"--config", f.Name()})
+	if !suite.NotNil(app.reloader) {
+		return
+	}
+
+	status := func(path string) int {
+		res := httptest.NewRecorder()
+		app.srv.Handler.ServeHTTP(res, httptest.NewRequest("GET", path, nil))
+		return res.Code
+	}
+	suite.Equal(http.StatusOK, status("/stable/index.yaml"))
+
+	suite.Require().NoError(ioutil.WriteFile(f.Name(), []byte("indexes: [{name: incubator}]"), 0644))
+	suite.NoError(app.reloader.Reload())
+	suite.Equal(http.StatusNotFound, status("/stable/index.yaml"))
+	suite.Equal(http.StatusOK, status("/incubator/index.yaml"))
+
+	// invalid configuration leaves the server unchanged
+	suite.Require().NoError(ioutil.WriteFile(f.Name(), []byte("indexes: [{}]"), 0644))
+	suite.Error(app.reloader.Reload())
+	suite.Equal(http.StatusOK, status("/incubator/index.yaml"))
+}
+
+func TestReloadTestSuite(t *testing.T) {
+	suite.Run(t, new(ReloadTestSuite))
+}
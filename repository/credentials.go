@@ -0,0 +1,83 @@
+package repository
+
+import (
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+)
+
+const defaultSSHUser = "git"
+
+// Credentials are used to authenticate against a private git repository.
+// Only one authentication method is used, in the order of precedence: SSH
+// private key, bearer token, HTTP basic auth.
+type Credentials struct {
+	// Username is used for HTTP basic auth, and as the SSH user if the
+	// repository URL doesn't specify one.
+	Username string
+	Password string
+
+	// Token is sent as a HTTP bearer token.
+	Token string
+
+	// SSHKeyFile is the path to a PEM encoded SSH private key, optionally
+	// encrypted with SSHKeyPassphrase. SSHKnownHostsFile is the known_hosts
+	// file used to verify the remote host key. If not provided, the
+	// SSH_KNOWN_HOSTS environment variable or ~/.ssh/known_hosts is used.
+	SSHKeyFile        string
+	SSHKeyPassphrase  string
+	SSHKnownHostsFile string
+}
+
+// String returns the name of the authentication method, so that credentials
+// can be logged without revealing secrets.
+func (c Credentials) String() string {
+	switch {
+	case c.SSHKeyFile != "":
+		return "ssh-key"
+	case c.Token != "":
+		return "token"
+	case c.Username != "" || c.Password != "":
+		return "basic"
+	}
+	return "none"
+}
+
+// authMethod returns the go-git authentication method for the repository url.
+// A nil method is returned when no credentials have been provided.
+func (c Credentials) authMethod(url string) (transport.AuthMethod, error) {
+	switch {
+	case c.SSHKeyFile != "":
+		user := c.Username
+		if user == "" {
+			if ep, err := transport.NewEndpoint(url); err == nil {
+				user = ep.User
+			}
+		}
+		if user == "" {
+			user = defaultSSHUser
+		}
+
+		auth, err := ssh.NewPublicKeysFromFile(user, c.SSHKeyFile, c.SSHKeyPassphrase)
+		if err != nil {
+			return nil, err
+		}
+
+		if c.SSHKnownHostsFile != "" {
+			auth.HostKeyCallback, err = ssh.NewKnownHostsCallback(c.SSHKnownHostsFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return auth, nil
+
+	case c.Token != "":
+		return &http.TokenAuth{Token: c.Token}, nil
+
+	case c.Username != "" || c.Password != "":
+		return &http.BasicAuth{Username: c.Username, Password: c.Password}, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,88 @@
+package repository
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+)
+
+type CredentialsTestSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (suite *CredentialsTestSuite) SetupSuite() {
+	var err error
+	suite.dir, err = ioutil.TempDir("", "navigator-credentials")
+	suite.Require().NoError(err)
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	suite.Require().NoError(err)
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	suite.Require().NoError(ioutil.WriteFile(filepath.Join(suite.dir, "id_rsa"), data, 0600))
+	suite.Require().NoError(ioutil.WriteFile(filepath.Join(suite.dir, "known_hosts"), nil, 0600))
+}
+
+func (suite *CredentialsTestSuite) TearDownSuite() {
+	os.RemoveAll(suite.dir)
+}
+
+func (suite *CredentialsTestSuite) TestString() {
+	suite.Equal("none", Credentials{}.String())
+	suite.Equal("basic", Credentials{Username: "user", Password: "secret"}.String())
+	suite.Equal("token", Credentials{Token: "secret"}.String())
+	suite.Equal("ssh-key", Credentials{SSHKeyFile: "id_rsa", SSHKeyPassphrase: "secret"}.String())
+}
+
+func (suite *CredentialsTestSuite) TestAuthMethod() {
+	auth, err := Credentials{}.authMethod("https://example.com/charts.git")
+	suite.NoError(err)
+	suite.Nil(auth)
+
+	auth, err = Credentials{Username: "user", Password: "secret"}.authMethod("https://example.com/charts.git")
+	if suite.NoError(err) {
+		suite.Equal(&http.BasicAuth{Username: "user", Password: "secret"}, auth)
+	}
+
+	auth, err = Credentials{Token: "secret"}.authMethod("https://example.com/charts.git")
+	if suite.NoError(err) {
+		suite.Equal(&http.TokenAuth{Token: "secret"}, auth)
+	}
+
+	credentials := Credentials{
+		SSHKeyFile:        filepath.Join(suite.dir, "id_rsa"),
+		SSHKnownHostsFile: filepath.Join(suite.dir, "known_hosts"),
+	}
+
+	auth, err = credentials.authMethod("ssh://deploy@example.com/charts.git")
+	if suite.NoError(err) && suite.IsType(&ssh.PublicKeys{}, auth) {
+		suite.Equal("deploy", auth.(*ssh.PublicKeys).User)
+		suite.NotNil(auth.(*ssh.PublicKeys).HostKeyCallback)
+	}
+
+	auth, err = credentials.authMethod("ssh://example.com/charts.git")
+	if suite.NoError(err) && suite.IsType(&ssh.PublicKeys{}, auth) {
+		suite.Equal(defaultSSHUser, auth.(*ssh.PublicKeys).User)
+	}
+
+	credentials.SSHKnownHostsFile = filepath.Join(suite.dir, "missing")
+	_, err = credentials.authMethod("ssh://example.com/charts.git")
+	suite.Error(err)
+
+	_, err = Credentials{SSHKeyFile: filepath.Join(suite.dir, "missing")}.authMethod("ssh://example.com/charts.git")
+	suite.Error(err)
+}
+
+func TestCredentialsTestSuite(t *testing.T) {
+	suite.Run(t, new(CredentialsTestSuite))
+}
@@ -3,11 +3,14 @@ package repository
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"path"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -30,7 +33,8 @@ type DependencyManager struct {
 	indexManager *IndexManager
 
 	// local repositories
-	local map[string]Repository
+	local      map[string]Repository
+	localMutex sync.RWMutex
 
 	// remote repositories
 	remote      map[string]*singleflightIndex
@@ -60,27 +64,61 @@ func NewDependencyManager(logger log.Logger, indexManager *IndexManager) *Depend
 
 // AddRepository adds a local repository for resolving local dependencies.
 func (dm *DependencyManager) AddRepository(repo Repository) {
+	dm.localMutex.Lock()
+	defer dm.localMutex.Unlock()
+
 	dm.local[repo.Name()] = repo
 }
 
+// RemoveRepository removes a local repository by name.
+func (dm *DependencyManager) RemoveRepository(name string) {
+	dm.localMutex.Lock()
+	defer dm.localMutex.Unlock()
+
+	delete(dm.local, name)
+}
+
 // IndexManager returns the index manager.
 func (dm *DependencyManager) IndexManager() *IndexManager {
 	return dm.indexManager
 }
 
+// resolvedDependency is a chart dependency resolved to the package of the
+// chart version it matches. The package is only fetched when the chart that
+// depends on it is archived.
+type resolvedDependency struct {
+	name string
+
+	// fingerprint identifies the contents of the package
+	fingerprint string
+
+	fetch func(context.Context) ([]byte, error)
+}
+
 // Download fetches multiple dependencies concurrently and returns a map of
 // the (chart name, archive data).
 func (dm *DependencyManager) Download(dependencies []*chartutil.Dependency) (map[string][]byte, error) {
+	resolved, err := dm.resolve(dependencies)
+	if err != nil {
+		return nil, err
+	}
+
+	return dm.fetch(resolved)
+}
+
+// resolve concurrently resolves dependencies to the packages of the chart
+// versions they match, without fetching them. Dependencies with a version
+// range resolve to the latest matching version, so the packages they resolve
+// to change as newer versions are indexed.
+func (dm *DependencyManager) resolve(dependencies []*chartutil.Dependency) ([]resolvedDependency, error) {
 	var wg sync.WaitGroup
 
 	type state struct {
-		data []byte
-		err  error
+		dependency resolvedDependency
+		err        error
 	}
 
 	states := make([]state, len(dependencies))
-	ctx, cancel := context.WithCancel(context.TODO())
-	defer cancel()
 
 	for idx, dep := range dependencies {
 		var err error
@@ -107,62 +145,152 @@ func (dm *DependencyManager) Download(dependencies []*chartutil.Dependency) (map
 			defer wg.Done()
 
 			if link.URL == nil {
-				states[idx].data, states[idx].err = dm.fetchLocalPackage(dep, link)
-				return
+				states[idx].dependency, states[idx].err = dm.resolveLocalPackage(dep, link)
+			} else {
+				states[idx].dependency, states[idx].err = dm.resolveRemotePackage(dep, link)
 			}
+		}(idx, dep, link)
+	}
 
-			packageURL, err := dm.getPackageURL(dep, link)
-			if err != nil {
-				states[idx].err = err
-				return
-			}
+	wg.Wait()
 
-			archive, err := dm.download(ctx, packageURL)
-			if err != nil {
-				states[idx].err = err
+	resolved := make([]resolvedDependency, len(dependencies))
+	for idx := range dependencies {
+		if err := states[idx].err; err != nil {
+			return nil, err
+		}
+		resolved[idx] = states[idx].dependency
+	}
+
+	return resolved, nil
+}
+
+// fetch fetches multiple resolved dependencies concurrently and returns a map
+// of the (chart name, archive data).
+func (dm *DependencyManager) fetch(dependencies []resolvedDependency) (map[string][]byte, error) {
+	var wg sync.WaitGroup
+
+	type state struct {
+		data []byte
+		err  error
+	}
+
+	states := make([]state, len(dependencies))
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	for idx, dep := range dependencies {
+		wg.Add(1)
+		go func(idx int, dep resolvedDependency) {
+			defer wg.Done()
+
+			states[idx].data, states[idx].err = dep.fetch(ctx)
+			if states[idx].err != nil {
 				cancel()
-				return
 			}
-
-			states[idx].data = archive
-		}(idx, dep, link)
+		}(idx, dep)
 	}
 
 	wg.Wait()
 
 	archives := make(map[string][]byte)
 	for idx, dep := range dependencies {
-		err := states[idx].err
-		if err != nil {
+		if err := states[idx].err; err != nil {
 			return nil, err
 		}
-		archives[dep.Name+".tgz"] = states[idx].data
+		archives[dep.name] = states[idx].data
 	}
 
 	return archives, nil
 }
 
-func (dm *DependencyManager) fetchLocalPackage(dep *chartutil.Dependency, link *repositoryLink) (body []byte, err error) {
+// fingerprintDependencies returns a fingerprint of the packages that
+// dependencies resolved to, or an empty string if there are none.
+func fingerprintDependencies(dependencies []resolvedDependency) string {
+	if len(dependencies) == 0 {
+		return ""
+	}
+
+	sorted := make([]resolvedDependency, len(dependencies))
+	copy(sorted, dependencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+
+	hash := sha256.New()
+	for _, dep := range sorted {
+		fmt.Fprintf(hash, "%s %s\n", dep.name, dep.fingerprint)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// digestDependents digests the charts of every local repository again, as
+// their dependencies may now resolve to different packages.
+func (dm *DependencyManager) digestDependents() {
+	dm.localMutex.RLock()
+	defer dm.localMutex.RUnlock()
+
+	for _, local := range dm.local {
+		if r, ok := local.(*repository); ok {
+			r.startDigesting()
+		}
+	}
+}
+
+func (dm *DependencyManager) resolveLocalPackage(dep *chartutil.Dependency, link *repositoryLink) (resolvedDependency, error) {
 	index, err := dm.indexManager.Get(link.Alias)
 	if err != nil {
-		return nil, err
+		return resolvedDependency{}, err
 	}
 
 	chart, err := index.Get(dep.Name, dep.Version)
 	if err != nil {
-		return nil, err
+		return resolvedDependency{}, err
 	}
 
 	repo, directory := repoCommitChartFromPath(chart.URLs[0])
-	archiver, err := dm.local[repo].ChartPackage(directory)
+
+	dm.localMutex.RLock()
+	local, ok := dm.local[repo]
+	dm.localMutex.RUnlock()
+	if !ok {
+		return resolvedDependency{}, ErrRepositoryNotFound
+	}
+
+	archiver, err := local.ChartPackage(directory)
 	if err != nil {
-		return nil, err
+		return resolvedDependency{}, err
 	}
 
-	buf := new(bytes.Buffer)
-	err = archiver.Archive(buf)
+	// a local package's contents change with the packages of its own
+	// dependencies
+	fingerprint := chart.URLs[0]
+	if f, ok := archiver.(Fingerprinter); ok && f.Fingerprint() != "" {
+		fingerprint += "@" + f.Fingerprint()
+	}
 
-	return buf.Bytes(), err
+	return resolvedDependency{
+		name:        dep.Name + ".tgz",
+		fingerprint: fingerprint,
+		fetch: func(context.Context) ([]byte, error) {
+			buf := new(bytes.Buffer)
+			err := archiver.Archive(buf)
+			return buf.Bytes(), err
+		},
+	}, nil
+}
+
+func (dm *DependencyManager) resolveRemotePackage(dep *chartutil.Dependency, link *repositoryLink) (resolvedDependency, error) {
+	packageURL, digest, err := dm.getPackageURL(dep, link)
+	if err != nil {
+		return resolvedDependency{}, err
+	}
+
+	return resolvedDependency{
+		name:        dep.Name + ".tgz",
+		fingerprint: packageURL.String() + "@" + digest,
+		fetch: func(ctx context.Context) ([]byte, error) {
+			return dm.download(ctx, packageURL)
+		},
+	}, nil
 }
 
 func (dm *DependencyManager) download(ctx context.Context, downloadURL *url.URL) (body []byte, err error) {
@@ -199,7 +327,10 @@ func (dm *DependencyManager) repository(repository string) *singleflightIndex {
 	return dm.remote[repository]
 }
 
-func (dm *DependencyManager) getPackageURL(dep *chartutil.Dependency, link *repositoryLink) (*url.URL, error) {
+// getPackageURL returns the URL and digest of the package a remote dependency
+// resolves to. The repository's index is downloaded again if the dependency
+// isn't in it, and the charts of local repositories are then digested again.
+func (dm *DependencyManager) getPackageURL(dep *chartutil.Dependency, link *repositoryLink) (*url.URL, string, error) {
 	index := dm.repository(dep.Repository)
 
 	index.Lock()
@@ -210,17 +341,18 @@ func (dm *DependencyManager) getPackageURL(dep *chartutil.Dependency, link *repo
 	if _, err := index.Get(dep.Name, dep.Version); err != nil {
 		body, err := dm.download(context.TODO(), link.URL)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 
 		if err := index.Unmarshal(body); err != nil {
-			return nil, err
+			return nil, "", err
 		}
+		dm.digestDependents()
 	}
 
 	chart, err := index.Get(dep.Name, dep.Version)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	var rawChartURL string
@@ -233,8 +365,8 @@ func (dm *DependencyManager) getPackageURL(dep *chartutil.Dependency, link *repo
 		chartURL, err = url.Parse(dep.Repository + "/" + chartURL.Path)
 	}
 	if err != nil {
-		return nil, fmt.Errorf("Chart dependency %v:%v has invalid package url: %v", dep.Name, dep.Version, rawChartURL)
+		return nil, "", fmt.Errorf("Chart dependency %v:%v has invalid package url: %v", dep.Name, dep.Version, rawChartURL)
 	}
 
-	return chartURL, nil
+	return chartURL, chart.Digest, nil
 }
@@ -0,0 +1,100 @@
+package repository
+
+import (
+	"container/heap"
+	"errors"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// commitHeap is a max-heap of commits ordered by committer time, so that
+// history is walked newest first, the same order as git log.
+type commitHeap []*object.Commit
+
+func (h commitHeap) Len() int           { return len(h) }
+func (h commitHeap) Less(i, j int) bool { return h[i].Committer.When.After(h[j].Committer.When) }
+func (h commitHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *commitHeap) Push(x interface{}) {
+	*h = append(*h, x.(*object.Commit))
+}
+
+func (h *commitHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// walkHistory calls fn for every commit reachable from head that is not in
+// the excluded set, newest first. Excluded commits are expected to have their
+// history excluded too, so the walk doesn't continue past them. The set of
+// walked commits is returned.
+func walkHistory(head *object.Commit, excluded map[plumbing.Hash]struct{}, fn func(*object.Commit) error) (map[plumbing.Hash]struct{}, error) {
+	walked := make(map[plumbing.Hash]struct{})
+
+	pending := &commitHeap{head}
+	for pending.Len() > 0 {
+		c := heap.Pop(pending).(*object.Commit)
+
+		if _, ok := excluded[c.Hash]; ok {
+			continue
+		}
+		if _, ok := walked[c.Hash]; ok {
+			continue
+		}
+		walked[c.Hash] = struct{}{}
+
+		if err := fn(c); err != nil {
+			return walked, err
+		}
+
+		err := c.Parents().ForEach(func(parent *object.Commit) error {
+			heap.Push(pending, parent)
+			return nil
+		})
+		if err != nil {
+			return walked, err
+		}
+	}
+
+	return walked, nil
+}
+
+// errFound stops a history walk early once a commit has been found
+var errFound = errors.New("found")
+
+// isAncestor returns whether the commit hash is reachable from head.
+func isAncestor(hash plumbing.Hash, head *object.Commit) (bool, error) {
+	_, err := walkHistory(head, nil, func(c *object.Commit) error {
+		if c.Hash == hash {
+			return errFound
+		}
+		return nil
+	})
+
+	switch err {
+	case errFound:
+		return true, nil
+	case nil:
+		return false, nil
+	}
+	return false, err
+}
+
+// reachableCommits returns the set of commits reachable from any of the heads.
+func reachableCommits(heads []*object.Commit) (map[plumbing.Hash]struct{}, error) {
+	reachable := make(map[plumbing.Hash]struct{})
+	for _, head := range heads {
+		walked, err := walkHistory(head, reachable, func(*object.Commit) error { return nil })
+		for hash := range walked {
+			reachable[hash] = struct{}{}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return reachable, nil
+}
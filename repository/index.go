@@ -3,7 +3,11 @@ package repository
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"io"
+	"sort"
 	"sync"
 	"time"
 
@@ -13,13 +17,17 @@ import (
 	"github.com/ghodss/yaml"
 )
 
-// Index handles the indexing of charts.
+// Index handles the indexing of charts. It is safe for concurrent use.
 type Index struct {
 	mutex sync.RWMutex
 	file  *repo.IndexFile
 
-	cache           []byte
-	cacheCompressed []byte
+	// serialized is the serialized index, cached until the index changes
+	serialized *SerializedIndex
+
+	// urls are the package URLs of the indexed chart versions, built when
+	// first needed
+	urls map[string]bool
 }
 
 // NewIndex returns a new Index.
@@ -34,33 +42,223 @@ func (i *Index) Add(md *chart.Metadata, urls []string, createdAt time.Time) bool
 	i.mutex.Lock()
 	defer i.mutex.Unlock()
 
-	cr := &repo.ChartVersion{
+	return i.add(&repo.ChartVersion{
 		URLs:     urls,
 		Metadata: md,
 		Created:  createdAt,
-	}
+	})
+}
 
+// add adds a chart version to the index. The mutex must be held.
+func (i *Index) add(cr *repo.ChartVersion) bool {
+	md := cr.Metadata
 	if ee, ok := i.file.Entries[md.Name]; !ok {
 		i.file.Entries[md.Name] = repo.ChartVersions{cr}
 	} else {
 		cv, err := i.file.Get(md.Name, md.Version)
 
 		if err != nil {
-			// If this is the first of this package+version, add it to the index
-			i.file.Entries[md.Name] = append(ee, cr)
+			// If this is the first of this package+version, add it to the index.
+			// Versions are kept sorted newest first, so that a version range
+			// resolves to the latest version that matches.
+			ee = append(ee, cr)
+			sort.Sort(sort.Reverse(ee))
+			i.file.Entries[md.Name] = ee
 		} else if cr.Created.After(cv.Created) {
-			// If this package+version already exists, always index the latest
-			*cv = *cr
+			// If this package+version already exists, always index the latest.
+			// The entry is replaced rather than updated, as the existing chart
+			// version may still be in use by a reader.
+			for idx := range ee {
+				if ee[idx] == cv {
+					ee[idx] = cr
+				}
+			}
 		} else {
 			return false
 		}
 	}
 
-	i.cache = nil
+	i.serialized = nil
+	i.urls = nil
+
+	return true
+}
+
+// Remove removes a specific chart version from the index.
+func (i *Index) Remove(name, version string) bool {
+	removed := i.RemoveFunc(func(cv *repo.ChartVersion) bool {
+		return cv.Name == name && cv.Version == version
+	})
+
+	return len(removed) > 0
+}
+
+// RemoveFunc removes all chart versions for which fn returns true, and
+// returns the removed chart versions.
+func (i *Index) RemoveFunc(fn func(*repo.ChartVersion) bool) []*repo.ChartVersion {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	return i.removeFunc(fn)
+}
+
+// removeFunc removes all chart versions for which fn returns true. The mutex
+// must be held.
+func (i *Index) removeFunc(fn func(*repo.ChartVersion) bool) []*repo.ChartVersion {
+	var removed []*repo.ChartVersion
+	for name, versions := range i.file.Entries {
+		kept := versions[:0]
+		for _, cv := range versions {
+			if fn(cv) {
+				removed = append(removed, cv)
+			} else {
+				kept = append(kept, cv)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(i.file.Entries, name)
+		} else {
+			i.file.Entries[name] = kept
+		}
+	}
+
+	if len(removed) > 0 {
+		i.serialized = nil
+		i.urls = nil
+	}
+
+	return removed
+}
+
+// RemoveRepository removes every chart version indexed from the named
+// repository, and returns the removed chart versions.
+func (i *Index) RemoveRepository(name string) []*repo.ChartVersion {
+	return i.RemoveFunc(indexedFrom(name))
+}
+
+// ReplaceRepository replaces every chart version indexed from the named
+// repository with versions, at once, so that readers never see the index
+// without either. Versions with the same package URL as a replaced version
+// keep its digest. It returns whether the index changed.
+func (i *Index) ReplaceRepository(name string, versions []*repo.ChartVersion) bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	replaced := make(map[string]*repo.ChartVersion)
+	for _, cv := range i.removeFunc(indexedFrom(name)) {
+		replaced[cv.URLs[0]] = cv
+	}
+
+	changed := false
+	for _, cv := range versions {
+		if len(cv.URLs) == 0 {
+			continue
+		}
+
+		// the version is copied, as it may still be in use by a reader of the
+		// index it came from
+		cr := *cv
+		if existing, ok := replaced[cr.URLs[0]]; ok {
+			if cr.Digest == "" {
+				cr.Digest = existing.Digest
+			}
+			delete(replaced, cr.URLs[0])
+		} else {
+			changed = true
+		}
+		i.add(&cr)
+	}
+
+	if !changed && len(replaced) == 0 {
+		return false
+	}
 
+	i.serialized = nil
+	i.urls = nil
 	return true
 }
 
+// indexedFrom returns a function reporting whether a chart version was
+// indexed from the named repository
+func indexedFrom(name string) func(*repo.ChartVersion) bool {
+	return func(cv *repo.ChartVersion) bool {
+		if len(cv.URLs) == 0 {
+			return false
+		}
+
+		repoName, _ := repoCommitChartFromPath(cv.URLs[0])
+		return repoName == name
+	}
+}
+
+// RepositoryNames returns the sorted names of the repositories that chart
+// versions were indexed from.
+func (i *Index) RepositoryNames() []string {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, versions := range i.file.Entries {
+		for _, cv := range versions {
+			if len(cv.URLs) == 0 {
+				continue
+			}
+
+			name, _ := repoCommitChartFromPath(cv.URLs[0])
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Find returns all chart versions for which fn returns true.
+func (i *Index) Find(fn func(*repo.ChartVersion) bool) []*repo.ChartVersion {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	var found []*repo.ChartVersion
+	for _, versions := range i.file.Entries {
+		for _, cv := range versions {
+			if fn(cv) {
+				found = append(found, cv)
+			}
+		}
+	}
+	return found
+}
+
+// SetDigest sets the digest of the chart version with the package URL, and
+// returns whether it was found.
+func (i *Index) SetDigest(url, digest string) bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	for _, versions := range i.file.Entries {
+		for idx, cv := range versions {
+			if len(cv.URLs) == 0 || cv.URLs[0] != url {
+				continue
+			}
+
+			// the entry is replaced rather than updated, as the existing
+			// chart version may still be in use by a reader
+			digested := *cv
+			digested.Digest = digest
+			versions[idx] = &digested
+
+			i.serialized = nil
+			return true
+		}
+	}
+	return false
+}
+
 // Get returns the metadata of a specific chart version.
 func (i *Index) Get(name, version string) (*repo.ChartVersion, error) {
 	i.mutex.RLock()
@@ -69,6 +267,32 @@ func (i *Index) Get(name, version string) (*repo.ChartVersion, error) {
 	return i.file.Get(name, version)
 }
 
+// ContainsURL returns whether a chart version in the index has the package
+// URL.
+func (i *Index) ContainsURL(url string) bool {
+	i.mutex.RLock()
+	urls := i.urls
+	i.mutex.RUnlock()
+
+	if urls == nil {
+		i.mutex.Lock()
+		if i.urls == nil {
+			i.urls = make(map[string]bool)
+			for _, versions := range i.file.Entries {
+				for _, cv := range versions {
+					for _, u := range cv.URLs {
+						i.urls[u] = true
+					}
+				}
+			}
+		}
+		urls = i.urls
+		i.mutex.Unlock()
+	}
+
+	return urls[url]
+}
+
 // Count returns the number of charts and versions indexed.
 func (i *Index) Count() (int, int) {
 	i.mutex.RLock()
@@ -82,63 +306,91 @@ func (i *Index) Count() (int, int) {
 	return len(i.file.Entries), versions
 }
 
+// SerializedIndex is a YAML serialized index
+type SerializedIndex struct {
+	Data       []byte
+	Compressed []byte
+
+	// ETag is a strong entity tag derived from the indexed chart versions, so
+	// that it only changes when they do
+	ETag string
+
+	// Generated is the time the index was serialized
+	Generated time.Time
+}
+
 // WriteTo writes out a YAML serialized representation of the Index. This data
 // is cached so that subsequent calls won't re-serialize an index that has not
 // changed.
 func (i *Index) WriteTo(w io.Writer) (n int64, err error) {
-	return i.writeTo(w, false)
+	serialized, err := i.Serialize()
+	if err != nil {
+		return 0, err
+	}
+
+	written, err := w.Write(serialized.Data)
+	return int64(written), err
 }
 
 // CompressedWriteTo is the same as WriteTo but with gzip compressed data.
 func (i *Index) CompressedWriteTo(w io.Writer) (n int64, err error) {
-	return i.writeTo(w, true)
+	serialized, err := i.Serialize()
+	if err != nil {
+		return 0, err
+	}
+
+	written, err := w.Write(serialized.Compressed)
+	return int64(written), err
 }
 
-func (i *Index) writeTo(w io.Writer, compressed bool) (n int64, err error) {
-	written, err := i.writeCache(w, compressed)
-	if err != nil || written > 0 {
-		return int64(written), err
+// Serialize returns the serialized index, which is cached until the index
+// changes.
+func (i *Index) Serialize() (*SerializedIndex, error) {
+	i.mutex.RLock()
+	serialized := i.serialized
+	i.mutex.RUnlock()
+
+	if serialized != nil {
+		return serialized, nil
 	}
 
 	i.mutex.Lock()
 	defer i.mutex.Unlock()
 
+	if i.serialized != nil {
+		return i.serialized, nil
+	}
+
 	i.file.SortEntries()
+
+	// the entity tag excludes the generated time, which changes every time the
+	// index is serialized
+	entries, err := json.Marshal(i.file.Entries)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(entries)
+
 	i.file.Generated = time.Now()
-	i.cache, err = yaml.Marshal(i.file)
+	data, err := yaml.Marshal(i.file)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	buf := new(bytes.Buffer)
 	compressor, _ := gzip.NewWriterLevel(buf, gzip.BestCompression)
-	if _, err = compressor.Write(i.cache); err != nil {
-		return 0, err
+	if _, err = compressor.Write(data); err != nil {
+		return nil, err
 	}
-
 	compressor.Close()
-	i.cacheCompressed = buf.Bytes()
-
-	if compressed {
-		written, err = w.Write(i.cacheCompressed)
-	} else {
-		written, err = w.Write(i.cache)
-	}
 
-	return int64(written), err
-}
-
-func (i *Index) writeCache(w io.Writer, compressed bool) (int, error) {
-	i.mutex.RLock()
-	defer i.mutex.RUnlock()
-
-	if i.cache == nil {
-		return 0, nil
-	}
-	if compressed {
-		return w.Write(i.cacheCompressed)
+	i.serialized = &SerializedIndex{
+		Data:       data,
+		Compressed: buf.Bytes(),
+		ETag:       `"` + hex.EncodeToString(sum[:]) + `"`,
+		Generated:  i.file.Generated,
 	}
-	return w.Write(i.cache)
+	return i.serialized, nil
 }
 
 // Unmarshal decodes a YAML serialized repository index.
@@ -146,7 +398,8 @@ func (i *Index) Unmarshal(data []byte) error {
 	i.mutex.Lock()
 	defer i.mutex.Unlock()
 
-	i.cache = nil
+	i.serialized = nil
+	i.urls = nil
 
 	return yaml.Unmarshal(data, i.file)
 }
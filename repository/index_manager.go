@@ -3,6 +3,7 @@ package repository
 import (
 	"errors"
 	"sort"
+	"sync"
 )
 
 var (
@@ -10,8 +11,9 @@ var (
 	ErrIndexNotFound = errors.New("index not found")
 )
 
-// IndexManager manages multiple indexes
+// IndexManager manages multiple indexes. It is safe for concurrent use.
 type IndexManager struct {
+	mutex   sync.RWMutex
 	indexes map[string]*Index
 }
 
@@ -24,6 +26,9 @@ func NewIndexManager() *IndexManager {
 
 // Get returns an instance by name
 func (m *IndexManager) Get(name string) (*Index, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
 	if index, ok := m.indexes[name]; ok {
 		return index, nil
 	}
@@ -33,6 +38,9 @@ func (m *IndexManager) Get(name string) (*Index, error) {
 
 // Names returns all index names assigned to the manager
 func (m *IndexManager) Names() []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
 	names := make([]string, 0, len(m.indexes))
 	for name := range m.indexes {
 		names = append(names, name)
@@ -44,9 +52,20 @@ func (m *IndexManager) Names() []string {
 
 // Create creates a new named index
 func (m *IndexManager) Create(name string) *Index {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	if _, ok := m.indexes[name]; !ok {
 		m.indexes[name] = NewIndex()
 	}
 
 	return m.indexes[name]
 }
+
+// Remove removes a named index
+func (m *IndexManager) Remove(name string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.indexes, name)
+}
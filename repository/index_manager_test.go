@@ -1,6 +1,7 @@
 package repository
 
 import (
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/suite"
@@ -31,6 +32,39 @@ func (suite *IndexManagerTestSuite) TestNames() {
 	suite.Len(suite.indexManager.Names(), 2)
 }
 
+func (suite *IndexManagerTestSuite) TestRemove() {
+	indexManager := NewIndexManager()
+	indexManager.Create("removed")
+	indexManager.Remove("removed")
+
+	_, err := indexManager.Get("removed")
+	suite.Equal(ErrIndexNotFound, err)
+	suite.Empty(indexManager.Names())
+}
+
+func (suite *IndexManagerTestSuite) TestConcurrentCreate() {
+	indexManager := NewIndexManager()
+
+	var wg sync.WaitGroup
+	indexes := make([]*Index, 10)
+	for i := range indexes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			indexes[i] = indexManager.Create("concurrent")
+			indexManager.Names()
+		}(i)
+	}
+	wg.Wait()
+
+	// every writer receives the same index
+	for _, index := range indexes {
+		suite.True(index == indexes[0])
+	}
+	suite.Equal([]string{"concurrent"}, indexManager.Names())
+}
+
 func TestIndexManagerTestSuite(t *testing.T) {
 	suite.Run(t, new(IndexManagerTestSuite))
 }
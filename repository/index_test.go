@@ -2,10 +2,14 @@ package repository
 
 import (
 	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sync"
 	"testing"
 	"time"
 
 	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/repo"
 
 	"github.com/stretchr/testify/suite"
 )
@@ -55,6 +59,183 @@ func (suite *IndexTestSuite) TestCount() {
 	suite.Equal(3, versions)
 }
 
+func (suite *IndexTestSuite) TestRemove() {
+	index := NewIndex()
+
+	for _, version := range []string{"0.1.0", "0.2.0"} {
+		md := &chart.Metadata{Name: "removable", Version: version}
+		suite.True(index.Add(md, []string{"foobar/removable-" + version + ".tgz"}, time.Now()))
+	}
+
+	suite.False(index.Remove("removable", "0.3.0"))
+	suite.True(index.Remove("removable", "0.1.0"))
+
+	_, err := index.Get("removable", "0.1.0")
+	suite.Error(err)
+
+	charts, versions := index.Count()
+	suite.Equal(1, charts)
+	suite.Equal(1, versions)
+
+	// removing the last version removes the chart
+	removed := index.RemoveFunc(func(cv *repo.ChartVersion) bool {
+		return cv.URLs[0] == "foobar/removable-0.2.0.tgz"
+	})
+	if suite.Len(removed, 1) {
+		suite.Equal("0.2.0", removed[0].Version)
+	}
+
+	charts, versions = index.Count()
+	suite.Equal(0, charts)
+	suite.Equal(0, versions)
+}
+
+func (suite *IndexTestSuite) TestRemoveRepository() {
+	index := NewIndex()
+
+	suite.True(index.Add(&chart.Metadata{Name: "shared", Version: "0.1.0"}, []string{repoCommitChartToPath("first", "abc", "charts", "shared", "0.1.0")}, time.Now()))
+	suite.True(index.Add(&chart.Metadata{Name: "shared", Version: "0.2.0"}, []string{repoCommitChartToPath("second", "def", "charts", "shared", "0.2.0")}, time.Now()))
+
+	removed := index.RemoveRepository("first")
+	if suite.Len(removed, 1) {
+		suite.Equal("0.1.0", removed[0].Version)
+	}
+	suite.Empty(index.RemoveRepository("first"))
+
+	_, err := index.Get("shared", "0.2.0")
+	suite.NoError(err)
+}
+
+func (suite *IndexTestSuite) TestReplaceRepository() {
+	index := NewIndex()
+
+	kept := repoCommitChartToPath("first", "abc", "charts", "shared", "0.1.0")
+	suite.True(index.Add(&chart.Metadata{Name: "shared", Version: "0.1.0"}, []string{kept}, time.Now()))
+	suite.True(index.Add(&chart.Metadata{Name: "shared", Version: "0.2.0"}, []string{repoCommitChartToPath("first", "def", "charts", "shared", "0.2.0")}, time.Now()))
+	suite.True(index.Add(&chart.Metadata{Name: "other", Version: "0.1.0"}, []string{repoCommitChartToPath("second", "abc", "charts", "other", "0.1.0")}, time.Now()))
+	suite.True(index.SetDigest(kept, "digest"))
+
+	staging := NewIndex()
+	suite.True(staging.Add(&chart.Metadata{Name: "shared", Version: "0.1.0"}, []string{kept}, time.Now()))
+	versions := staging.Find(func(*repo.ChartVersion) bool { return true })
+
+	// versions no longer indexed are removed, and those still indexed keep
+	// their digest
+	suite.True(index.ReplaceRepository("first", versions))
+	cv, err := index.Get("shared", "0.1.0")
+	if suite.NoError(err) {
+		suite.Equal("digest", cv.Digest)
+	}
+	_, err = index.Get("shared", "0.2.0")
+	suite.Error(err)
+	_, err = index.Get("other", "0.1.0")
+	suite.NoError(err)
+
+	suite.False(index.ReplaceRepository("first", versions))
+}
+
+func (suite *IndexTestSuite) TestRepositoryNames() {
+	index := NewIndex()
+	suite.Empty(index.RepositoryNames())
+
+	index.Add(&chart.Metadata{Name: "shared", Version: "0.1.0"}, []string{repoCommitChartToPath("second", "abc", "charts", "shared", "0.1.0")}, time.Now())
+	index.Add(&chart.Metadata{Name: "shared", Version: "0.2.0"}, []string{repoCommitChartToPath("first", "def", "charts", "shared", "0.2.0")}, time.Now())
+	index.Add(&chart.Metadata{Name: "other", Version: "0.1.0"}, []string{repoCommitChartToPath("first", "def", "charts", "other", "0.1.0")}, time.Now())
+
+	suite.Equal([]string{"first", "second"}, index.RepositoryNames())
+}
+
+func (suite *IndexTestSuite) TestGetLatest() {
+	index := NewIndex()
+	for _, version := range []string{"0.2.0", "0.1.0", "0.3.0", "1.0.0"} {
+		index.Add(&chart.Metadata{Name: "ranged", Version: version}, []string{"ranged-" + version + ".tgz"}, time.Now())
+	}
+
+	// a range resolves to the latest matching version, whatever the order the
+	// versions were added in
+	cv, err := index.Get("ranged", "~0.1")
+	if suite.NoError(err) {
+		suite.Equal("0.1.0", cv.Version)
+	}
+	cv, err = index.Get("ranged", "<1.0.0")
+	if suite.NoError(err) {
+		suite.Equal("0.3.0", cv.Version)
+	}
+	cv, err = index.Get("ranged", "")
+	if suite.NoError(err) {
+		suite.Equal("1.0.0", cv.Version)
+	}
+}
+
+func (suite *IndexTestSuite) TestContainsURL() {
+	index := NewIndex()
+	suite.False(index.ContainsURL("/repo/a/mychart-0.1.0.tgz"))
+
+	md := &chart.Metadata{Name: "mychart", Version: "0.1.0"}
+	index.Add(md, []string{"/repo/a/mychart-0.1.0.tgz"}, time.Now())
+	suite.True(index.ContainsURL("/repo/a/mychart-0.1.0.tgz"))
+
+	// replaced versions are no longer referenced
+	index.Add(md, []string{"/repo/b/mychart-0.1.0.tgz"}, time.Now().Add(time.Hour))
+	suite.False(index.ContainsURL("/repo/a/mychart-0.1.0.tgz"))
+	suite.True(index.ContainsURL("/repo/b/mychart-0.1.0.tgz"))
+
+	index.Remove("mychart", "0.1.0")
+	suite.False(index.ContainsURL("/repo/b/mychart-0.1.0.tgz"))
+}
+
+func (suite *IndexTestSuite) TestSetDigest() {
+	index := NewIndex()
+	index.Add(&chart.Metadata{Name: "mychart", Version: "0.1.0"}, []string{"/repo/a/mychart-0.1.0.tgz"}, time.Now())
+	index.Add(&chart.Metadata{Name: "mychart", Version: "0.2.0"}, []string{"/repo/b/mychart-0.2.0.tgz"}, time.Now())
+
+	undigested := func() []*repo.ChartVersion {
+		return index.Find(func(cv *repo.ChartVersion) bool { return cv.Digest == "" })
+	}
+	suite.Len(undigested(), 2)
+
+	previous, _ := index.Get("mychart", "0.1.0")
+	suite.True(index.SetDigest("/repo/a/mychart-0.1.0.tgz", "abc123"))
+	suite.False(index.SetDigest("/repo/c/mychart-0.3.0.tgz", "abc123"))
+
+	cv, err := index.Get("mychart", "0.1.0")
+	if suite.NoError(err) {
+		suite.Equal("abc123", cv.Digest)
+	}
+	if suite.Len(undigested(), 1) {
+		suite.Equal("0.2.0", undigested()[0].Version)
+	}
+
+	// chart versions already in use by readers are unchanged
+	suite.Empty(previous.Digest)
+
+	buf := new(bytes.Buffer)
+	_, err = index.WriteTo(buf)
+	suite.NoError(err)
+	suite.Contains(buf.String(), "digest: abc123")
+}
+
+func (suite *IndexTestSuite) TestConcurrentAdd() {
+	index := NewIndex()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			md := &chart.Metadata{Name: "concurrent", Version: fmt.Sprintf("0.%d.0", i%5)}
+			index.Add(md, []string{fmt.Sprintf("foobar/concurrent-%d.tgz", i)}, time.Now())
+			index.WriteTo(ioutil.Discard)
+		}(i)
+	}
+	wg.Wait()
+
+	charts, versions := index.Count()
+	suite.Equal(1, charts)
+	suite.Equal(5, versions)
+}
+
 func (suite *IndexTestSuite) TestWriteTo() {
 	buf := new(bytes.Buffer)
 
@@ -85,6 +266,33 @@ func (suite *IndexTestSuite) TestWriteTo() {
 	suite.NoError(err)
 }
 
+func (suite *IndexTestSuite) TestSerialize() {
+	index := NewIndex()
+	index.Add(&chart.Metadata{Name: "mychart", Version: "0.1.0"}, []string{"/repo/a/mychart-0.1.0.tgz"}, time.Unix(0, 0))
+
+	first, err := index.Serialize()
+	suite.Require().NoError(err)
+	suite.NotEmpty(first.ETag)
+
+	// the serialized index is cached until the index changes
+	second, err := index.Serialize()
+	suite.Require().NoError(err)
+	suite.True(first == second)
+
+	// the entity tag doesn't change if the index is serialized again without
+	// any change to its chart versions
+	suite.NoError(index.Unmarshal(first.Data))
+	second, err = index.Serialize()
+	suite.Require().NoError(err)
+	suite.False(first == second)
+	suite.Equal(first.ETag, second.ETag)
+
+	index.SetDigest("/repo/a/mychart-0.1.0.tgz", "abc123")
+	second, err = index.Serialize()
+	suite.Require().NoError(err)
+	suite.NotEqual(first.ETag, second.ETag)
+}
+
 func TestIndexTestSuite(t *testing.T) {
 	suite.Run(t, new(IndexTestSuite))
 }
@@ -0,0 +1,100 @@
+package repository
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+
+	"github.com/ghodss/yaml"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"golang.org/x/crypto/openpgp/packet"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/provenance"
+)
+
+// ErrProvenanceNotFound is raised when a chart package has no provenance file
+var ErrProvenanceNotFound = errors.New("provenance not found")
+
+// ProvenanceReader is implemented by repositories that can read provenance
+// files committed alongside their charts.
+type ProvenanceReader interface {
+	Provenance(name, filename string) ([]byte, error)
+}
+
+// Signer signs chart packages, producing the provenance files verified by
+// helm --verify.
+type Signer struct {
+	entity *openpgp.Entity
+}
+
+// NewSigner returns a signer using a private key of an OpenPGP keyring, such
+// as one exported with gpg --export-secret-keys. If key is not empty, the key
+// with an identity containing it is used, otherwise the first private key of
+// the keyring. Encrypted keys are decrypted with passphrase.
+func NewSigner(keyring, key string, passphrase []byte) (*Signer, error) {
+	signatory, err := provenance.NewFromKeyring(keyring, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if key == "" {
+		for _, entity := range signatory.KeyRing {
+			if entity.PrivateKey != nil {
+				signatory.Entity = entity
+				break
+			}
+		}
+	}
+	if signatory.Entity == nil {
+		if key == "" {
+			return nil, errors.New("no private key found in keyring")
+		}
+		return nil, fmt.Errorf("key %q not found in keyring", key)
+	}
+
+	if signatory.Entity.PrivateKey != nil && signatory.Entity.PrivateKey.Encrypted && len(passphrase) == 0 {
+		return nil, errors.New("private key is encrypted, and requires a passphrase")
+	}
+
+	err = signatory.DecryptKey(func(string) ([]byte, error) { return passphrase, nil })
+	if err != nil {
+		return nil, err
+	}
+
+	return &Signer{entity: signatory.Entity}, nil
+}
+
+// Sign returns the provenance file of a chart package, the clear signed
+// metadata of the chart and the SHA-256 digest of the package filename.
+func (s *Signer) Sign(md *chart.Metadata, filename, digest string) ([]byte, error) {
+	message, err := yaml.Marshal(md)
+	if err != nil {
+		return nil, err
+	}
+
+	// "---" isn't allowed in a clear signed message, so the YAML document end
+	// marker separates the metadata from the checksums, as helm does
+	sums, err := yaml.Marshal(&provenance.SumCollection{
+		Files: map[string]string{filename: "sha256:" + digest},
+	})
+	if err != nil {
+		return nil, err
+	}
+	message = append(append(message, "\n...\n"...), sums...)
+
+	buf := new(bytes.Buffer)
+	w, err := clearsign.Encode(buf, s.entity.PrivateKey, &packet.Config{DefaultHash: crypto.SHA512})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(message); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/provenance"
+)
+
+type ProvenanceTestSuite struct {
+	suite.Suite
+	dir     string
+	keyring string
+}
+
+func (suite *ProvenanceTestSuite) SetupTest() {
+	var err error
+	suite.dir, err = ioutil.TempDir("", "navigator-provenance")
+	suite.Require().NoError(err)
+
+	suite.keyring = filepath.Join(suite.dir, "secring.gpg")
+	f, err := os.Create(suite.keyring)
+	suite.Require().NoError(err)
+	defer f.Close()
+
+	for _, name := range []string{"first", "navigator"} {
+		entity, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+		suite.Require().NoError(err)
+		suite.Require().NoError(entity.SerializePrivate(f, nil))
+	}
+}
+
+func (suite *ProvenanceTestSuite) TearDownTest() {
+	os.RemoveAll(suite.dir)
+}
+
+func (suite *ProvenanceTestSuite) TestSign() {
+	signer, err := NewSigner(suite.keyring, "navigator@example.com", nil)
+	suite.Require().NoError(err)
+
+	archive := []byte("mychart archive")
+	sum := sha256.Sum256(archive)
+
+	prov, err := signer.Sign(&chart.Metadata{Name: "mychart", Version: "0.1.0"}, "mychart-0.1.0.tgz", hex.EncodeToString(sum[:]))
+	suite.Require().NoError(err)
+
+	// the provenance file verifies with helm
+	chartPath := filepath.Join(suite.dir, "mychart-0.1.0.tgz")
+	suite.Require().NoError(ioutil.WriteFile(chartPath, archive, 0644))
+	suite.Require().NoError(ioutil.WriteFile(chartPath+".prov", prov, 0644))
+
+	verifier, err := provenance.NewFromKeyring(suite.keyring, "")
+	suite.Require().NoError(err)
+
+	verification, err := verifier.Verify(chartPath, chartPath+".prov")
+	if suite.NoError(err) {
+		suite.Equal("mychart-0.1.0.tgz", verification.FileName)
+		suite.Contains(verification.SignedBy.Identities, "navigator <navigator@example.com>")
+	}
+
+	// a different archive doesn't verify
+	suite.Require().NoError(ioutil.WriteFile(chartPath, []byte("tampered"), 0644))
+	_, err = verifier.Verify(chartPath, chartPath+".prov")
+	suite.Error(err)
+}
+
+func (suite *ProvenanceTestSuite) TestNewSigner() {
+	// the first private key is used by default
+	signer, err := NewSigner(suite.keyring, "", nil)
+	if suite.NoError(err) {
+		suite.Contains(signer.entity.Identities, "first <first@example.com>")
+	}
+
+	_, err = NewSigner(suite.keyring, "missing", nil)
+	suite.Error(err)
+
+	_, err = NewSigner(suite.keyring, "example.com", nil)
+	suite.Error(err, "ambiguous key")
+
+	_, err = NewSigner(filepath.Join(suite.dir, "missing.gpg"), "", nil)
+	suite.Error(err)
+}
+
+func TestProvenanceTestSuite(t *testing.T) {
+	suite.Run(t, new(ProvenanceTestSuite))
+}
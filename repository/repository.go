@@ -6,6 +6,7 @@ import (
 	"io"
 	"path"
 	"strings"
+	"time"
 )
 
 var (
@@ -13,6 +14,12 @@ var (
 	ErrInvalidPackageName = errors.New("invalid package name")
 	// ErrRepositoryNotFound is raised when the helm repository referenced in a package link cannot be found
 	ErrRepositoryNotFound = errors.New("repository not found")
+	// ErrRepositoryNotReady is raised when a repository has not yet been cloned
+	ErrRepositoryNotReady = errors.New("repository not ready")
+	// ErrNoMatchingReferences is raised when none of the references in a git repository match the selected refs
+	ErrNoMatchingReferences = errors.New("no matching references")
+	// ErrStateMismatch is raised when restoring indexing state that was recorded for different refs or directories
+	ErrStateMismatch = errors.New("indexing state recorded for a different configuration")
 )
 
 // Archiver produces a compressed tar archive.
@@ -20,6 +27,15 @@ type Archiver interface {
 	Archive(io.Writer) error
 }
 
+// Fingerprinter is implemented by archivers of charts with dependencies. A
+// dependency with a version range resolves to the latest matching version, so
+// a chart's archive changes when a newer version of a dependency is indexed.
+// The fingerprint identifies the packages the dependencies resolved to, and
+// is empty for charts without dependencies, whose archive never changes.
+type Fingerprinter interface {
+	Fingerprint() string
+}
+
 // Repository represents a generic repository.
 type Repository interface {
 	URL() string
@@ -28,6 +44,55 @@ type Repository interface {
 	Update() error
 }
 
+// Snapshotter is implemented by repositories that can save and restore their
+// indexing state, so that indexing can resume where it left off. Restore
+// returns ErrStateMismatch, restoring nothing, if the state no longer matches
+// what the repository indexes.
+type Snapshotter interface {
+	Snapshot(io.Writer) error
+	Restore(io.Reader) error
+}
+
+// Reindexer is implemented by repositories that can discard their indexing
+// state, so that their next update indexes their entire history again.
+type Reindexer interface {
+	Reindex()
+}
+
+// Reauthenticator is implemented by repositories whose credentials can be
+// changed without indexing them again.
+type Reauthenticator interface {
+	SetCredentials(Credentials)
+}
+
+// Replacer is implemented by repositories created to replace a repository of
+// the same name whose refs or directories changed. Until replaced, charts are
+// indexed to staging indexes, so that the replaced repository's charts are
+// served until its replacement has indexed them again. Replace swaps the
+// replaced repository's chart versions in every index for those indexed by
+// the replacement, and returns the names of the indexes that changed. It's
+// called once, after the replacement's first successful update.
+type Replacer interface {
+	Replace() []string
+}
+
+// Stats are the statistics of a repository's most recent update
+type Stats struct {
+	// Heads are the last indexed commits, by reference name
+	Heads map[string]string
+
+	// FetchDuration and IndexDuration are how long the most recent successful
+	// fetch and indexing took
+	FetchDuration time.Duration
+	IndexDuration time.Duration
+}
+
+// StatsReporter is implemented by repositories that report statistics of
+// their updates.
+type StatsReporter interface {
+	Stats() Stats
+}
+
 // IndexDirectory maps a directory to a named index
 type IndexDirectory struct {
 	IndexName string
@@ -47,6 +112,28 @@ func (id IndexDirectories) Match(path string) bool {
 	return false
 }
 
+// IndexRef maps a git reference selector to a named index. The selector is a
+// glob pattern matched against branch names (eg. "main", "release-*") or, when
+// prefixed with "tags/", against tag names (eg. "tags/v*"). An empty IndexName
+// leaves charts in the index of the directory they were found in.
+type IndexRef struct {
+	IndexName string
+	Name      string
+}
+
+// IndexRefs is a slice of IndexRef
+type IndexRefs []IndexRef
+
+// Match returns the first IndexRef whose selector matches the reference name
+func (ir IndexRefs) Match(name string) (IndexRef, bool) {
+	for _, ref := range ir {
+		if ok, _ := path.Match(ref.Name, name); ok {
+			return ref, true
+		}
+	}
+	return IndexRef{}, false
+}
+
 // pathHeadTail is similar to path.Split, but returns the first component of the path (head) and then everything else as the tail
 func pathHeadTail(p string) (string, string) {
 	p = strings.TrimLeft(p, "/")
@@ -2,23 +2,32 @@ package repository
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"io"
 	"os"
 	"path"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/src-d/go-git.v4"
-	"gopkg.in/src-d/go-git.v4/config"
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
 	"gopkg.in/src-d/go-git.v4/storage/memory"
 	"gopkg.in/src-d/go-git.v4/utils/ioutil"
 
 	"k8s.io/helm/pkg/chartutil"
 	"k8s.io/helm/pkg/ignore"
 	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/repo"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -29,6 +38,14 @@ import (
 const (
 	requirementsName = "requirements.yaml"
 	lockfileName     = "requirements.lock"
+
+	remoteBranchPrefix = "refs/remotes/origin/"
+	tagPrefix          = "refs/tags/"
+
+	// digestRetryInterval is how long after failing a chart package is first
+	// digested again, doubling with each consecutive failure
+	digestRetryInterval    = time.Minute
+	maxDigestRetryInterval = time.Hour
 )
 
 type repository struct {
@@ -36,34 +53,121 @@ type repository struct {
 
 	name        string
 	url         string
-	backend     *git.Repository
+	dir         string
+	credentials Credentials
+	refs        []IndexRef
 	directories []IndexDirectory
 
+	// go-git storage doesn't support reads concurrent with writes, so chart
+	// packages are read with the mutex read locked and fetches write locked.
+	backend *git.Repository
+	mutex   sync.RWMutex
+
+	// updateMutex serializes updates, and guards the indexing state below
+	updateMutex sync.Mutex
+
 	dm *DependencyManager
 
+	// indexManager is the dependency manager's index manager, or the staging
+	// indexes of a replacement until Replace is called
 	indexManager *IndexManager
 
-	// A map of chart filename + file hash, so we know which charts have already
-	// been processed
+	// A map of index name + chart filename + file hash, so we know which charts
+	// have already been processed
 	visited map[string]struct{}
 
-	head plumbing.Hash
+	// The last indexed commit of each selected reference
+	heads map[plumbing.ReferenceName]plumbing.Hash
+
+	// The commits already parsed, by the index name of the reference they
+	// were found in. A parsed commit's history is always parsed too, so new
+	// heads only require walking back to the first parsed commit.
+	parsed map[string]map[plumbing.Hash]struct{}
+
+	statsMutex sync.Mutex
+	stats      Stats
+
+	// Charts are digested in the background, by at most one goroutine at a
+	// time. digestMutex guards whether it's running, and whether charts were
+	// indexed since it started.
+	digestMutex   sync.Mutex
+	digesting     bool
+	digestPending bool
+	digests       sync.WaitGroup
+
+	// The fingerprint of the dependencies each chart package was digested
+	// with, by URL, so that it's digested again when they resolve to other
+	// packages. Guarded by digestMutex.
+	fingerprints map[string]string
+
+	// The chart packages that failed to be digested, by URL. Only accessed by
+	// the digesting goroutine.
+	digestFailures map[string]digestFailure
+}
+
+// digestFailure records the consecutive failures to digest a chart package,
+// and when it's next tried
+type digestFailure struct {
+	attempts int
+	retry    time.Time
+}
+
+// selectedReference is a git reference that matched one of the repository's
+// ref selectors
+type selectedReference struct {
+	IndexRef
+	reference *plumbing.Reference
+}
+
+// NewGitBackedRepository returns a new git-backed based repository. If no refs
+// are provided, the history of the remote's default branch is indexed. If dir
+// is empty, the repository is stored in memory, otherwise it is cloned to, or
+// reused from, dir.
+func NewGitBackedRepository(logger log.Logger, dependencyManager *DependencyManager, name, url, dir string, credentials Credentials, refs []IndexRef, directories []IndexDirectory) Repository {
+	repo := newGitBackedRepository(logger, dependencyManager, name, url, dir, credentials, refs, directories)
+
+	dependencyManager.AddRepository(repo)
+	return repo
 }
 
-// NewGitBackedRepository returns a new git-backed based repository.
-func NewGitBackedRepository(logger log.Logger, dependencyManager *DependencyManager, name, url string, directories []IndexDirectory) Repository {
-	repo := &repository{
+// NewGitBackedReplacement returns a new git-backed based repository that
+// replaces the repository of the same name, as described by Replacer. Until
+// then, its charts are indexed to staging indexes, and the repository it
+// replaces continues to resolve dependencies on its charts.
+func NewGitBackedReplacement(logger log.Logger, dependencyManager *DependencyManager, name, url, dir string, credentials Credentials, refs []IndexRef, directories []IndexDirectory) Repository {
+	repo := newGitBackedRepository(logger, dependencyManager, name, url, dir, credentials, refs, directories)
+
+	repo.indexManager = NewIndexManager()
+	for _, directory := range directories {
+		repo.indexManager.Create(directory.IndexName)
+	}
+	for _, ref := range refs {
+		if ref.IndexName != "" {
+			repo.indexManager.Create(ref.IndexName)
+		}
+	}
+
+	return repo
+}
+
+func newGitBackedRepository(logger log.Logger, dependencyManager *DependencyManager, name, url, dir string, credentials Credentials, refs []IndexRef, directories []IndexDirectory) *repository {
+	return &repository{
 		logger:       logger,
 		name:         name,
 		url:          url,
+		dir:          dir,
+		credentials:  credentials,
+		refs:         refs,
 		directories:  directories,
 		visited:      make(map[string]struct{}),
+		heads:        make(map[plumbing.ReferenceName]plumbing.Hash),
+		parsed:       make(map[string]map[plumbing.Hash]struct{}),
 		indexManager: dependencyManager.IndexManager(),
 		dm:           dependencyManager,
-	}
 
-	dependencyManager.AddRepository(repo)
-	return repo
+		fingerprints:   make(map[string]string),
+		digestFailures: make(map[string]digestFailure),
+	}
 }
 
 func (r *repository) URL() string {
@@ -75,83 +179,390 @@ func (r *repository) Name() string {
 }
 
 func (r *repository) Update() (err error) {
+	r.updateMutex.Lock()
+	defer r.updateMutex.Unlock()
+
 	begin := time.Now()
 
-	if r.backend == nil {
-		r.backend, err = git.Clone(memory.NewStorage(), nil, &git.CloneOptions{
-			URL:           r.url,
-			ReferenceName: plumbing.Master,
-			SingleBranch:  true,
-		})
+	auth, err := r.credentials.authMethod(r.url)
+	if err != nil {
+		return err
+	}
+
+	if err = r.fetch(auth); err != nil {
+		return err
+	}
+
+	fetchDuration := time.Since(begin)
+	level.Info(r.logger).Log("event", "fetching", "repository", r.url, "took", fetchDuration)
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	refs, err := r.selectedReferences()
+	if err != nil {
+		return err
+	}
+
+	heads := make([]*object.Commit, len(refs))
+	for idx, ref := range refs {
+		heads[idx], err = r.referenceCommit(ref.reference)
 		if err != nil {
 			return err
 		}
-	} else {
-		err := r.backend.Fetch(&git.FetchOptions{RefSpecs: []config.RefSpec{"refs/heads/*:refs/heads/*"}})
-		if err != nil && err != git.NoErrAlreadyUpToDate {
+	}
+
+	rewritten, err := r.rewritten(refs, heads)
+	if err != nil {
+		return err
+	}
+	if rewritten {
+		if err = r.removeUnreachable(heads); err != nil {
 			return err
 		}
 	}
 
-	level.Info(r.logger).Log("event", "fetching", "repository", r.url, "took", time.Since(begin))
+	for idx, ref := range refs {
+		if err = r.indexReference(ref, heads[idx]); err != nil {
+			return err
+		}
+	}
 
-	var ref *plumbing.Reference
-	defer func(begin time.Time) {
-		if err == nil {
-			level.Info(r.logger).Log("event", "indexing", "repository", r.url, "head", ref.Hash(), "took", time.Since(begin))
-		} else {
-			level.Error(r.logger).Log("event", "indexing", "repository", r.url, "head", ref.Hash(), "took", time.Since(begin), "err", err)
+	// charts of this and other repositories can depend on the charts indexed
+	r.dm.digestDependents()
+
+	r.statsMutex.Lock()
+	r.stats = Stats{
+		Heads:         r.indexedHeads(),
+		FetchDuration: fetchDuration,
+		IndexDuration: time.Since(begin) - fetchDuration,
+	}
+	r.statsMutex.Unlock()
+
+	return nil
+}
+
+// Stats returns the statistics of the repository's most recent update
+func (r *repository) Stats() Stats {
+	r.statsMutex.Lock()
+	defer r.statsMutex.Unlock()
+
+	return r.stats
+}
+
+// indexedHeads returns a copy of the last indexed heads. The update mutex must
+// be held.
+func (r *repository) indexedHeads() map[string]string {
+	heads := make(map[string]string, len(r.heads))
+	for name, hash := range r.heads {
+		heads[name.String()] = hash.String()
+	}
+	return heads
+}
+
+// rewritten returns whether any previously indexed head is no longer in the
+// history of the reference it was indexed from, which happens when a branch is
+// force-pushed, or a reference is deleted and pruned by fetch.
+func (r *repository) rewritten(refs []selectedReference, heads []*object.Commit) (bool, error) {
+	current := make(map[plumbing.ReferenceName]*object.Commit)
+	for idx, ref := range refs {
+		current[ref.reference.Name()] = heads[idx]
+	}
+
+	var rewritten bool
+	for name, previous := range r.heads {
+		head, ok := current[name]
+		if ok {
+			if head.Hash == previous {
+				continue
+			}
+
+			fastForward, err := isAncestor(previous, head)
+			if err != nil {
+				return false, err
+			}
+			if fastForward {
+				continue
+			}
 		}
-	}(time.Now())
 
-	ref, err = r.backend.Head()
+		level.Info(r.logger).Log("event", "rewritten", "repository", r.url, "ref", name, "previous", previous)
+		rewritten = true
+	}
+
+	return rewritten, nil
+}
+
+// removeUnreachable removes the chart versions indexed from this repository
+// that are no longer reachable from any of the heads. The indexing state is
+// reset, so that the history of the heads is indexed again from scratch.
+func (r *repository) removeUnreachable(heads []*object.Commit) error {
+	reachable, err := reachableCommits(heads)
 	if err != nil {
 		return err
 	}
 
-	if r.head == ref.Hash() {
-		return nil
+	for _, indexName := range r.indexManager.Names() {
+		index, err := r.indexManager.Get(indexName)
+		if err != nil {
+			return err
+		}
+
+		removed := index.RemoveFunc(func(cv *repo.ChartVersion) bool {
+			if len(cv.URLs) == 0 {
+				return false
+			}
+
+			name, chartPath := repoCommitChartFromPath(cv.URLs[0])
+			if name != r.name {
+				return false
+			}
+
+			commit, _ := pathHeadTail(chartPath)
+			_, ok := reachable[plumbing.NewHash(commit)]
+			return !ok
+		})
+
+		for _, cv := range removed {
+			level.Info(r.logger).Log("event", "removed", "repository", r.url, "index", indexName, "chart", cv.Name, "version", cv.Version, "url", cv.URLs[0])
+		}
 	}
 
-	iter, err := r.backend.Log(&git.LogOptions{From: ref.Hash()})
-	if err != nil {
-		return err
+	r.resetState()
+
+	return nil
+}
+
+// startDigesting digests the chart versions indexed from this repository in
+// the background, so that archiving their packages doesn't hold up updates or
+// the fetches of the next ones. If charts are already being digested, they're
+// digested again once that finishes, to pick up the newly indexed versions.
+func (r *repository) startDigesting() {
+	r.digestMutex.Lock()
+	defer r.digestMutex.Unlock()
+
+	if r.digesting {
+		r.digestPending = true
+		return
+	}
+	r.digesting = true
+
+	r.digests.Add(1)
+	go func() {
+		defer r.digests.Done()
+
+		for {
+			r.digestCharts()
+
+			r.digestMutex.Lock()
+			if !r.digestPending {
+				r.digesting = false
+				r.digestMutex.Unlock()
+				return
+			}
+			r.digestPending = false
+			r.digestMutex.Unlock()
+		}
+	}()
+}
+
+// digestCharts sets the digest of the chart versions indexed from this
+// repository that don't have one yet, or whose dependencies resolve to other
+// packages than they were digested with. Chart versions whose package can't
+// be archived, for example because a dependency can't be downloaded, keep
+// their digest and are tried again after a delay that doubles with each
+// failure, up to maxDigestRetryInterval.
+func (r *repository) digestCharts() {
+	now := time.Now()
+	digests := make(map[string]string)
+	indexed := make(map[string]struct{})
+
+	r.digestMutex.Lock()
+	fingerprints := make(map[string]string, len(r.fingerprints))
+	for url, fingerprint := range r.fingerprints {
+		fingerprints[url] = fingerprint
+	}
+	r.digestMutex.Unlock()
+
+	for _, indexName := range r.indexManager.Names() {
+		index, err := r.indexManager.Get(indexName)
+		if err != nil {
+			continue
+		}
+
+		versions := index.Find(func(cv *repo.ChartVersion) bool {
+			if len(cv.URLs) == 0 {
+				return false
+			}
+
+			name, _ := repoCommitChartFromPath(cv.URLs[0])
+			if name != r.name {
+				return false
+			}
+			indexed[cv.URLs[0]] = struct{}{}
+
+			// charts without dependencies are only digested once
+			fingerprint, ok := fingerprints[cv.URLs[0]]
+			return cv.Digest == "" || !ok || fingerprint != ""
+		})
+
+		for _, cv := range versions {
+			url := cv.URLs[0]
+
+			digest, ok := digests[url]
+			if !ok {
+				failure, failed := r.digestFailures[url]
+				if failed && now.Before(failure.retry) {
+					continue
+				}
+
+				fingerprint, known := fingerprints[url]
+				if digest, fingerprint, err = r.digest(url, cv.Digest, fingerprint, known); err != nil {
+					failure.attempts++
+					failure.retry = now.Add(digestRetryDelay(failure.attempts))
+					r.digestFailures[url] = failure
+
+					level.Warn(r.logger).Log("event", "digest", "repository", r.url, "chart", cv.Name, "version", cv.Version, "url", url, "attempts", failure.attempts, "retry", failure.retry, "err", err)
+				} else {
+					delete(r.digestFailures, url)
+					fingerprints[url] = fingerprint
+				}
+				digests[url] = digest
+			}
+
+			if digest != "" && digest != cv.Digest {
+				index.SetDigest(url, digest)
+			}
+		}
+	}
+
+	// forget the chart versions that are no longer indexed
+	for url := range r.digestFailures {
+		if _, ok := indexed[url]; !ok {
+			delete(r.digestFailures, url)
+		}
+	}
+	for url := range fingerprints {
+		if _, ok := indexed[url]; !ok {
+			delete(fingerprints, url)
+		}
+	}
+
+	r.digestMutex.Lock()
+	r.fingerprints = fingerprints
+	r.digestMutex.Unlock()
+}
+
+// digestRetryDelay returns how long to wait before digesting a chart package
+// again after it failed the number of attempts
+func digestRetryDelay(attempts int) time.Duration {
+	delay := digestRetryInterval
+	for i := 1; i < attempts && delay < maxDigestRetryInterval; i++ {
+		delay *= 2
 	}
+	if delay > maxDigestRetryInterval {
+		delay = maxDigestRetryInterval
+	}
+	return delay
+}
 
-	err = iter.ForEach(r.parseCommit)
+// digest returns the hex encoded SHA-256 digest of the chart package at url,
+// and the fingerprint of the dependencies it was archived with. The package
+// isn't archived again if its current digest is of the same dependencies, or
+// of a chart without dependencies.
+func (r *repository) digest(url, current, fingerprint string, known bool) (string, string, error) {
+	_, chartPath := repoCommitChartFromPath(url)
+
+	archiver, err := r.ChartPackage(chartPath)
 	if err != nil {
+		return "", "", err
+	}
+
+	resolved := archiver.(Fingerprinter).Fingerprint()
+	if current != "" && (resolved == "" || (known && resolved == fingerprint)) {
+		return current, resolved, nil
+	}
+
+	hash := sha256.New()
+	if err = archiver.Archive(hash); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), resolved, nil
+}
+
+// fetch clones the repository if it has not yet been cloned, otherwise it
+// fetches changes from the remote. References deleted from the remote are
+// pruned.
+func (r *repository) fetch(auth transport.AuthMethod) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.backend == nil {
+		backend, err := r.clone(auth)
+		if err != nil {
+			return err
+		}
+
+		r.backend = backend
+		return r.prune(auth)
+	}
+
+	err := r.backend.Fetch(&git.FetchOptions{Auth: auth, Tags: git.AllTags})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
 		return err
 	}
-	r.head = ref.Hash()
 
-	return nil
+	return r.prune(auth)
 }
 
-func (r *repository) parseCommit(c *object.Commit) error {
-	level.Debug(r.logger).Log("event", "parsing", "commit", c.Hash.String())
+// prune removes the remote-tracking branches and tags that the remote no
+// longer advertises. go-git doesn't prune when fetching, so a deleted branch
+// or tag would otherwise keep resolving to its last commit, and its charts
+// would never be removed.
+func (r *repository) prune(auth transport.AuthMethod) error {
+	remote, err := r.backend.Remote(git.DefaultRemoteName)
+	if err != nil {
+		return err
+	}
 
-	tree, err := c.Tree()
+	advertised, err := remote.List(&git.ListOptions{Auth: auth})
 	if err != nil {
 		return err
 	}
 
-	for _, directory := range r.directories {
-		var subtree *object.Tree
+	exists := make(map[plumbing.ReferenceName]bool, len(advertised))
+	for _, ref := range advertised {
+		exists[ref.Name()] = true
+	}
 
-		if directory.Name == "" {
-			subtree = tree
-		} else {
-			subtree, err = tree.Tree(directory.Name)
-			if err == object.ErrDirectoryNotFound {
-				level.Debug(r.logger).Log("event", "parsing", "commit", c.Hash.String(), "directory", directory, "err", err)
-				return nil
+	iter, err := r.backend.References()
+	if err != nil {
+		return err
+	}
+
+	var stale []plumbing.ReferenceName
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name()
+		switch {
+		case strings.HasPrefix(name.String(), remoteBranchPrefix):
+			branch := strings.TrimPrefix(name.String(), remoteBranchPrefix)
+			if branch != "HEAD" && !exists[plumbing.NewBranchReferenceName(branch)] {
+				stale = append(stale, name)
 			}
-			if err != nil {
-				return err
+		case name.IsTag():
+			if !exists[name] {
+				stale = append(stale, name)
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-		if err = subtree.Files().ForEach(r.processFile(c, directory)); err != nil {
+	for _, name := range stale {
+		level.Info(r.logger).Log("event", "pruning", "repository", r.url, "ref", name)
+		if err = r.backend.Storer.RemoveReference(name); err != nil {
 			return err
 		}
 	}
@@ -159,6 +570,186 @@ func (r *repository) parseCommit(c *object.Commit) error {
 	return nil
 }
 
+// clone clones the repository into memory or, if the repository has a data
+// directory, onto disk. A clone that already exists on disk is reused and only
+// fetches what has changed.
+func (r *repository) clone(auth transport.AuthMethod) (*git.Repository, error) {
+	options := &git.CloneOptions{
+		URL:  r.url,
+		Auth: auth,
+		Tags: git.AllTags,
+	}
+
+	if r.dir == "" {
+		return git.Clone(memory.NewStorage(), nil, options)
+	}
+
+	backend, err := git.PlainOpen(r.dir)
+	if err == git.ErrRepositoryNotExists {
+		backend, err = git.PlainClone(r.dir, true, options)
+		if err != nil {
+			// remove partial clones so that the next update starts afresh
+			os.RemoveAll(r.dir)
+		}
+		return backend, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	level.Info(r.logger).Log("event", "reusing", "repository", r.url, "dir", r.dir)
+
+	err = backend.Fetch(&git.FetchOptions{Auth: auth, Tags: git.AllTags})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return nil, err
+	}
+
+	return backend, nil
+}
+
+// selectedReferences returns the fetched references matching the repository's
+// ref selectors, sorted by name.
+func (r *repository) selectedReferences() ([]selectedReference, error) {
+	selectors := IndexRefs(r.refs)
+	if len(selectors) == 0 {
+		head, err := r.backend.Head()
+		if err != nil {
+			return nil, err
+		}
+
+		// a detached head cannot be matched against a branch, so is indexed as-is
+		if !head.Name().IsBranch() {
+			return []selectedReference{{reference: head}}, nil
+		}
+		selectors = IndexRefs{{Name: head.Name().Short()}}
+	}
+
+	iter, err := r.backend.References()
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []selectedReference
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+
+		var name string
+		switch {
+		case strings.HasPrefix(ref.Name().String(), remoteBranchPrefix):
+			name = strings.TrimPrefix(ref.Name().String(), remoteBranchPrefix)
+		case ref.Name().IsTag():
+			name = path.Join("tags", strings.TrimPrefix(ref.Name().String(), tagPrefix))
+		default:
+			return nil
+		}
+
+		if selector, ok := selectors.Match(name); ok {
+			refs = append(refs, selectedReference{selector, ref})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(refs) == 0 {
+		return nil, ErrNoMatchingReferences
+	}
+
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].reference.Name() < refs[j].reference.Name()
+	})
+
+	return refs, nil
+}
+
+// referenceCommit returns the commit a reference points to, peeling annotated
+// tags.
+func (r *repository) referenceCommit(ref *plumbing.Reference) (*object.Commit, error) {
+	if tag, err := r.backend.TagObject(ref.Hash()); err == nil {
+		return tag.Commit()
+	}
+
+	return r.backend.CommitObject(ref.Hash())
+}
+
+func (r *repository) indexReference(ref selectedReference, commit *object.Commit) (err error) {
+	if r.heads[ref.reference.Name()] == commit.Hash {
+		return nil
+	}
+
+	var walked map[plumbing.Hash]struct{}
+	defer func(begin time.Time) {
+		if err == nil {
+			level.Info(r.logger).Log("event", "indexing", "repository", r.url, "ref", ref.reference.Name(), "head", commit.Hash, "commits", len(walked), "took", time.Since(begin))
+		} else {
+			level.Error(r.logger).Log("event", "indexing", "repository", r.url, "ref", ref.reference.Name(), "head", commit.Hash, "commits", len(walked), "took", time.Since(begin), "err", err)
+		}
+	}(time.Now())
+
+	parsed, ok := r.parsed[ref.IndexName]
+	if !ok {
+		parsed = make(map[plumbing.Hash]struct{})
+		r.parsed[ref.IndexName] = parsed
+	}
+
+	// only walk the commits that are not reachable from previously indexed heads
+	walked, err = walkHistory(commit, parsed, r.parseCommit(ref.IndexRef))
+	if err != nil {
+		return err
+	}
+
+	for hash := range walked {
+		parsed[hash] = struct{}{}
+	}
+	r.heads[ref.reference.Name()] = commit.Hash
+
+	return nil
+}
+
+// parseCommit returns a function that indexes the charts of a commit found in
+// the history of a reference. If the reference is mapped to an index, charts
+// are added to it rather than to their directory's index.
+func (r *repository) parseCommit(ref IndexRef) func(c *object.Commit) error {
+	return func(c *object.Commit) error {
+		level.Debug(r.logger).Log("event", "parsing", "commit", c.Hash.String())
+
+		tree, err := c.Tree()
+		if err != nil {
+			return err
+		}
+
+		for _, directory := range r.directories {
+			var subtree *object.Tree
+
+			if ref.IndexName != "" {
+				directory.IndexName = ref.IndexName
+			}
+
+			if directory.Name == "" {
+				subtree = tree
+			} else {
+				subtree, err = tree.Tree(directory.Name)
+				if err == object.ErrDirectoryNotFound {
+					level.Debug(r.logger).Log("event", "parsing", "commit", c.Hash.String(), "directory", directory.Name, "err", err)
+					continue
+				}
+				if err != nil {
+					return err
+				}
+			}
+
+			if err = subtree.Files().ForEach(r.processFile(c, directory)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
 func (r *repository) processFile(c *object.Commit, directory IndexDirectory) func(f *object.File) error {
 	return func(f *object.File) error {
 		// ignore if not Chart.yaml file
@@ -167,7 +758,7 @@ func (r *repository) processFile(c *object.Commit, directory IndexDirectory) fun
 		}
 
 		// ignore if already processed chart
-		key := f.Name + f.Hash.String()
+		key := directory.IndexName + ":" + f.Name + f.Hash.String()
 		if _, ok := r.visited[key]; ok {
 			level.Debug(r.logger).Log("event", "already-indexed", "commit", c.Hash.String(), "directory", directory.Name, "file", f.Name)
 			return nil
@@ -205,46 +796,287 @@ func (r *repository) ChartPackage(name string) (Archiver, error) {
 		return nil, ErrInvalidPackageName
 	}
 
-	hash := plumbing.NewHash(commit)
-	c, err := r.backend.CommitObject(hash)
+	// check that the package is in one of the specified directories
+	if !IndexDirectories(r.directories).Match(name) {
+		return nil, object.ErrDirectoryNotFound
+	}
+
+	// the lock is released before resolving dependencies, as they can be
+	// packages of this same repository
+	r.mutex.RLock()
+	modTime, tree, rules, dependencies, err := r.loadChart(plumbing.NewHash(commit), name)
+	r.mutex.RUnlock()
 	if err != nil {
 		return nil, err
 	}
 
-	tree, err := c.Tree()
+	deps, err := r.dm.resolve(dependencies)
 	if err != nil {
 		return nil, err
 	}
 
+	return &versionedChartPackage{
+		name:    path.Base(name),
+		rules:   rules,
+		files:   tree.Files(),
+		dm:      r.dm,
+		deps:    deps,
+		modTime: modTime,
+		lock:    r.mutex.RLocker(),
+	}, nil
+}
+
+// Provenance returns the provenance file of the chart package filename,
+// committed to the parent directory of the chart at the commit, alongside
+// where helm package --sign would write it.
+func (r *repository) Provenance(name, filename string) ([]byte, error) {
+	commit, name := pathHeadTail(name)
+	if name == "" || filename != path.Base(filename) {
+		return nil, ErrInvalidPackageName
+	}
+
 	// check that the package is in one of the specified directories
 	if !IndexDirectories(r.directories).Match(name) {
 		return nil, object.ErrDirectoryNotFound
 	}
 
-	tree, err = tree.Tree(name)
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if r.backend == nil {
+		return nil, ErrRepositoryNotReady
+	}
+
+	c, err := r.backend.CommitObject(plumbing.NewHash(commit))
 	if err != nil {
 		return nil, err
 	}
 
-	// load helm ignore file
-	rules, err := r.loadIgnoreFile(tree)
+	f, err := c.File(path.Join(path.Dir(name), filename+".prov"))
+	if err == object.ErrFileNotFound {
+		return nil, ErrProvenanceNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
+
+	contents, err := f.Contents()
+	return []byte(contents), err
+}
+
+// loadChart returns the commit time, and the tree, helm ignore rules and
+// dependencies of the chart directory at a commit.
+func (r *repository) loadChart(commit plumbing.Hash, name string) (modTime time.Time, tree *object.Tree, rules *ignore.Rules, dependencies []*chartutil.Dependency, err error) {
+	if r.backend == nil {
+		return modTime, nil, nil, nil, ErrRepositoryNotReady
+	}
+
+	c, err := r.backend.CommitObject(commit)
+	if err != nil {
+		return modTime, nil, nil, nil, err
+	}
+	modTime = c.Committer.When.UTC().Truncate(time.Second)
+
+	tree, err = c.Tree()
+	if err != nil {
+		return modTime, nil, nil, nil, err
+	}
+
+	tree, err = tree.Tree(name)
+	if err != nil {
+		return modTime, nil, nil, nil, err
+	}
+
+	// load helm ignore file
+	rules, err = r.loadIgnoreFile(tree)
+	if err != nil {
+		return modTime, nil, nil, nil, err
+	}
 	rules.AddDefaults()
 
 	// load helm dependencies
-	dependencies, err := r.loadDependencies(tree)
+	dependencies, err = r.loadDependencies(tree)
 	if err != nil {
-		return nil, err
+		return modTime, nil, nil, nil, err
+	}
+
+	return modTime, tree, rules, dependencies, nil
+}
+
+// repositoryState is the serialized indexing state of a repository
+type repositoryState struct {
+	Refs        []IndexRef
+	Directories []IndexDirectory
+
+	Heads   map[string]string
+	Visited []string
+	Parsed  map[string][]string
+
+	// Fingerprints are of the dependencies chart packages were digested with
+	Fingerprints map[string]string
+}
+
+// Snapshot writes the repository's indexing state, so that it can be restored
+// along with the indexes it was indexed to.
+func (r *repository) Snapshot(w io.Writer) error {
+	r.updateMutex.Lock()
+	defer r.updateMutex.Unlock()
+
+	state := repositoryState{
+		Refs:        r.refs,
+		Directories: r.directories,
+		Heads:       r.indexedHeads(),
+		Parsed:      make(map[string][]string),
 	}
 
-	deps, err := r.dm.Download(dependencies)
+	for key := range r.visited {
+		state.Visited = append(state.Visited, key)
+	}
+	for indexName, parsed := range r.parsed {
+		for hash := range parsed {
+			state.Parsed[indexName] = append(state.Parsed[indexName], hash.String())
+		}
+	}
+
+	r.digestMutex.Lock()
+	state.Fingerprints = make(map[string]string, len(r.fingerprints))
+	for url, fingerprint := range r.fingerprints {
+		state.Fingerprints[url] = fingerprint
+	}
+	r.digestMutex.Unlock()
+
+	return json.NewEncoder(w).Encode(state)
+}
+
+// Restore restores a previously snapshotted indexing state. State recorded for
+// different refs or directories no longer matches what is being indexed, and
+// ErrStateMismatch is returned. If the repository is stored on disk, the
+// existing clone is opened so that chart packages can be served before the
+// next update.
+func (r *repository) Restore(rd io.Reader) error {
+	var state repositoryState
+	if err := json.NewDecoder(rd).Decode(&state); err != nil {
+		return err
+	}
+
+	r.updateMutex.Lock()
+	defer r.updateMutex.Unlock()
+
+	if !reflect.DeepEqual(state.Refs, r.refs) || !reflect.DeepEqual(state.Directories, r.directories) {
+		return ErrStateMismatch
+	}
+
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	for name, hash := range state.Heads {
+		r.heads[plumbing.ReferenceName(name)] = plumbing.NewHash(hash)
+	}
+	for _, key := range state.Visited {
+		r.visited[key] = struct{}{}
+	}
+	for indexName, hashes := range state.Parsed {
+		parsed := make(map[plumbing.Hash]struct{}, len(hashes))
+		for _, hash := range hashes {
+			parsed[plumbing.NewHash(hash)] = struct{}{}
+		}
+		r.parsed[indexName] = parsed
+	}
+
+	r.digestMutex.Lock()
+	for url, fingerprint := range state.Fingerprints {
+		r.fingerprints[url] = fingerprint
+	}
+	r.digestMutex.Unlock()
+
+	r.statsMutex.Lock()
+	r.stats.Heads = r.indexedHeads()
+	r.statsMutex.Unlock()
+
+	level.Info(r.logger).Log("event", "restore", "repository", r.url, "heads", len(r.heads))
+
+	return nil
+}
+
+// Reindex discards the indexing state, so that the next update indexes the
+// history of every selected ref again.
+func (r *repository) Reindex() {
+	r.updateMutex.Lock()
+	defer r.updateMutex.Unlock()
+
+	r.resetState()
+}
+
+// resetState discards the indexing state. The update mutex must be held.
+func (r *repository) resetState() {
+	r.visited = make(map[string]struct{})
+	r.heads = make(map[plumbing.ReferenceName]plumbing.Hash)
+	r.parsed = make(map[string]map[plumbing.Hash]struct{})
+}
+
+// SetCredentials changes the credentials the repository is fetched with,
+// from its next update.
+func (r *repository) SetCredentials(credentials Credentials) {
+	r.updateMutex.Lock()
+	defer r.updateMutex.Unlock()
+
+	r.credentials = credentials
+}
+
+// Replace replaces the chart versions indexed from the repository of the same
+// name with those in the staging indexes, and from then on indexes charts to
+// the dependency manager's indexes. Digests of chart versions already indexed
+// by the replaced repository are kept, and the others are digested.
+func (r *repository) Replace() []string {
+	r.updateMutex.Lock()
+	defer r.updateMutex.Unlock()
+
+	staging := r.indexManager
+	r.indexManager = r.dm.IndexManager()
+
+	var changed []string
+	for _, indexName := range r.indexManager.Names() {
+		index, err := r.indexManager.Get(indexName)
+		if err != nil {
+			continue
+		}
+
+		var versions []*repo.ChartVersion
+		if staged, err := staging.Get(indexName); err == nil {
+			versions = staged.Find(func(*repo.ChartVersion) bool { return true })
+		}
+
+		if index.ReplaceRepository(r.name, versions) {
+			changed = append(changed, indexName)
+		}
+	}
+
+	level.Info(r.logger).Log("event", "replace", "repository", r.url, "indexes", strings.Join(changed, ","))
+
+	r.dm.AddRepository(r)
+	r.dm.digestDependents()
+
+	return changed
+}
+
+// open opens an existing clone on disk, if the repository hasn't already been
+// cloned.
+func (r *repository) open() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.dir == "" || r.backend != nil {
+		return nil
+	}
+
+	backend, err := git.PlainOpen(r.dir)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	r.backend = backend
 
-	return &versionedChartPackage{path.Base(name), rules, tree.Files(), deps}, nil
+	return nil
 }
 
 func (r *repository) loadMetadataFile(f *object.File) (*chart.Metadata, error) {
@@ -331,38 +1163,102 @@ func (f *fileInfo) IsDir() bool {
 }
 
 type versionedChartPackage struct {
-	name  string
-	rules *ignore.Rules
-	files *object.FileIter
-	deps  map[string][]byte
+	name    string
+	rules   *ignore.Rules
+	files   *object.FileIter
+	dm      *DependencyManager
+	deps    []resolvedDependency
+	modTime time.Time
+
+	// lock guards reading files from the repository storage
+	lock sync.Locker
+}
+
+// archiveEntry is a file written to a chart archive, either from the git tree
+// or a downloaded dependency
+type archiveEntry struct {
+	name string
+	mode int64
+	data []byte
 }
 
+// Archive writes the chart package as a gzip compressed tar archive. The
+// archive of a chart at a commit is always the same for the same resolved
+// dependencies: entries are sorted by name, their modification time is the
+// time of the commit, their mode is taken from the git tree (executable or
+// not), and the gzip header is fixed.
+//
+// Dependencies are fetched and the chart's files are read into memory first,
+// so that the repository isn't locked while the archive is written to a slow
+// client.
 func (a *versionedChartPackage) Archive(w io.Writer) (err error) {
+	deps, err := a.dm.fetch(a.deps)
+	if err != nil {
+		return err
+	}
+
+	entries, err := a.entries(deps)
+	if err != nil {
+		return err
+	}
+
 	zipper := gzip.NewWriter(w)
-	zipper.Header.Extra = []byte("+aHR0cHM6Ly95b3V0dS5iZS96OVV6MWljandyTQo=")
-	zipper.Header.Comment = "Helm"
-	defer zipper.Close()
+	zipper.Header = gzip.Header{Comment: "Helm", OS: 255}
+	defer func() {
+		if cerr := zipper.Close(); err == nil {
+			err = cerr
+		}
+	}()
 
 	twriter := tar.NewWriter(zipper)
-	defer twriter.Close()
+	defer func() {
+		if cerr := twriter.Close(); err == nil {
+			err = cerr
+		}
+	}()
 
-	for name, data := range a.deps {
+	for _, entry := range entries {
 		h := &tar.Header{
-			Name: path.Join(a.name, "charts", name),
-			Mode: 0755,
-			Size: int64(len(data)),
+			Typeflag: tar.TypeReg,
+			Name:     entry.name,
+			Mode:     entry.mode,
+			Size:     int64(len(entry.data)),
+			ModTime:  a.modTime,
 		}
 
-		if err := twriter.WriteHeader(h); err != nil {
+		if err = twriter.WriteHeader(h); err != nil {
 			return err
 		}
-
-		if _, err := twriter.Write(data); err != nil {
+		if _, err = twriter.Write(entry.data); err != nil {
 			return err
 		}
 	}
 
-	return a.files.ForEach(func(f *object.File) error {
+	return nil
+}
+
+// Fingerprint returns the fingerprint of the packages the chart's dependencies
+// resolved to.
+func (a *versionedChartPackage) Fingerprint() string {
+	return fingerprintDependencies(a.deps)
+}
+
+// entries returns the entries of the archive sorted by name, reading the
+// chart's files from the repository storage.
+func (a *versionedChartPackage) entries(deps map[string][]byte) ([]archiveEntry, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var entries []archiveEntry
+	for name, data := range deps {
+		entries = append(entries, archiveEntry{
+			name: path.Join(a.name, "charts", name),
+			mode: 0644,
+			data: data,
+		})
+	}
+
+	err := a.files.ForEach(func(f *object.File) error {
 		// ignore file
 		if a.rules.Ignore(f.Name, newFileInfo(path.Base(f.Name), false)) {
 			return nil
@@ -376,24 +1272,41 @@ func (a *versionedChartPackage) Archive(w io.Writer) (err error) {
 			}
 		}
 
-		h := &tar.Header{
-			Name: path.Join(a.name, f.Name),
-			Mode: 0755,
-			Size: f.Size,
-		}
-
-		if err := twriter.WriteHeader(h); err != nil {
-			return err
+		mode := int64(0644)
+		if f.Mode == filemode.Executable {
+			mode = 0755
 		}
 
-		r, err := f.Reader()
+		data, err := readFile(f)
 		if err != nil {
 			return err
 		}
-		defer ioutil.CheckClose(r, nil)
-
-		_, err = io.Copy(twriter, r)
 
-		return err
+		entries = append(entries, archiveEntry{
+			name: path.Join(a.name, f.Name),
+			mode: mode,
+			data: data,
+		})
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	return entries, nil
+}
+
+// readFile reads the contents of a file from the git tree
+func readFile(f *object.File) (data []byte, err error) {
+	r, err := f.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer ioutil.CheckClose(r, &err)
+
+	data = make([]byte, 0, f.Size)
+	buf := bytes.NewBuffer(data)
+	_, err = buf.ReadFrom(r)
+	return buf.Bytes(), err
 }
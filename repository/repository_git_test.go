@@ -1,15 +1,152 @@
 package repository
 
 import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"bytes"
 
 	"github.com/go-kit/kit/log"
 	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
 	"k8s.io/helm/pkg/chartutil"
 )
 
+// testGitRepository is a scratch git repository on disk that tests can
+// commit charts to.
+type testGitRepository struct {
+	dir  string
+	repo *git.Repository
+	when time.Time
+}
+
+func newTestGitRepository() (*testGitRepository, error) {
+	dir, err := ioutil.TempDir("", "navigator-repository")
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return &testGitRepository{dir: dir, repo: repo, when: time.Now().Add(-time.Hour)}, nil
+}
+
+// commitChart commits a chart's Chart.yaml, returning the commit hash.
+func (r *testGitRepository) commitChart(name, version string) (plumbing.Hash, error) {
+	filename := filepath.Join("charts", name, chartutil.ChartfileName)
+	if err := os.MkdirAll(filepath.Join(r.dir, "charts", name), 0755); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	data := fmt.Sprintf("name: %s\nversion: %s\n", name, version)
+	if err := ioutil.WriteFile(filepath.Join(r.dir, filename), []byte(data), 0644); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	w, err := r.repo.Worktree()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	if _, err = w.Add(filepath.ToSlash(filename)); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	// commits are a minute apart so that their order is deterministic
+	r.when = r.when.Add(time.Minute)
+	signature := &object.Signature{Name: "navigator", Email: "navigator@example.com", When: r.when}
+
+	return w.Commit(name+" "+version, &git.CommitOptions{Author: signature, Committer: signature})
+}
+
+// addFile adds a file to a chart, to be committed with the next commitChart.
+func (r *testGitRepository) addFile(name, filename, data string, mode os.FileMode) error {
+	filename = filepath.Join("charts", name, filename)
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(r.dir, filename)), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(r.dir, filename), []byte(data), mode); err != nil {
+		return err
+	}
+	if err := os.Chmod(filepath.Join(r.dir, filename), mode); err != nil {
+		return err
+	}
+
+	w, err := r.repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Add(filepath.ToSlash(filename))
+	return err
+}
+
+// reset hard resets the current branch to a commit, rewriting its history.
+func (r *testGitRepository) reset(hash plumbing.Hash) error {
+	w, err := r.repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	return w.Reset(&git.ResetOptions{Commit: hash, Mode: git.HardReset})
+}
+
+// checkout checks out a branch, creating it at the current commit if create is
+// set.
+func (r *testGitRepository) checkout(branch string, create bool) error {
+	w, err := r.repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	return w.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName(branch), Create: create})
+}
+
+// deleteBranch deletes a branch that isn't checked out.
+func (r *testGitRepository) deleteBranch(branch string) error {
+	return r.repo.Storer.RemoveReference(plumbing.NewBranchReferenceName(branch))
+}
+
+func (r *testGitRepository) Close() error {
+	return os.RemoveAll(r.dir)
+}
+
+// waitForDigests waits for the charts of a repository to be digested in the
+// background. go-git's filesystem storage isn't safe for concurrent reads, so
+// tests wait before reading from a repository again.
+func waitForDigests(repo Repository) {
+	repo.(*repository).digests.Wait()
+}
+
+// parseCounter is a logger that counts the commits parsed by a repository.
+type parseCounter struct {
+	commits map[string]int
+}
+
+func (c *parseCounter) Log(keyvals ...interface{}) error {
+	for i := 0; i+3 < len(keyvals); i += 2 {
+		if keyvals[i] == "event" && keyvals[i+1] == "parsing" && keyvals[i+2] == "commit" {
+			c.commits[fmt.Sprint(keyvals[i+3])]++
+		}
+	}
+	return nil
+}
+
 type RepositoryGitTestSuite struct {
 	suite.Suite
 	indexManager *IndexManager
@@ -31,13 +168,14 @@ func (suite *RepositoryGitTestSuite) SetupSuite() {
 	logger := log.NewNopLogger()
 	dependencyManager := NewDependencyManager(logger, suite.indexManager)
 
-	suite.repo = NewGitBackedRepository(logger, dependencyManager, "repo", "../.git", []IndexDirectory{{Name: "repository/testdata/charts", IndexName: "default"}})
+	suite.repo = NewGitBackedRepository(logger, dependencyManager, "repo", "../.git", "", Credentials{}, nil, []IndexDirectory{{Name: "repository/testdata/charts", IndexName: "default"}})
 
 	// clone
 	suite.Nil(suite.repo.Update())
 
 	// fetch
 	suite.Nil(suite.repo.Update())
+	waitForDigests(suite.repo)
 }
 
 func (suite *RepositoryGitTestSuite) TestURL() {
@@ -68,6 +206,579 @@ func (suite *RepositoryGitTestSuite) TestChartPackage() {
 	}
 }
 
+func (suite *RepositoryGitTestSuite) TestDigest() {
+	index, err := suite.indexManager.Get("default")
+	if !suite.NoError(err) {
+		return
+	}
+
+	for _, testChart := range testCharts {
+		chart, err := index.Get(testChart.Name, testChart.Version)
+		if !suite.NoError(err) {
+			continue
+		}
+
+		_, name := repoCommitChartFromPath(chart.URLs[0])
+		archiver, err := suite.repo.ChartPackage(name)
+		if !suite.NoError(err) {
+			continue
+		}
+
+		// the digest is of the archive that's served
+		hash := sha256.New()
+		if suite.NoError(archiver.Archive(hash)) {
+			suite.Equal(hex.EncodeToString(hash.Sum(nil)), chart.Digest, chart.Name)
+		}
+	}
+}
+
+func (suite *RepositoryGitTestSuite) TestDigestFailures() {
+	remote, err := newTestGitRepository()
+	if !suite.NoError(err) {
+		return
+	}
+	defer remote.Close()
+
+	suite.Require().NoError(remote.addFile("broken", requirementsName, "dependencies:\n- name: missing\n  version: 0.1.0\n  repository: alias:missing\n", 0644))
+	_, err = remote.commitChart("broken", "0.1.0")
+	suite.Require().NoError(err)
+	_, err = remote.commitChart("working", "0.1.0")
+	suite.Require().NoError(err)
+
+	indexManager := NewIndexManager()
+	index := indexManager.Create("default")
+	logger := log.NewNopLogger()
+	repo := NewGitBackedRepository(logger, NewDependencyManager(logger, indexManager), "failures", remote.dir, "", Credentials{}, nil, []IndexDirectory{{Name: "charts", IndexName: "default"}}).(*repository)
+
+	update := func() {
+		suite.Require().NoError(repo.Update())
+		waitForDigests(repo)
+	}
+	update()
+
+	working, err := index.Get("working", "0.1.0")
+	suite.Require().NoError(err)
+	suite.NotEmpty(working.Digest)
+
+	broken, err := index.Get("broken", "0.1.0")
+	suite.Require().NoError(err)
+	suite.Empty(broken.Digest)
+	suite.Equal(1, repo.digestFailures[broken.URLs[0]].attempts)
+
+	// failures aren't retried on every update
+	update()
+	suite.Equal(1, repo.digestFailures[broken.URLs[0]].attempts)
+
+	// but are once their retry is due, waiting longer each time
+	failure := repo.digestFailures[broken.URLs[0]]
+	failure.retry = time.Now()
+	repo.digestFailures[broken.URLs[0]] = failure
+	update()
+	suite.Equal(2, repo.digestFailures[broken.URLs[0]].attempts)
+	suite.True(repo.digestFailures[broken.URLs[0]].retry.After(time.Now().Add(digestRetryInterval)))
+}
+
+func (suite *RepositoryGitTestSuite) TestDependencyDigests() {
+	remote, err := newTestGitRepository()
+	if !suite.NoError(err) {
+		return
+	}
+	defer remote.Close()
+
+	_, err = remote.commitChart("dependency", "0.1.0")
+	suite.Require().NoError(err)
+	suite.Require().NoError(remote.addFile("dependent", requirementsName, "dependencies:\n- name: dependency\n  version: \">=0.1.0\"\n  repository: alias:default\n", 0644))
+	_, err = remote.commitChart("dependent", "0.1.0")
+	suite.Require().NoError(err)
+
+	indexManager := NewIndexManager()
+	index := indexManager.Create("default")
+	logger := log.NewNopLogger()
+	repo := NewGitBackedRepository(logger, NewDependencyManager(logger, indexManager), "dependencies", remote.dir, "", Credentials{}, nil, []IndexDirectory{{Name: "charts", IndexName: "default"}})
+
+	digest := func() (string, string) {
+		suite.Require().NoError(repo.Update())
+		waitForDigests(repo)
+
+		cv, err := index.Get("dependent", "0.1.0")
+		suite.Require().NoError(err)
+
+		_, name := repoCommitChartFromPath(cv.URLs[0])
+		archiver, err := repo.ChartPackage(name)
+		suite.Require().NoError(err)
+
+		hash := sha256.New()
+		suite.Require().NoError(archiver.Archive(hash))
+		return cv.Digest, hex.EncodeToString(hash.Sum(nil))
+	}
+
+	first, archived := digest()
+	suite.Equal(archived, first)
+
+	// the dependency's range now resolves to a newer version, changing the
+	// dependent chart's archive
+	_, err = remote.commitChart("dependency", "0.2.0")
+	suite.Require().NoError(err)
+
+	second, archived := digest()
+	suite.Equal(archived, second)
+	suite.NotEqual(first, second)
+}
+
+func (suite *RepositoryGitTestSuite) TestDigestRetryDelay() {
+	tests := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{7, time.Hour},
+		{100, time.Hour},
+	}
+
+	for idx, test := range tests {
+		suite.Equal(test.delay, digestRetryDelay(test.attempts), "test index: %v", idx)
+	}
+}
+
+func (suite *RepositoryGitTestSuite) TestReproducibleArchive() {
+	remote, err := newTestGitRepository()
+	if !suite.NoError(err) {
+		return
+	}
+	defer remote.Close()
+
+	suite.Require().NoError(remote.addFile("reproducible", "templates/service.yaml", "kind: Service\n", 0644))
+	suite.Require().NoError(remote.addFile("reproducible", "scripts/install.sh", "#!/bin/sh\n", 0755))
+	suite.Require().NoError(remote.addFile("reproducible", "README.md", "# reproducible\n", 0644))
+	hash, err := remote.commitChart("reproducible", "0.1.0")
+	suite.Require().NoError(err)
+
+	indexManager := NewIndexManager()
+	indexManager.Create("default")
+	logger := log.NewNopLogger()
+	repo := NewGitBackedRepository(logger, NewDependencyManager(logger, indexManager), "reproducible", remote.dir, "", Credentials{}, nil, []IndexDirectory{{Name: "charts", IndexName: "default"}})
+	suite.Require().NoError(repo.Update())
+
+	archive := func() []byte {
+		archiver, err := repo.ChartPackage(hash.String() + "/charts/reproducible")
+		suite.Require().NoError(err)
+
+		buf := new(bytes.Buffer)
+		suite.Require().NoError(archiver.Archive(buf))
+		return buf.Bytes()
+	}
+
+	// two builds of the same chart are identical
+	first := archive()
+	suite.Equal(first, archive())
+
+	zr, err := gzip.NewReader(bytes.NewReader(first))
+	suite.Require().NoError(err)
+	suite.Empty(zr.Header.Extra)
+	suite.True(zr.Header.ModTime.IsZero() || zr.Header.ModTime.Unix() == 0)
+
+	commit, err := remote.repo.CommitObject(hash)
+	suite.Require().NoError(err)
+
+	var names []string
+	modes := make(map[string]int64)
+	tr := tar.NewReader(zr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		suite.Require().NoError(err)
+
+		names = append(names, h.Name)
+		modes[h.Name] = h.Mode
+		suite.True(commit.Committer.When.Equal(h.ModTime), h.Name)
+	}
+
+	suite.Equal([]string{
+		"reproducible/Chart.yaml",
+		"reproducible/README.md",
+		"reproducible/scripts/install.sh",
+		"reproducible/templates/service.yaml",
+	}, names)
+	suite.Equal(int64(0644), modes["reproducible/Chart.yaml"])
+	suite.Equal(int64(0755), modes["reproducible/scripts/install.sh"])
+}
+
+// stalledWriter blocks writes until it's released, like a slow client
+type stalledWriter struct {
+	written chan struct{}
+	release chan struct{}
+}
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	select {
+	case w.written <- struct{}{}:
+	default:
+	}
+	<-w.release
+	return len(p), nil
+}
+
+func (suite *RepositoryGitTestSuite) TestArchiveUnlocked() {
+	index, err := suite.indexManager.Get("default")
+	suite.Require().NoError(err)
+
+	chart, err := index.Get("mychart", "0.1.0")
+	suite.Require().NoError(err)
+
+	_, name := repoCommitChartFromPath(chart.URLs[0])
+	archiver, err := suite.repo.ChartPackage(name)
+	suite.Require().NoError(err)
+
+	w := &stalledWriter{written: make(chan struct{}, 1), release: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() { done <- archiver.Archive(w) }()
+
+	select {
+	case <-w.written:
+	case <-time.After(5 * time.Second):
+		suite.FailNow("archive wasn't written")
+	}
+
+	// a fetch isn't blocked by the slow client
+	locked := make(chan struct{})
+	go func() {
+		repo := suite.repo.(*repository)
+		repo.mutex.Lock()
+		repo.mutex.Unlock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		suite.Fail("repository locked while archive is written")
+	}
+
+	close(w.release)
+	suite.NoError(<-done)
+}
+
+func (suite *RepositoryGitTestSuite) TestProvenance() {
+	remote, err := newTestGitRepository()
+	if !suite.NoError(err) {
+		return
+	}
+	defer remote.Close()
+
+	// provenance files are committed next to the chart directory
+	suite.Require().NoError(remote.addFile("", "signed-0.1.0.tgz.prov", "signature\n", 0644))
+	hash, err := remote.commitChart("signed", "0.1.0")
+	suite.Require().NoError(err)
+
+	indexManager := NewIndexManager()
+	indexManager.Create("default")
+	logger := log.NewNopLogger()
+	repo := NewGitBackedRepository(logger, NewDependencyManager(logger, indexManager), "signed", remote.dir, "", Credentials{}, nil, []IndexDirectory{{Name: "charts", IndexName: "default"}})
+	suite.Require().NoError(repo.Update())
+
+	reader := repo.(ProvenanceReader)
+	data, err := reader.Provenance(hash.String()+"/charts/signed", "signed-0.1.0.tgz")
+	if suite.NoError(err) {
+		suite.Equal("signature\n", string(data))
+	}
+
+	_, err = reader.Provenance(hash.String()+"/charts/signed", "signed-0.2.0.tgz")
+	suite.Equal(ErrProvenanceNotFound, err)
+
+	_, err = reader.Provenance(hash.String()+"/charts/signed", "../signed-0.1.0.tgz")
+	suite.Equal(ErrInvalidPackageName, err)
+}
+
+func (suite *RepositoryGitTestSuite) TestRefs() {
+	logger := log.NewNopLogger()
+	dependencyManager := NewDependencyManager(logger, suite.indexManager)
+
+	index := suite.indexManager.Create("branches")
+	repo := NewGitBackedRepository(logger, dependencyManager, "refs", "../.git", "", Credentials{}, []IndexRef{{Name: "*", IndexName: "branches"}}, []IndexDirectory{{Name: "repository/testdata/charts", IndexName: "default"}})
+	if suite.NoError(repo.Update()) {
+		for _, testChart := range testCharts {
+			_, err := index.Get(testChart.Name, testChart.Version)
+			suite.NoError(err)
+		}
+	}
+
+	repo = NewGitBackedRepository(logger, dependencyManager, "norefs", "../.git", "", Credentials{}, []IndexRef{{Name: "no-such-branch"}}, []IndexDirectory{{Name: "repository/testdata/charts", IndexName: "default"}})
+	suite.Equal(ErrNoMatchingReferences, repo.Update())
+}
+
+func (suite *RepositoryGitTestSuite) TestIncrementalUpdate() {
+	remote, err := newTestGitRepository()
+	if !suite.NoError(err) {
+		return
+	}
+	defer remote.Close()
+
+	first, err := remote.commitChart("incremental", "0.1.0")
+	if !suite.NoError(err) {
+		return
+	}
+
+	counter := &parseCounter{commits: make(map[string]int)}
+	indexManager := NewIndexManager()
+	index := indexManager.Create("default")
+	repo := NewGitBackedRepository(counter, NewDependencyManager(counter, indexManager), "incremental", remote.dir, "", Credentials{}, nil, []IndexDirectory{{Name: "charts", IndexName: "default"}})
+
+	if !suite.NoError(repo.Update()) {
+		return
+	}
+	suite.Equal(map[string]int{first.String(): 1}, counter.commits)
+
+	stats := repo.(StatsReporter).Stats()
+	if suite.Len(stats.Heads, 1) {
+		for _, head := range stats.Heads {
+			suite.Equal(first.String(), head)
+		}
+	}
+	suite.True(stats.FetchDuration > 0)
+
+	second, err := remote.commitChart("incremental", "0.2.0")
+	if !suite.NoError(err) {
+		return
+	}
+	third, err := remote.commitChart("incremental", "0.3.0")
+	if !suite.NoError(err) {
+		return
+	}
+
+	// only the new commits are parsed
+	if !suite.NoError(repo.Update()) {
+		return
+	}
+	suite.Equal(map[string]int{first.String(): 1, second.String(): 1, third.String(): 1}, counter.commits)
+
+	// nothing is parsed when the head hasn't changed
+	if !suite.NoError(repo.Update()) {
+		return
+	}
+	suite.Len(counter.commits, 3)
+
+	for _, version := range []string{"0.1.0", "0.2.0", "0.3.0"} {
+		_, err := index.Get("incremental", version)
+		suite.NoError(err, version)
+	}
+
+	// the entire history is parsed again after reindexing
+	repo.(Reindexer).Reindex()
+	if !suite.NoError(repo.Update()) {
+		return
+	}
+	suite.Equal(map[string]int{first.String(): 2, second.String(): 2, third.String(): 2}, counter.commits)
+}
+
+func (suite *RepositoryGitTestSuite) TestRewrittenHistory() {
+	remote, err := newTestGitRepository()
+	if !suite.NoError(err) {
+		return
+	}
+	defer remote.Close()
+
+	first, err := remote.commitChart("rewritten", "0.1.0")
+	if !suite.NoError(err) {
+		return
+	}
+	if _, err = remote.commitChart("rewritten", "0.2.0"); !suite.NoError(err) {
+		return
+	}
+
+	logger := log.NewNopLogger()
+	indexManager := NewIndexManager()
+	index := indexManager.Create("default")
+	repo := NewGitBackedRepository(logger, NewDependencyManager(logger, indexManager), "rewritten", remote.dir, "", Credentials{}, nil, []IndexDirectory{{Name: "charts", IndexName: "default"}})
+
+	if !suite.NoError(repo.Update()) {
+		return
+	}
+	_, err = index.Get("rewritten", "0.2.0")
+	suite.NoError(err)
+
+	// force-push: drop the 0.2.0 commit and replace it with 0.3.0
+	if !suite.NoError(remote.reset(first)) {
+		return
+	}
+	if _, err = remote.commitChart("rewritten", "0.3.0"); !suite.NoError(err) {
+		return
+	}
+
+	if !suite.NoError(repo.Update()) {
+		return
+	}
+
+	_, err = index.Get("rewritten", "0.2.0")
+	suite.Error(err)
+
+	for _, version := range []string{"0.1.0", "0.3.0"} {
+		cv, err := index.Get("rewritten", version)
+		if suite.NoError(err, version) {
+			_, name := repoCommitChartFromPath(cv.URLs[0])
+			_, err = repo.ChartPackage(name)
+			suite.NoError(err, version)
+		}
+	}
+}
+
+func (suite *RepositoryGitTestSuite) TestDeletedReference() {
+	remote, err := newTestGitRepository()
+	if !suite.NoError(err) {
+		return
+	}
+	defer remote.Close()
+
+	if _, err = remote.commitChart("deleted", "0.1.0"); !suite.NoError(err) {
+		return
+	}
+	suite.Require().NoError(remote.checkout("feature", true))
+	if _, err = remote.commitChart("deleted", "0.2.0"); !suite.NoError(err) {
+		return
+	}
+	suite.Require().NoError(remote.checkout("master", false))
+
+	logger := log.NewNopLogger()
+	indexManager := NewIndexManager()
+	index := indexManager.Create("default")
+	repo := NewGitBackedRepository(logger, NewDependencyManager(logger, indexManager), "deleted", remote.dir, "", Credentials{}, []IndexRef{{Name: "*"}}, []IndexDirectory{{Name: "charts", IndexName: "default"}})
+
+	if !suite.NoError(repo.Update()) {
+		return
+	}
+	_, err = index.Get("deleted", "0.2.0")
+	suite.NoError(err)
+
+	// the charts only found on a deleted branch are removed
+	suite.Require().NoError(remote.deleteBranch("feature"))
+	if !suite.NoError(repo.Update()) {
+		return
+	}
+
+	_, err = index.Get("deleted", "0.2.0")
+	suite.Error(err)
+	_, err = index.Get("deleted", "0.1.0")
+	suite.NoError(err)
+
+	heads := repo.(StatsReporter).Stats().Heads
+	suite.Len(heads, 1)
+	suite.Contains(heads, "refs/remotes/origin/master")
+}
+
+func (suite *RepositoryGitTestSuite) TestPersistentStorage() {
+	remote, err := newTestGitRepository()
+	if !suite.NoError(err) {
+		return
+	}
+	defer remote.Close()
+
+	if _, err = remote.commitChart("persistent", "0.1.0"); !suite.NoError(err) {
+		return
+	}
+
+	dataDir, err := ioutil.TempDir("", "navigator-data")
+	if !suite.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dataDir)
+
+	dir := filepath.Join(dataDir, "persistent")
+	for _, version := range []string{"0.2.0", "0.3.0"} {
+		logger := log.NewNopLogger()
+		indexManager := NewIndexManager()
+		index := indexManager.Create("default")
+		repo := NewGitBackedRepository(logger, NewDependencyManager(logger, indexManager), "persistent", remote.dir, dir, Credentials{}, nil, []IndexDirectory{{Name: "charts", IndexName: "default"}})
+
+		// the first repository clones to disk, the second reuses the clone
+		if !suite.NoError(repo.Update()) {
+			return
+		}
+		waitForDigests(repo)
+		_, err = git.PlainOpen(dir)
+		suite.NoError(err)
+
+		if _, err = remote.commitChart("persistent", version); !suite.NoError(err) {
+			return
+		}
+		if !suite.NoError(repo.Update()) {
+			return
+		}
+		waitForDigests(repo)
+
+		cv, err := index.Get("persistent", version)
+		if suite.NoError(err, version) {
+			_, name := repoCommitChartFromPath(cv.URLs[0])
+			_, err = repo.ChartPackage(name)
+			suite.NoError(err, version)
+		}
+	}
+}
+
+func (suite *RepositoryGitTestSuite) TestSnapshotRestore() {
+	remote, err := newTestGitRepository()
+	if !suite.NoError(err) {
+		return
+	}
+	defer remote.Close()
+
+	first, err := remote.commitChart("snapshot", "0.1.0")
+	if !suite.NoError(err) {
+		return
+	}
+
+	dataDir, err := ioutil.TempDir("", "navigator-data")
+	if !suite.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dataDir)
+
+	newRepository := func(counter *parseCounter) Repository {
+		indexManager := NewIndexManager()
+		indexManager.Create("default")
+		return NewGitBackedRepository(counter, NewDependencyManager(counter, indexManager), "snapshot", remote.dir, dataDir, Credentials{}, nil, []IndexDirectory{{Name: "charts", IndexName: "default"}})
+	}
+
+	counter := &parseCounter{commits: make(map[string]int)}
+	repo := newRepository(counter)
+	if !suite.NoError(repo.Update()) {
+		return
+	}
+	suite.Equal(map[string]int{first.String(): 1}, counter.commits)
+
+	snapshot := new(bytes.Buffer)
+	if !suite.NoError(repo.(Snapshotter).Snapshot(snapshot)) {
+		return
+	}
+
+	second, err := remote.commitChart("snapshot", "0.2.0")
+	if !suite.NoError(err) {
+		return
+	}
+
+	// a restored repository resumes from the last indexed head
+	counter = &parseCounter{commits: make(map[string]int)}
+	repo = newRepository(counter)
+	if !suite.NoError(repo.(Snapshotter).Restore(bytes.NewReader(snapshot.Bytes()))) {
+		return
+	}
+	if suite.NoError(repo.Update()) {
+		suite.Equal(map[string]int{second.String(): 1}, counter.commits)
+	}
+
+	// state from a differently configured repository is ignored
+	counter = &parseCounter{commits: make(map[string]int)}
+	indexManager := NewIndexManager()
+	indexManager.Create("default")
+	repo = NewGitBackedRepository(counter, NewDependencyManager(counter, indexManager), "snapshot", remote.dir, dataDir, Credentials{}, nil, []IndexDirectory{{Name: "", IndexName: "default"}})
+	suite.Equal(ErrStateMismatch, repo.(Snapshotter).Restore(bytes.NewReader(snapshot.Bytes())))
+	if suite.NoError(repo.Update()) {
+		suite.Len(counter.commits, 2)
+	}
+}
+
 func TestRepositoryGitTestSuite(t *testing.T) {
 	suite.Run(t, new(RepositoryGitTestSuite))
 }
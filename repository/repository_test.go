@@ -52,6 +52,32 @@ func (suite *RepositoryTestSuite) TestIndexDirectoryMatch() {
 	suite.True(directories.Match("stable"))
 }
 
+func (suite *RepositoryTestSuite) TestIndexRefMatch() {
+	refs := IndexRefs{
+		{Name: "main"},
+		{Name: "release-*", IndexName: "releases"},
+		{Name: "tags/v*", IndexName: "tagged"},
+	}
+
+	_, ok := refs.Match("develop")
+	suite.False(ok)
+
+	ref, ok := refs.Match("main")
+	suite.True(ok)
+	suite.Equal("", ref.IndexName)
+
+	ref, ok = refs.Match("release-1.0")
+	suite.True(ok)
+	suite.Equal("releases", ref.IndexName)
+
+	ref, ok = refs.Match("tags/v0.1.0")
+	suite.True(ok)
+	suite.Equal("tagged", ref.IndexName)
+
+	_, ok = refs.Match("v0.1.0")
+	suite.False(ok)
+}
+
 func (suite *RepositoryTestSuite) TestPathUtility() {
 	headtails := [][3]string{
 		{"a/b", "a", "b"},
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"path"
+)
+
+var errForbidden = errors.New("access denied")
+
+// AccessRule allows identities to read indexes, and the chart packages they
+// reference. Indexes are glob patterns matched against index names. Users and
+// Groups are the names and groups of the identities allowed, where "*" allows
+// any authenticated identity.
+type AccessRule struct {
+	Indexes []string
+	Users   []string
+	Groups  []string
+}
+
+// allows returns whether the rule allows the identity to read the index
+func (r AccessRule) allows(identity Identity, indexName string) bool {
+	matched := false
+	for _, pattern := range r.Indexes {
+		if ok, _ := path.Match(pattern, indexName); ok {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return false
+	}
+
+	// identities without a name are anonymous, and never allowed
+	if identity.Name == "" {
+		return false
+	}
+
+	for _, user := range r.Users {
+		if user == "*" || user == identity.Name {
+			return true
+		}
+	}
+	for _, group := range r.Groups {
+		for _, g := range identity.Groups {
+			if group == "*" || group == g {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setAccessRules sets the access rules. If there are no rules, every index can
+// be read.
+func (s *Server) setAccessRules(rules []AccessRule) {
+	s.accessMutex.Lock()
+	defer s.accessMutex.Unlock()
+
+	s.accessRules = rules
+}
+
+// canReadIndex returns whether the client that made the request can read the
+// index
+func (s *Server) canReadIndex(r *http.Request, indexName string) bool {
+	s.accessMutex.RLock()
+	defer s.accessMutex.RUnlock()
+
+	if len(s.accessRules) == 0 {
+		return true
+	}
+
+	identity, _ := RequestIdentity(r)
+	for _, rule := range s.accessRules {
+		if rule.allows(identity, indexName) {
+			return true
+		}
+	}
+	return false
+}
+
+// canReadPackage returns whether the client that made the request can read the
+// chart package at url, which requires it to be referenced by an index the
+// client can read
+func (s *Server) canReadPackage(r *http.Request, url string) bool {
+	s.accessMutex.RLock()
+	restricted := len(s.accessRules) > 0
+	s.accessMutex.RUnlock()
+
+	if !restricted {
+		return true
+	}
+
+	for _, indexName := range s.indexManager.Names() {
+		if !s.canReadIndex(r, indexName) {
+			continue
+		}
+
+		index, err := s.indexManager.Get(indexName)
+		if err == nil && index.ContainsURL(url) {
+			return true
+		}
+	}
+	return false
+}
+
+// canReadRepository returns whether the client that made the request can read
+// any of the indexes a repository's charts are indexed into
+func (s *Server) canReadRepository(r *http.Request, repo repositoryResponse) bool {
+	for _, ref := range repo.Refs {
+		if ref.Index != "" && s.canReadIndex(r, ref.Index) {
+			return true
+		}
+	}
+	for _, directory := range repo.Directories {
+		if s.canReadIndex(r, directory.Index) {
+			return true
+		}
+	}
+	return false
+}
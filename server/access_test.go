@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/suite"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+)
+
+type AccessTestSuite struct {
+	suite.Suite
+	navigator *Server
+}
+
+func (suite *AccessTestSuite) SetupTest() {
+	suite.navigator = New(log.NewNopLogger(), Authentication(
+		staticAuthenticator{"alice", Identity{Name: "alice"}},
+		staticAuthenticator{"bob", Identity{Name: "bob", Groups: []string{"team-a"}}},
+		staticAuthenticator{"carol", Identity{Name: "carol"}},
+	))
+
+	stable := suite.navigator.indexManager.Create("stable")
+	stable.Add(&chart.Metadata{Name: "public", Version: "0.1.0"}, []string{"/repo/abc/charts/public-0.1.0.tgz"}, time.Now())
+
+	teamA := suite.navigator.indexManager.Create("team-a")
+	teamA.Add(&chart.Metadata{Name: "private", Version: "0.1.0"}, []string{"/repo/abc/team-a/private-0.1.0.tgz"}, time.Now())
+
+	suite.navigator.Reconfigure(Config{
+		Indexes: []string{"stable", "team-a"},
+		Access: []AccessRule{
+			{Indexes: []string{"stable"}, Users: []string{"*"}},
+			{Indexes: []string{"team-*"}, Users: []string{"alice"}, Groups: []string{"team-a"}},
+		},
+	})
+}
+
+func (suite *AccessTestSuite) status(username, path string) int {
+	req := httptest.NewRequest("GET", path, nil)
+	req.SetBasicAuth(username, "password")
+
+	res := httptest.NewRecorder()
+	suite.navigator.ServeHTTP(res, req)
+	return res.Code
+}
+
+func (suite *AccessTestSuite) TestIndexes() {
+	suite.Equal(http.StatusOK, suite.status("alice", "/stable/index.yaml"))
+	suite.Equal(http.StatusOK, suite.status("alice", "/team-a/index.yaml"))
+	suite.Equal(http.StatusOK, suite.status("bob", "/team-a/index.yaml"))
+	suite.Equal(http.StatusOK, suite.status("carol", "/stable/index.yaml"))
+	suite.Equal(http.StatusForbidden, suite.status("carol", "/team-a/index.yaml"))
+
+	// indexes that don't exist aren't revealed to clients without access
+	suite.Equal(http.StatusForbidden, suite.status("carol", "/team-b/index.yaml"))
+	suite.Equal(http.StatusNotFound, suite.status("alice", "/team-b/index.yaml"))
+}
+
+func (suite *AccessTestSuite) TestPackages() {
+	// packages that can be read fail later, as the repository doesn't exist
+	suite.Equal(http.StatusNotFound, suite.status("carol", "/repo/abc/charts/public-0.1.0.tgz"))
+	suite.Equal(http.StatusNotFound, suite.status("bob", "/repo/abc/team-a/private-0.1.0.tgz"))
+
+	suite.Equal(http.StatusForbidden, suite.status("carol", "/repo/abc/team-a/private-0.1.0.tgz"))
+
+	// packages that aren't referenced by any index can't be read
+	suite.Equal(http.StatusForbidden, suite.status("alice", "/repo/def/charts/public-0.1.0.tgz"))
+}
+
+func (suite *AccessTestSuite) TestNoRules() {
+	suite.navigator.Reconfigure(Config{Indexes: []string{"stable", "team-a"}})
+
+	suite.Equal(http.StatusOK, suite.status("carol", "/team-a/index.yaml"))
+	suite.Equal(http.StatusNotFound, suite.status("carol", "/repo/def/charts/public-0.1.0.tgz"))
+}
+
+func (suite *AccessTestSuite) TestStatus() {
+	suite.navigator.Reconfigure(Config{
+		Indexes: []string{"stable", "team-a"},
+		Repositories: []RepositoryConfig{
+			{URL: "https://example.com/org/public.git", Directories: []string{"charts@stable"}},
+			{URL: "https://example.com/org/team-a.git", Directories: []string{"charts@team-a"}},
+			{URL: "https://example.com/org/mixed.git", Directories: []string{"charts@stable"}, Refs: []string{"tags/v*@team-a"}},
+		},
+		Access: suite.navigator.accessRules,
+	})
+
+	status := func(username string) (int, []string, []string) {
+		req := httptest.NewRequest("GET", "/api/status", nil)
+		if username != "" {
+			req.SetBasicAuth(username, "password")
+		}
+
+		res := httptest.NewRecorder()
+		suite.navigator.ServeStatus(res, req)
+
+		var response struct {
+			Repositories []repositoryStatusResponse
+			Indexes      []indexStatusResponse
+		}
+		json.NewDecoder(res.Body).Decode(&response)
+
+		var urls, indexes []string
+		for _, repo := range response.Repositories {
+			urls = append(urls, repo.URL)
+		}
+		for _, index := range response.Indexes {
+			indexes = append(indexes, index.Name)
+		}
+		return res.Code, urls, indexes
+	}
+
+	code, _, _ := status("")
+	suite.Equal(http.StatusUnauthorized, code)
+
+	code, urls, indexes := status("carol")
+	suite.Equal(http.StatusOK, code)
+	suite.Equal([]string{"https://example.com/org/mixed.git", "https://example.com/org/public.git"}, urls)
+	suite.Equal([]string{"stable"}, indexes)
+
+	_, urls, indexes = status("bob")
+	suite.Len(urls, 3)
+	suite.Equal([]string{"stable", "team-a"}, indexes)
+}
+
+func (suite *AccessTestSuite) TestAllows() {
+	rule := AccessRule{Indexes: []string{"stable"}, Groups: []string{"*"}}
+
+	suite.True(rule.allows(Identity{Name: "alice", Groups: []string{"ops"}}, "stable"))
+	suite.False(rule.allows(Identity{Name: "alice"}, "stable"))
+	suite.False(rule.allows(Identity{Name: "alice", Groups: []string{"ops"}}, "incubator"))
+
+	// anonymous identities are never allowed
+	rule.Users = []string{"*"}
+	suite.False(rule.allows(Identity{}, "stable"))
+}
+
+func TestAccessTestSuite(t *testing.T) {
+	suite.Run(t, new(AccessTestSuite))
+}
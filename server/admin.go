@@ -0,0 +1,384 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/saracen/navigator/repository"
+)
+
+// maxAdminRequestSize is the largest admin API request body accepted
+const maxAdminRequestSize = 1 << 20
+
+var (
+	// ErrRepositoryExists is raised when adding a repository whose URL has
+	// already been added
+	ErrRepositoryExists = errors.New("repository already exists")
+
+	errAdminUnauthorized = errors.New("invalid or missing bearer token")
+	errAdminNotFound     = errors.New("not found")
+)
+
+// apiRef maps a ref selector to an index
+type apiRef struct {
+	Name  string `json:"name"`
+	Index string `json:"index,omitempty"`
+}
+
+// apiDirectory maps a directory to an index
+type apiDirectory struct {
+	Path  string `json:"path"`
+	Index string `json:"index,omitempty"`
+}
+
+// apiAuth are the credentials of a private repository. Passwords, tokens and
+// passphrases are given inline, while SSH keys and known_hosts files are paths
+// to files on the server.
+type apiAuth struct {
+	Username       string `json:"username"`
+	Password       string `json:"password"`
+	Token          string `json:"token"`
+	SSHKeyFile     string `json:"sshKeyFile"`
+	SSHPassphrase  string `json:"sshPassphrase"`
+	KnownHostsFile string `json:"knownHostsFile"`
+}
+
+// repositoryRequest is the admin API request to add a repository
+type repositoryRequest struct {
+	URL         string         `json:"url"`
+	Interval    string         `json:"interval"`
+	Refs        []apiRef       `json:"refs"`
+	Directories []apiDirectory `json:"directories"`
+	Auth        apiAuth        `json:"auth"`
+}
+
+// repositoryResponse describes a repository. Credentials are never returned,
+// only the authentication method.
+type repositoryResponse struct {
+	Name        string         `json:"name"`
+	URL         string         `json:"url"`
+	Interval    string         `json:"interval,omitempty"`
+	Refs        []apiRef       `json:"refs,omitempty"`
+	Directories []apiDirectory `json:"directories,omitempty"`
+	Auth        string         `json:"auth"`
+	State       syncState      `json:"state"`
+	API         bool           `json:"api"`
+}
+
+// config returns the repository configuration of a request
+func (r *repositoryRequest) config() (RepositoryConfig, error) {
+	config := RepositoryConfig{
+		URL: r.URL,
+		Credentials: repository.Credentials{
+			Username:          r.Auth.Username,
+			Password:          r.Auth.Password,
+			Token:             r.Auth.Token,
+			SSHKeyFile:        r.Auth.SSHKeyFile,
+			SSHKeyPassphrase:  r.Auth.SSHPassphrase,
+			SSHKnownHostsFile: r.Auth.KnownHostsFile,
+		},
+	}
+
+	if r.URL == "" {
+		return config, errors.New("url is required")
+	}
+
+	if r.Interval != "" {
+		interval, err := time.ParseDuration(r.Interval)
+		if err != nil {
+			return config, err
+		}
+		if interval <= 0 {
+			return config, fmt.Errorf("interval %v is not positive", interval)
+		}
+		config.Interval = interval
+	}
+
+	for idx, ref := range r.Refs {
+		if ref.Name == "" {
+			return config, fmt.Errorf("refs[%d]: name is required", idx)
+		}
+		config.Refs = append(config.Refs, WithIndex(ref.Name, ref.Index))
+	}
+	for _, directory := range r.Directories {
+		config.Directories = append(config.Directories, WithIndex(directory.Path, directory.Index))
+	}
+
+	return config, nil
+}
+
+// AddRepository adds a repository at runtime, as if it were configured at
+// startup. Repositories added are saved to the data directory, and restored
+// along with the snapshot. The repository is updated by the scheduler.
+func (s *Server) AddRepository(config RepositoryConfig) error {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	name := repositoryName(config.URL)
+	if _, ok := s.repository(name); ok {
+		return ErrRepositoryExists
+	}
+
+	s.addRepository(config)
+	s.setAPIRepository(name, true)
+
+	return s.saveAPIRepositories()
+}
+
+// RemoveRepository removes a repository at runtime, along with its charts in
+// every index and its data in the data directory. The remaining repositories
+// of the indexes it was indexed to are indexed again.
+func (s *Server) RemoveRepository(name string) error {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	if _, ok := s.repository(name); !ok {
+		return repository.ErrRepositoryNotFound
+	}
+
+	affected := make(map[string]bool)
+	for _, indexName := range s.removeRepository(name, true) {
+		affected[indexName] = true
+	}
+	s.reindex(affected, nil)
+	s.updateMetrics()
+
+	if err := s.saveAPIRepositories(); err != nil {
+		return err
+	}
+	return s.SaveSnapshot()
+}
+
+// AdminHandler returns a handler for the admin API, authenticated with a
+// bearer token:
+//
+//	GET    /api/repositories             lists repositories
+//	POST   /api/repositories             adds a repository
+//	GET    /api/repositories/<name>      describes a repository
+//	DELETE /api/repositories/<name>      removes a repository
+//	POST   /api/repositories/<name>/sync triggers an update
+func (s *Server) AdminHandler(token []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, body, err := s.serveAdmin(w, r, token)
+		if err != nil {
+			if code == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="navigator"`)
+			}
+			http.Error(w, err.Error(), code)
+			level.Error(s.logger).Log("event", "admin", "method", r.Method, "path", r.URL.Path, "err", err)
+			return
+		}
+
+		level.Info(s.logger).Log("event", "admin", "method", r.Method, "path", r.URL.Path)
+
+		if body == nil {
+			w.WriteHeader(code)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(body)
+	})
+}
+
+func (s *Server) serveAdmin(w http.ResponseWriter, r *http.Request, token []byte) (int, interface{}, error) {
+	authorization := r.Header.Get("Authorization")
+	if len(token) == 0 || !strings.HasPrefix(authorization, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(authorization, "Bearer ")), token) != 1 {
+		return http.StatusUnauthorized, nil, errAdminUnauthorized
+	}
+
+	if !strings.HasPrefix(r.URL.Path+"/", "/api/repositories/") {
+		return http.StatusNotFound, nil, errAdminNotFound
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/repositories"), "/"), "/")
+
+	switch {
+	case parts[0] == "" && r.Method == http.MethodGet:
+		return http.StatusOK, s.repositoryResponses(), nil
+
+	case parts[0] == "" && r.Method == http.MethodPost:
+		var req repositoryRequest
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminRequestSize))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			return http.StatusBadRequest, nil, err
+		}
+
+		config, err := req.config()
+		if err != nil {
+			return http.StatusBadRequest, nil, err
+		}
+
+		err = s.AddRepository(config)
+		if err == ErrRepositoryExists {
+			return http.StatusConflict, nil, err
+		}
+		if err != nil {
+			return http.StatusInternalServerError, nil, err
+		}
+
+		response, _ := s.repositoryResponse(repositoryName(config.URL))
+		return http.StatusCreated, response, nil
+
+	case parts[0] == "":
+		return http.StatusMethodNotAllowed, nil, errors.New(http.StatusText(http.StatusMethodNotAllowed))
+	}
+
+	name := parts[0]
+	response, ok := s.repositoryResponse(name)
+	if !ok || len(parts) > 2 || (len(parts) == 2 && parts[1] != "sync") {
+		return http.StatusNotFound, nil, errAdminNotFound
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		return http.StatusOK, response, nil
+
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		err := s.RemoveRepository(name)
+		if err == repository.ErrRepositoryNotFound {
+			return http.StatusNotFound, nil, err
+		}
+		if err != nil {
+			return http.StatusInternalServerError, nil, err
+		}
+		return http.StatusNoContent, nil, nil
+
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		s.TriggerUpdate(name)
+		return http.StatusAccepted, response, nil
+	}
+
+	return http.StatusMethodNotAllowed, nil, errors.New(http.StatusText(http.StatusMethodNotAllowed))
+}
+
+// repositoryResponses describes every repository, sorted by URL
+func (s *Server) repositoryResponses() []repositoryResponse {
+	responses := []repositoryResponse{}
+	for name := range s.repositoryConfigs() {
+		if response, ok := s.repositoryResponse(name); ok {
+			responses = append(responses, response)
+		}
+	}
+
+	sort.Slice(responses, func(i, j int) bool {
+		return responses[i].URL < responses[j].URL
+	})
+	return responses
+}
+
+// repositoryResponse describes a repository by name
+func (s *Server) repositoryResponse(name string) (repositoryResponse, bool) {
+	s.reposMutex.RLock()
+	config, ok := s.configs[name]
+	api := s.apiRepos[name]
+	s.reposMutex.RUnlock()
+
+	if !ok {
+		return repositoryResponse{}, false
+	}
+
+	response := repositoryResponse{
+		Name: name,
+		URL:  config.URL,
+		Auth: config.Credentials.String(),
+		API:  api,
+	}
+	if config.Interval > 0 {
+		response.Interval = config.Interval.String()
+	}
+
+	indexRefs, indexDirectories := config.indexMappings()
+	for _, ref := range indexRefs {
+		response.Refs = append(response.Refs, apiRef{Name: ref.Name, Index: ref.IndexName})
+	}
+	for _, directory := range indexDirectories {
+		response.Directories = append(response.Directories, apiDirectory{Path: directory.Name, Index: directory.IndexName})
+	}
+
+	s.statusMutex.RLock()
+	if status, ok := s.status[name]; ok {
+		response.State = status.State
+	}
+	s.statusMutex.RUnlock()
+
+	return response, true
+}
+
+func (s *Server) apiRepositoriesPath() string {
+	return filepath.Join(s.dataDir, "api-repositories.json")
+}
+
+// saveAPIRepositories saves the configuration of the repositories added with
+// the admin API to the data directory. The file includes credentials, and is
+// only readable by its owner.
+func (s *Server) saveAPIRepositories() error {
+	if s.dataDir == "" {
+		return nil
+	}
+
+	configs := s.repositoryConfigs()
+	var saved []RepositoryConfig
+	for name := range s.apiRepositories() {
+		saved = append(saved, configs[name])
+	}
+	sort.Slice(saved, func(i, j int) bool {
+		return saved[i].URL < saved[j].URL
+	})
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	return writeSnapshotFile(s.apiRepositoriesPath(), func(w io.Writer) (int64, error) {
+		n, err := w.Write(data)
+		return int64(n), err
+	})
+}
+
+// restoreAPIRepositories adds the repositories previously added with the admin
+// API, unless they've since been configured.
+func (s *Server) restoreAPIRepositories() error {
+	data, err := ioutil.ReadFile(s.apiRepositoriesPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved []RepositoryConfig
+	if err = json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	for _, config := range saved {
+		name := repositoryName(config.URL)
+		if _, ok := s.repository(name); ok {
+			continue
+		}
+
+		s.addRepository(config)
+		s.setAPIRepository(name, true)
+	}
+
+	return nil
+}
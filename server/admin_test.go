@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/saracen/navigator/repository"
+)
+
+type AdminTestSuite struct {
+	suite.Suite
+	dataDir   string
+	navigator *Server
+	ts        *httptest.Server
+}
+
+func (suite *AdminTestSuite) SetupTest() {
+	var err error
+	suite.dataDir, err = ioutil.TempDir("", "navigator-admin")
+	suite.Require().NoError(err)
+
+	suite.navigator = New(log.NewNopLogger(), DataDir(suite.dataDir))
+	suite.ts = httptest.NewServer(suite.navigator.AdminHandler([]byte("token")))
+}
+
+func (suite *AdminTestSuite) TearDownTest() {
+	suite.ts.Close()
+	os.RemoveAll(suite.dataDir)
+}
+
+func (suite *AdminTestSuite) request(method, path, token, body string, v interface{}) int {
+	req, _ := http.NewRequest(method, suite.ts.URL+path, bytes.NewBufferString(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if !suite.NoError(err) {
+		return 0
+	}
+	defer res.Body.Close()
+
+	if v != nil {
+		suite.NoError(json.NewDecoder(res.Body).Decode(v))
+	}
+	return res.StatusCode
+}
+
+func (suite *AdminTestSuite) TestAuthentication() {
+	suite.Equal(http.StatusUnauthorized, suite.request("GET", "/api/repositories", "", "", nil))
+	suite.Equal(http.StatusUnauthorized, suite.request("GET", "/api/repositories", "wrong", "", nil))
+	suite.Equal(http.StatusOK, suite.request("GET", "/api/repositories", "token", "", nil))
+
+	// the token must be a bearer token
+	for _, authorization := range []string{"token", "Basic token", "bearer token", "Bearer  token"} {
+		req, _ := http.NewRequest("GET", suite.ts.URL+"/api/repositories", nil)
+		req.Header.Set("Authorization", authorization)
+		res, err := http.DefaultClient.Do(req)
+		if suite.NoError(err, authorization) {
+			suite.Equal(http.StatusUnauthorized, res.StatusCode, authorization)
+			res.Body.Close()
+		}
+	}
+
+	// an empty token never authenticates
+	ts := httptest.NewServer(suite.navigator.AdminHandler(nil))
+	defer ts.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/api/repositories", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	res, err := http.DefaultClient.Do(req)
+	if suite.NoError(err) {
+		suite.Equal(http.StatusUnauthorized, res.StatusCode)
+		res.Body.Close()
+	}
+}
+
+func (suite *AdminTestSuite) TestRepositoryLifecycle() {
+	body := `{"url": "../.git", "interval": "1m", "refs": [{"name": "master"}], "directories": [{"path": "repository/testdata/charts", "index": "api"}], "auth": {"username": "user", "password": "secret"}}`
+
+	var created repositoryResponse
+	if !suite.Equal(http.StatusCreated, suite.request("POST", "/api/repositories", "token", body, &created)) {
+		return
+	}
+	suite.Equal(repositoryResponse{
+		Name:        repositoryName("../.git"),
+		URL:         "../.git",
+		Interval:    "1m0s",
+		Refs:        []apiRef{{Name: "master"}},
+		Directories: []apiDirectory{{Path: "repository/testdata/charts", Index: "api"}},
+		Auth:        "basic",
+		State:       syncPending,
+		API:         true,
+	}, created)
+
+	suite.Equal(http.StatusConflict, suite.request("POST", "/api/repositories", "token", body, nil))
+	suite.Equal(http.StatusBadRequest, suite.request("POST", "/api/repositories", "token", `{"directories": []}`, nil))
+	suite.Equal(http.StatusBadRequest, suite.request("POST", "/api/repositories", "token", `{"url": "../.git/", "interval": "-1m"}`, nil))
+	suite.Equal(http.StatusBadRequest, suite.request("POST", "/api/repositories", "token", `{"url": "../.git/", "branch": "master"}`, nil))
+
+	var repos []repositoryResponse
+	suite.Equal(http.StatusOK, suite.request("GET", "/api/repositories", "token", "", &repos))
+	suite.Equal([]repositoryResponse{created}, repos)
+
+	path := "/api/repositories/" + created.Name
+	suite.Equal(http.StatusOK, suite.request("GET", path, "token", "", nil))
+	suite.Equal(http.StatusNotFound, suite.request("GET", "/api/repositories/missing", "token", "", nil))
+	suite.Equal(http.StatusNotFound, suite.request("POST", path+"/unknown", "token", "", nil))
+	suite.Equal(http.StatusMethodNotAllowed, suite.request("PUT", path, "token", "", nil))
+
+	// syncing updates the repository in the background
+	suite.Equal(http.StatusAccepted, suite.request("POST", path+"/sync", "token", "", nil))
+	waitForTriggers(suite.navigator)
+
+	index, err := suite.navigator.indexManager.Get("api")
+	if !suite.NoError(err) {
+		return
+	}
+	_, err = index.Get("mychart", "0.1.0")
+	suite.NoError(err)
+
+	// removing the repository removes its charts
+	suite.Equal(http.StatusNoContent, suite.request("DELETE", path, "token", "", nil))
+	suite.Equal(http.StatusNotFound, suite.request("GET", path, "token", "", nil))
+
+	_, err = index.Get("mychart", "0.1.0")
+	suite.Error(err)
+	_, err = os.Stat(suite.navigator.repositoryDir(created.Name))
+	suite.True(os.IsNotExist(err))
+}
+
+func (suite *AdminTestSuite) TestRepositoryRequestAuth() {
+	var request repositoryRequest
+	body := `{"url": "git@example.com:charts.git", "auth": {"sshKeyFile": "/etc/navigator/id_rsa", "sshPassphrase": "secret", "knownHostsFile": "/etc/navigator/known_hosts"}}`
+	suite.Require().NoError(json.Unmarshal([]byte(body), &request))
+
+	config, err := request.config()
+	suite.Require().NoError(err)
+	suite.Equal(repository.Credentials{
+		SSHKeyFile:        "/etc/navigator/id_rsa",
+		SSHKeyPassphrase:  "secret",
+		SSHKnownHostsFile: "/etc/navigator/known_hosts",
+	}, config.Credentials)
+}
+
+func (suite *AdminTestSuite) TestRestore() {
+	suite.NoError(suite.navigator.AddRepository(RepositoryConfig{URL: "../.git", Directories: []string{"repository/testdata/charts@api"}}))
+
+	// repositories added with the admin API are restored, and left unchanged
+	// by reconfiguration
+	navigator := New(log.NewNopLogger(), DataDir(suite.dataDir))
+	navigator.Reconfigure(Config{Repositories: []RepositoryConfig{{URL: "./../.git"}}})
+	suite.NoError(navigator.RestoreSnapshot())
+	suite.Len(navigator.repositories(), 2)
+
+	navigator.Reconfigure(Config{})
+	if suite.Len(navigator.repositories(), 1) {
+		_, ok := navigator.repository(repositoryName("../.git"))
+		suite.True(ok)
+	}
+
+	// repositories later added to the configuration are no longer restored
+	navigator.Reconfigure(Config{Repositories: []RepositoryConfig{{URL: "../.git", Directories: []string{"repository/testdata/charts@api"}}}})
+	suite.Empty(navigator.apiRepositories())
+
+	navigator = New(log.NewNopLogger(), DataDir(suite.dataDir))
+	suite.NoError(navigator.RestoreSnapshot())
+	suite.Empty(navigator.repositories())
+}
+
+func TestAdminTestSuite(t *testing.T) {
+	suite.Run(t, new(AdminTestSuite))
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var errUnauthorized = errors.New("invalid or missing credentials")
+
+// Identity is an authenticated client
+type Identity struct {
+	Name   string
+	Groups []string
+}
+
+// Authenticator authenticates requests for chart indexes and packages
+type Authenticator interface {
+	// Authenticate returns the identity of the client that made the request.
+	// ok is false if the request has no credentials the authenticator
+	// recognizes, or they're invalid.
+	Authenticate(r *http.Request) (identity Identity, ok bool)
+}
+
+// Authentication requires requests for chart indexes and packages to be
+// accepted by one of the authenticators. By default, requests are not
+// authenticated.
+func Authentication(authenticators ...Authenticator) Option {
+	return func(s *Server) {
+		s.authenticators = append(s.authenticators, authenticators...)
+	}
+}
+
+// authenticate returns the identity of the client that made the request, using
+// the first authenticator that accepts it
+func (s *Server) authenticate(r *http.Request) (Identity, bool) {
+	if len(s.authenticators) == 0 {
+		return Identity{}, true
+	}
+
+	for _, authenticator := range s.authenticators {
+		if identity, ok := authenticator.Authenticate(r); ok {
+			return identity, true
+		}
+	}
+	return Identity{}, false
+}
+
+// requestToken returns the bearer token of a request. As helm only supports
+// basic auth, the basic auth password is also accepted as a token.
+func requestToken(r *http.Request) (string, bool) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+		return token, token != ""
+	}
+
+	if _, password, ok := r.BasicAuth(); ok && password != "" {
+		return password, true
+	}
+	return "", false
+}
+
+type identityKey struct{}
+
+// withIdentity returns a copy of ctx with the client's identity
+func withIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// RequestIdentity returns the identity of the client that made an
+// authenticated request
+func RequestIdentity(r *http.Request) (Identity, bool) {
+	identity, ok := r.Context().Value(identityKey{}).(Identity)
+	return identity, ok
+}
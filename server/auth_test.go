@@ -0,0 +1,105 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/suite"
+)
+
+type AuthTestSuite struct {
+	suite.Suite
+}
+
+// staticAuthenticator authenticates requests with a fixed basic auth username
+type staticAuthenticator struct {
+	username string
+	identity Identity
+}
+
+func (a staticAuthenticator) Authenticate(r *http.Request) (Identity, bool) {
+	username, _, ok := r.BasicAuth()
+	return a.identity, ok && username == a.username
+}
+
+func (suite *AuthTestSuite) TestUnauthenticated() {
+	navigator := New(log.NewNopLogger())
+	navigator.indexManager.Create("default")
+
+	res := httptest.NewRecorder()
+	navigator.ServeHTTP(res, httptest.NewRequest("GET", "/default/index.yaml", nil))
+	suite.Equal(http.StatusOK, res.Code)
+}
+
+func (suite *AuthTestSuite) TestAuthentication() {
+	navigator := New(log.NewNopLogger(), Authentication(
+		staticAuthenticator{"first", Identity{Name: "first"}},
+		staticAuthenticator{"second", Identity{Name: "second", Groups: []string{"ops"}}},
+	))
+	navigator.indexManager.Create("default")
+
+	request := func(username string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/default/index.yaml", nil)
+		if username != "" {
+			req.SetBasicAuth(username, "password")
+		}
+
+		res := httptest.NewRecorder()
+		navigator.ServeHTTP(res, req)
+		return res
+	}
+
+	res := request("")
+	suite.Equal(http.StatusUnauthorized, res.Code)
+	suite.Equal(`Basic realm="navigator"`, res.Header().Get("WWW-Authenticate"))
+
+	suite.Equal(http.StatusUnauthorized, request("third").Code)
+	suite.Equal(http.StatusOK, request("first").Code)
+	suite.Equal(http.StatusOK, request("second").Code)
+
+	// the first authenticator that accepts the request provides the identity
+	req := httptest.NewRequest("GET", "/", nil)
+	req.SetBasicAuth("second", "password")
+	identity, ok := navigator.authenticate(req)
+	suite.True(ok)
+	suite.Equal(Identity{Name: "second", Groups: []string{"ops"}}, identity)
+}
+
+func (suite *AuthTestSuite) TestRequestToken() {
+	req := httptest.NewRequest("GET", "/", nil)
+	_, ok := requestToken(req)
+	suite.False(ok)
+
+	req.Header.Set("Authorization", "Bearer token")
+	token, ok := requestToken(req)
+	suite.True(ok)
+	suite.Equal("token", token)
+
+	// helm only supports basic auth, so the password is used as the token
+	req = httptest.NewRequest("GET", "/", nil)
+	req.SetBasicAuth("helm", "token")
+	token, ok = requestToken(req)
+	suite.True(ok)
+	suite.Equal("token", token)
+
+	req.SetBasicAuth("helm", "")
+	_, ok = requestToken(req)
+	suite.False(ok)
+}
+
+func (suite *AuthTestSuite) TestRequestIdentity() {
+	req := httptest.NewRequest("GET", "/", nil)
+	_, ok := RequestIdentity(req)
+	suite.False(ok)
+
+	req = req.WithContext(withIdentity(req.Context(), Identity{Name: "user"}))
+	identity, ok := RequestIdentity(req)
+	suite.True(ok)
+	suite.Equal("user", identity.Name)
+}
+
+func TestAuthTestSuite(t *testing.T) {
+	suite.Run(t, new(AuthTestSuite))
+}
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ArchiveCache is a size-bounded, least recently used cache of generated chart
+// packages, kept in memory and optionally on disk. Chart packages are
+// reproducible, so the package of a chart at a commit only changes when its
+// dependencies resolve to other versions. Keys include the resolved
+// dependencies, so entries never need to be invalidated: outdated packages
+// are no longer requested, and are evicted.
+type ArchiveCache struct {
+	logger log.Logger
+	dir    string
+
+	mutex  sync.Mutex
+	memory *lruCache
+	disk   *lruCache
+
+	// calls are the packages being loaded, so that concurrent requests for the
+	// same package only generate it once
+	calls map[string]*archiveCall
+}
+
+type archiveCall struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// NewArchiveCache returns a cache of up to memorySize bytes of chart packages
+// in memory. If dir is not empty, up to diskSize bytes of chart packages are
+// also cached in dir, and packages cached there by a previous process are
+// reused.
+func NewArchiveCache(logger log.Logger, memorySize int64, dir string, diskSize int64) (*ArchiveCache, error) {
+	c := &ArchiveCache{
+		logger: logger,
+		dir:    dir,
+		memory: newLRUCache("memory", memorySize, nil),
+		calls:  make(map[string]*archiveCall),
+	}
+
+	if dir == "" {
+		return c, nil
+	}
+
+	c.disk = newLRUCache("disk", diskSize, c.removeFile)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// the least recently used files are added first, so that they're the
+	// first to be evicted
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, f := range files {
+		switch {
+		case !f.Mode().IsRegular():
+		case strings.HasPrefix(f.Name(), "."):
+			// remove packages that were partially written
+			c.removeFile(f.Name())
+		case !c.disk.add(f.Name(), f.Size(), nil):
+			c.removeFile(f.Name())
+		}
+	}
+
+	return c, nil
+}
+
+// Get returns the chart package cached with key, or generates and caches it
+func (c *ArchiveCache) Get(key string, generate func() ([]byte, error)) ([]byte, error) {
+	c.mutex.Lock()
+	if data, ok := c.memory.get(key); ok {
+		c.mutex.Unlock()
+		archiveCacheHits.With(prometheus.Labels{"cache": "memory"}).Inc()
+		return data, nil
+	}
+
+	if call, ok := c.calls[key]; ok {
+		c.mutex.Unlock()
+		<-call.done
+		if call.err == nil {
+			archiveCacheHits.With(prometheus.Labels{"cache": "memory"}).Inc()
+		}
+		return call.data, call.err
+	}
+
+	call := &archiveCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mutex.Unlock()
+
+	call.data, call.err = c.load(key, generate)
+
+	c.mutex.Lock()
+	delete(c.calls, key)
+	if call.err == nil {
+		c.memory.add(key, int64(len(call.data)), call.data)
+	}
+	c.mutex.Unlock()
+	close(call.done)
+
+	return call.data, call.err
+}
+
+// load reads a chart package from disk, or generates it
+func (c *ArchiveCache) load(key string, generate func() ([]byte, error)) ([]byte, error) {
+	if c.disk != nil {
+		if data, ok := c.readFile(key); ok {
+			archiveCacheHits.With(prometheus.Labels{"cache": "disk"}).Inc()
+			return data, nil
+		}
+	}
+
+	archiveCacheMisses.Inc()
+	data, err := generate()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.disk != nil {
+		c.writeFile(key, data)
+	}
+	return data, nil
+}
+
+// filename returns the name of the file a chart package is cached in on disk
+func (c *ArchiveCache) filename(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *ArchiveCache) readFile(key string) ([]byte, bool) {
+	name := c.filename(key)
+
+	c.mutex.Lock()
+	_, ok := c.disk.get(name)
+	c.mutex.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, name))
+	if err != nil {
+		level.Error(c.logger).Log("event", "archive-cache", "file", name, "err", err)
+
+		c.mutex.Lock()
+		c.disk.remove(name)
+		c.mutex.Unlock()
+		return nil, false
+	}
+
+	// the modification time records when the file was last used, so that the
+	// order of use is restored on startup
+	now := time.Now()
+	os.Chtimes(filepath.Join(c.dir, name), now, now)
+
+	return data, true
+}
+
+func (c *ArchiveCache) writeFile(key string, data []byte) {
+	if int64(len(data)) > c.disk.maxSize {
+		return
+	}
+	name := c.filename(key)
+
+	// the package is written to a temporary file first, so that a partially
+	// written package is never read
+	f, err := ioutil.TempFile(c.dir, ".")
+	if err == nil {
+		_, err = f.Write(data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), filepath.Join(c.dir, name))
+		}
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}
+	if err != nil {
+		level.Error(c.logger).Log("event", "archive-cache", "file", name, "err", err)
+		return
+	}
+
+	c.mutex.Lock()
+	c.disk.add(name, int64(len(data)), nil)
+	c.mutex.Unlock()
+}
+
+func (c *ArchiveCache) removeFile(name string) {
+	if err := os.Remove(filepath.Join(c.dir, name)); err != nil && !os.IsNotExist(err) {
+		level.Error(c.logger).Log("event", "archive-cache", "file", name, "err", err)
+	}
+}
+
+// lruCache tracks the size and order of use of cached entries, evicting the
+// least recently used entries when its size exceeds maxSize
+type lruCache struct {
+	name    string
+	maxSize int64
+	size    int64
+	entries map[string]*list.Element
+	order   *list.List
+
+	// evicted is called with the key of each entry evicted
+	evicted func(key string)
+}
+
+type lruEntry struct {
+	key  string
+	size int64
+	data []byte
+}
+
+func newLRUCache(name string, maxSize int64, evicted func(string)) *lruCache {
+	return &lruCache{
+		name:    name,
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		evicted: evicted,
+	}
+}
+
+// get returns the data of an entry, and marks it as the most recently used
+func (l *lruCache) get(key string) ([]byte, bool) {
+	elem, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	l.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry).data, true
+}
+
+// add adds an entry as the most recently used, returning false if it's larger
+// than the cache
+func (l *lruCache) add(key string, size int64, data []byte) bool {
+	if size > l.maxSize {
+		return false
+	}
+
+	if elem, ok := l.entries[key]; ok {
+		l.size -= elem.Value.(*lruEntry).size
+		l.order.Remove(elem)
+	}
+
+	l.entries[key] = l.order.PushFront(&lruEntry{key: key, size: size, data: data})
+	l.size += size
+
+	for l.size > l.maxSize {
+		entry := l.order.Back().Value.(*lruEntry)
+		l.remove(entry.key)
+		if l.evicted != nil {
+			l.evicted(entry.key)
+		}
+	}
+
+	archiveCacheSize.With(prometheus.Labels{"cache": l.name}).Set(float64(l.size))
+	return true
+}
+
+// remove removes an entry
+func (l *lruCache) remove(key string) {
+	elem, ok := l.entries[key]
+	if !ok {
+		return
+	}
+
+	l.size -= elem.Value.(*lruEntry).size
+	l.order.Remove(elem)
+	delete(l.entries, key)
+
+	archiveCacheSize.With(prometheus.Labels{"cache": l.name}).Set(float64(l.size))
+}
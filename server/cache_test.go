@@ -0,0 +1,228 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/saracen/navigator/repository"
+)
+
+// archiveRepository is a fake repository whose chart packages are their
+// commit and chart path, counting the packages generated
+type archiveRepository struct {
+	*fakeRepository
+	generated int32
+
+	// fingerprint is the fingerprint of the packages' dependencies
+	fingerprint atomic.Value
+}
+
+func (r *archiveRepository) ChartPackage(name string) (repository.Archiver, error) {
+	fingerprint, _ := r.fingerprint.Load().(string)
+	return &fingerprintArchiver{
+		archiverFunc: func(w io.Writer) error {
+			atomic.AddInt32(&r.generated, 1)
+			_, err := io.WriteString(w, name)
+			return err
+		},
+		fingerprint: fingerprint,
+	}, nil
+}
+
+type archiverFunc func(io.Writer) error
+
+func (fn archiverFunc) Archive(w io.Writer) error {
+	return fn(w)
+}
+
+type fingerprintArchiver struct {
+	archiverFunc
+	fingerprint string
+}
+
+func (a *fingerprintArchiver) Fingerprint() string {
+	return a.fingerprint
+}
+
+type CacheTestSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (suite *CacheTestSuite) SetupTest() {
+	var err error
+	suite.dir, err = ioutil.TempDir("", "navigator-cache")
+	suite.Require().NoError(err)
+}
+
+func (suite *CacheTestSuite) TearDownTest() {
+	os.RemoveAll(suite.dir)
+}
+
+// generator returns a generator of data, counting the times it's called
+func generator(data string, calls *int) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		*calls++
+		return []byte(data), nil
+	}
+}
+
+func (suite *CacheTestSuite) TestMemory() {
+	cache, err := NewArchiveCache(log.NewNopLogger(), 10, "", 0)
+	suite.Require().NoError(err)
+
+	var a, b, c int
+	for i := 0; i < 2; i++ {
+		data, err := cache.Get("a", generator("aaaa", &a))
+		suite.NoError(err)
+		suite.Equal("aaaa", string(data))
+
+		cache.Get("b", generator("bbbb", &b))
+	}
+	suite.Equal(1, a)
+	suite.Equal(1, b)
+
+	// "a" was used most recently, so "b" is evicted
+	cache.Get("a", generator("aaaa", &a))
+	cache.Get("c", generator("cccc", &c))
+	cache.Get("a", generator("aaaa", &a))
+	cache.Get("b", generator("bbbb", &b))
+	suite.Equal(1, a)
+	suite.Equal(2, b)
+	suite.Equal(1, c)
+
+	// packages larger than the cache are not cached
+	var large int
+	cache.Get("large", generator("0123456789a", &large))
+	cache.Get("large", generator("0123456789a", &large))
+	suite.Equal(2, large)
+
+	// errors are not cached
+	var failed int
+	for i := 0; i < 2; i++ {
+		_, err = cache.Get("failed", func() ([]byte, error) {
+			failed++
+			return nil, errors.New("failed")
+		})
+		suite.EqualError(err, "failed")
+	}
+	suite.Equal(2, failed)
+}
+
+func (suite *CacheTestSuite) TestConcurrent() {
+	cache, err := NewArchiveCache(log.NewNopLogger(), 1024, "", 0)
+	suite.Require().NoError(err)
+
+	release := make(chan struct{})
+	var calls int32
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			data, err := cache.Get("chart", func() ([]byte, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return []byte("chart"), nil
+			})
+			suite.NoError(err)
+			suite.Equal("chart", string(data))
+		}()
+	}
+
+	close(release)
+	wg.Wait()
+
+	suite.EqualValues(1, atomic.LoadInt32(&calls))
+}
+
+func (suite *CacheTestSuite) TestDisk() {
+	cache, err := NewArchiveCache(log.NewNopLogger(), 0, suite.dir, 10)
+	suite.Require().NoError(err)
+
+	var a, b, c int
+	cache.Get("a", generator("aaaa", &a))
+	cache.Get("b", generator("bbbb", &b))
+	cache.Get("a", generator("aaaa", &a))
+	suite.Equal(1, a)
+	suite.Equal(1, b)
+
+	files, err := ioutil.ReadDir(suite.dir)
+	suite.NoError(err)
+	suite.Len(files, 2)
+
+	// packages cached on disk are reused by new caches, and partially written
+	// packages are removed
+	suite.NoError(ioutil.WriteFile(filepath.Join(suite.dir, ".partial"), []byte("partial"), 0644))
+
+	cache, err = NewArchiveCache(log.NewNopLogger(), 0, suite.dir, 10)
+	suite.Require().NoError(err)
+
+	data, err := cache.Get("a", generator("aaaa", &a))
+	suite.NoError(err)
+	suite.Equal("aaaa", string(data))
+	suite.Equal(1, a)
+
+	_, err = os.Stat(filepath.Join(suite.dir, ".partial"))
+	suite.True(os.IsNotExist(err))
+
+	// "a" was used most recently, so "b" is evicted and its file removed
+	cache.Get("c", generator("cccc", &c))
+	cache.Get("a", generator("aaaa", &a))
+	cache.Get("b", generator("bbbb", &b))
+	suite.Equal(1, a)
+	suite.Equal(2, b)
+
+	files, err = ioutil.ReadDir(suite.dir)
+	suite.NoError(err)
+	suite.Len(files, 2)
+}
+
+func (suite *CacheTestSuite) TestServe() {
+	cache, err := NewArchiveCache(log.NewNopLogger(), 1024, "", 0)
+	suite.Require().NoError(err)
+
+	navigator := New(log.NewNopLogger(), Cache(cache))
+	repo := &archiveRepository{fakeRepository: &fakeRepository{url: "repo"}}
+	navigator.repos["repo"] = repo
+
+	for _, url := range []string{"/repo/abc/mychart-0.1.0.tgz", "/repo/abc/mychart-0.1.0.tgz", "/repo/def/mychart-0.1.0.tgz"} {
+		res := httptest.NewRecorder()
+		navigator.ServeHTTP(res, httptest.NewRequest("GET", url, nil))
+		suite.Equal(http.StatusOK, res.Code)
+		suite.Equal(strings.TrimPrefix(path.Dir(url), "/repo/"), res.Body.String())
+		suite.Equal("3", res.Header().Get("Content-Length"))
+	}
+
+	suite.EqualValues(2, repo.generated)
+
+	// packages are generated again when their dependencies resolve to other
+	// packages
+	repo.fingerprint.Store("dependencies")
+	for _, expected := range []int32{3, 3} {
+		res := httptest.NewRecorder()
+		navigator.ServeHTTP(res, httptest.NewRequest("GET", "/repo/abc/mychart-0.1.0.tgz", nil))
+		suite.Equal(http.StatusOK, res.Code)
+		suite.Equal("public, no-cache", res.Header().Get("Cache-Control"))
+		suite.EqualValues(expected, repo.generated)
+	}
+}
+
+func TestCacheTestSuite(t *testing.T) {
+	suite.Run(t, new(CacheTestSuite))
+}
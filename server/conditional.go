@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// cacheControl returns the Cache-Control header of a response with the
+// directives. Responses are only cached by shared caches, such as proxies, if
+// requests are not authenticated.
+func (s *Server) cacheControl(directives string) string {
+	if len(s.authenticators) > 0 {
+		return "private, " + directives
+	}
+	return "public, " + directives
+}
+
+// setValidators sets the entity tag and modification time of a response, if
+// they're known
+func setValidators(w http.ResponseWriter, etag string, modified time.Time) {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// headerWriter is a response writer that sets the headers of a response just
+// before its body is first written
+type headerWriter struct {
+	http.ResponseWriter
+	setHeaders func()
+	written    bool
+}
+
+func (w *headerWriter) Write(p []byte) (int, error) {
+	if !w.written {
+		w.written = true
+		w.setHeaders()
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// notModified returns whether the client that made a conditional request
+// already has the representation with the entity tag and modification time.
+// If-None-Match takes precedence over If-Modified-Since.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		return etag != "" && etagMatches(match, etag)
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modified.IsZero() {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(since)
+}
+
+// etagMatches returns whether an If-None-Match header matches the entity tag,
+// using weak comparison
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/suite"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+
+	"github.com/saracen/navigator/repository"
+)
+
+// failingArchiveRepository is a fake repository whose chart packages fail to
+// be archived
+type failingArchiveRepository struct {
+	*fakeRepository
+}
+
+func (r *failingArchiveRepository) ChartPackage(name string) (repository.Archiver, error) {
+	return archiverFunc(func(w io.Writer) error {
+		return errors.New("archive failed")
+	}), nil
+}
+
+type ConditionalTestSuite struct {
+	suite.Suite
+}
+
+func (suite *ConditionalTestSuite) TestNotModified() {
+	modified := time.Date(2018, 1, 2, 3, 4, 5, 600, time.UTC)
+
+	tests := []struct {
+		method  string
+		headers map[string]string
+		etag    string
+		result  bool
+	}{
+		{"GET", nil, `"abc"`, false},
+		{"GET", map[string]string{"If-None-Match": `"abc"`}, `"abc"`, true},
+		{"HEAD", map[string]string{"If-None-Match": `"abc"`}, `"abc"`, true},
+		{"POST", map[string]string{"If-None-Match": `"abc"`}, `"abc"`, false},
+		{"GET", map[string]string{"If-None-Match": `"def", W/"abc"`}, `"abc"`, true},
+		{"GET", map[string]string{"If-None-Match": `*`}, `"abc"`, true},
+		{"GET", map[string]string{"If-None-Match": `"def"`}, `"abc"`, false},
+		{"GET", map[string]string{"If-None-Match": `"abc"`}, "", false},
+		{"GET", map[string]string{"If-Modified-Since": "Tue, 02 Jan 2018 03:04:05 GMT"}, `"abc"`, true},
+		{"GET", map[string]string{"If-Modified-Since": "Wed, 03 Jan 2018 00:00:00 GMT"}, `"abc"`, true},
+		{"GET", map[string]string{"If-Modified-Since": "Tue, 02 Jan 2018 03:04:04 GMT"}, `"abc"`, false},
+		{"GET", map[string]string{"If-Modified-Since": "yesterday"}, `"abc"`, false},
+
+		// If-None-Match takes precedence over If-Modified-Since
+		{"GET", map[string]string{"If-None-Match": `"def"`, "If-Modified-Since": "Wed, 03 Jan 2018 00:00:00 GMT"}, `"abc"`, false},
+	}
+
+	for idx, test := range tests {
+		r := httptest.NewRequest(test.method, "/default/index.yaml", nil)
+		for key, value := range test.headers {
+			r.Header.Set(key, value)
+		}
+
+		suite.Equal(test.result, notModified(r, test.etag, modified), "test index: %v", idx)
+	}
+}
+
+func (suite *ConditionalTestSuite) TestIndex() {
+	navigator := New(log.NewNopLogger())
+	index := navigator.indexManager.Create("default")
+	index.Add(&chart.Metadata{Name: "mychart", Version: "0.1.0"}, []string{"/repo/abc/mychart-0.1.0.tgz"}, time.Now())
+
+	get := func(headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/default/index.yaml", nil)
+		for key, value := range headers {
+			r.Header.Set(key, value)
+		}
+
+		res := httptest.NewRecorder()
+		navigator.ServeHTTP(res, r)
+		return res
+	}
+
+	res := get(nil)
+	suite.Equal(http.StatusOK, res.Code)
+	suite.Equal("public, no-cache", res.Header().Get("Cache-Control"))
+	suite.NotEmpty(res.Header().Get("Last-Modified"))
+
+	etag := res.Header().Get("ETag")
+	if suite.NotEmpty(etag) {
+		suite.Equal(http.StatusNotModified, get(map[string]string{"If-None-Match": etag}).Code)
+	}
+	suite.Equal(http.StatusNotModified, get(map[string]string{"If-Modified-Since": res.Header().Get("Last-Modified")}).Code)
+
+	// the compressed index has its own entity tag
+	res = get(map[string]string{"Accept-Encoding": "gzip"})
+	suite.Equal(http.StatusOK, res.Code)
+	suite.Equal("gzip", res.Header().Get("Content-Encoding"))
+	suite.NotEqual(etag, res.Header().Get("ETag"))
+	suite.Equal(http.StatusOK, get(map[string]string{"Accept-Encoding": "gzip", "If-None-Match": etag}).Code)
+
+	// the entity tag changes when the index does
+	index.Add(&chart.Metadata{Name: "mychart", Version: "0.2.0"}, []string{"/repo/def/mychart-0.2.0.tgz"}, time.Now())
+	res = get(map[string]string{"If-None-Match": etag})
+	suite.Equal(http.StatusOK, res.Code)
+	suite.NotEqual(etag, res.Header().Get("ETag"))
+}
+
+func (suite *ConditionalTestSuite) TestPackage() {
+	created := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	navigator := New(log.NewNopLogger(), Authentication(staticAuthenticator{username: "alice", identity: Identity{Name: "alice"}}))
+	index := navigator.indexManager.Create("default")
+	index.Add(&chart.Metadata{Name: "mychart", Version: "0.1.0"}, []string{"/repo/abc/mychart-0.1.0.tgz"}, created)
+	index.SetDigest("/repo/abc/mychart-0.1.0.tgz", "c0ffee")
+
+	repo := &archiveRepository{fakeRepository: &fakeRepository{url: "repo"}}
+	navigator.repos["repo"] = repo
+
+	get := func(url string, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", url, nil)
+		r.SetBasicAuth("alice", "")
+		for key, value := range headers {
+			r.Header.Set(key, value)
+		}
+
+		res := httptest.NewRecorder()
+		navigator.ServeHTTP(res, r)
+		return res
+	}
+
+	res := get("/repo/abc/mychart-0.1.0.tgz", nil)
+	suite.Equal(http.StatusOK, res.Code)
+	suite.Equal(`"c0ffee"`, res.Header().Get("ETag"))
+	suite.Equal("Tue, 02 Jan 2018 03:04:05 GMT", res.Header().Get("Last-Modified"))
+	suite.Equal("private, max-age=31536000, immutable", res.Header().Get("Cache-Control"))
+
+	// packages clients already have aren't generated
+	suite.Equal(http.StatusNotModified, get("/repo/abc/mychart-0.1.0.tgz", map[string]string{"If-None-Match": `"c0ffee"`}).Code)
+	suite.Equal(http.StatusNotModified, get("/repo/abc/mychart-0.1.0.tgz", map[string]string{"If-Modified-Since": "Tue, 02 Jan 2018 03:04:05 GMT"}).Code)
+	suite.EqualValues(1, repo.generated)
+
+	// packages that aren't indexed have no validators
+	res = get("/repo/def/mychart-0.1.0.tgz", map[string]string{"If-None-Match": `"c0ffee"`})
+	suite.Equal(http.StatusOK, res.Code)
+	suite.Empty(res.Header().Get("ETag"))
+	suite.Empty(res.Header().Get("Last-Modified"))
+
+	// errors aren't cached
+	navigator.repos["repo"] = &fakeRepository{url: "repo"}
+	res = get("/repo/abc/mychart-0.1.0.tgz", nil)
+	suite.Equal(http.StatusInternalServerError, res.Code)
+	suite.Empty(res.Header().Get("Cache-Control"))
+	suite.Empty(res.Header().Get("ETag"))
+
+	// including errors archiving the package
+	navigator.repos["repo"] = &failingArchiveRepository{fakeRepository: &fakeRepository{url: "repo"}}
+	res = get("/repo/abc/mychart-0.1.0.tgz", nil)
+	suite.Equal(http.StatusInternalServerError, res.Code)
+	suite.Empty(res.Header().Get("Cache-Control"))
+	suite.Empty(res.Header().Get("ETag"))
+	suite.Empty(res.Header().Get("Last-Modified"))
+}
+
+func TestConditionalTestSuite(t *testing.T) {
+	suite.Run(t, new(ConditionalTestSuite))
+}
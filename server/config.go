@@ -0,0 +1,445 @@
+package server
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/saracen/navigator/repository"
+)
+
+// Config is the set of indexes and repositories served by the server
+type Config struct {
+	// Indexes are served even if no charts are indexed to them
+	Indexes      []string
+	Repositories []RepositoryConfig
+
+	// Access restricts the indexes, and the chart packages they reference,
+	// that clients can read. If empty, every client can read every index.
+	Access []AccessRule
+}
+
+// RepositoryConfig configures a git backed repository. Refs and directories
+// can be mapped to a named index using the format <selector>@<index>. The
+// repository is polled for updates at Interval, or the server's poll interval
+// if zero.
+type RepositoryConfig struct {
+	URL         string
+	Credentials repository.Credentials
+	Interval    time.Duration
+	Refs        []string
+	Directories []string
+}
+
+// WithIndex returns a ref or directory in the <selector>@<index> format of
+// RepositoryConfig
+func WithIndex(name, index string) string {
+	if index == "" {
+		return name
+	}
+	return name + "@" + index
+}
+
+// indexMappings returns the repository's refs and directories mapped to
+// their indexes
+func (c RepositoryConfig) indexMappings() ([]repository.IndexRef, []repository.IndexDirectory) {
+	var indexRefs []repository.IndexRef
+	for _, ref := range c.Refs {
+		ri := strings.SplitN(ref, "@", 2)
+
+		var indexName string
+		if len(ri) == 2 {
+			indexName = ri[1]
+		}
+
+		indexRefs = append(indexRefs, repository.IndexRef{Name: ri[0], IndexName: indexName})
+	}
+
+	directories := c.Directories
+	if len(directories) == 0 {
+		directories = []string{""}
+	}
+
+	var indexDirectories []repository.IndexDirectory
+	for _, directory := range directories {
+		di := strings.SplitN(directory, "@", 2)
+
+		indexName := "default"
+		if len(di) == 2 {
+			indexName = di[1]
+		}
+
+		indexDirectories = append(indexDirectories, repository.IndexDirectory{Name: di[0], IndexName: indexName})
+	}
+
+	return indexRefs, indexDirectories
+}
+
+// indexNames returns the names of the indexes the repository is indexed to
+func (c RepositoryConfig) indexNames() []string {
+	indexRefs, indexDirectories := c.indexMappings()
+
+	var names []string
+	for _, ref := range indexRefs {
+		if ref.IndexName != "" {
+			names = append(names, ref.IndexName)
+		}
+	}
+	for _, directory := range indexDirectories {
+		names = append(names, directory.IndexName)
+	}
+	return names
+}
+
+// Reconfigure changes the indexes and repositories served to those of the
+// config, while charts continue to be served. New repositories are added and
+// updated by the scheduler. Removed repositories, and indexes no longer in
+// use, are removed along with their data in the data directory. Repositories
+// whose credentials or interval changed are changed in place. Those whose refs
+// or directories changed are indexed again by a replacement, reusing their
+// existing clone, and their charts continue to be served until it has been
+// indexed. Repositories added with the admin API are left unchanged, unless
+// they are also in the config. Access rules are replaced immediately.
+//
+// Charts are removed from indexes along with the repository they were indexed
+// from, so the remaining repositories indexed to the same indexes are indexed
+// again, in case they provide the same chart versions. In progress updates
+// are completed before the server is reconfigured.
+func (s *Server) Reconfigure(config Config) {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	s.setAccessRules(config.Access)
+
+	desired := make(map[string]RepositoryConfig)
+	for _, rc := range config.Repositories {
+		desired[repositoryName(rc.URL)] = rc
+	}
+
+	// remove repositories that are no longer configured, and reconfigure
+	// those that have changed
+	affected := make(map[string]bool)
+	apiRepos := s.apiRepositories()
+	for name, current := range s.repositoryConfigs() {
+		rc, ok := desired[name]
+		if !ok {
+			if apiRepos[name] {
+				continue
+			}
+
+			for _, indexName := range s.removeRepository(name, true) {
+				affected[indexName] = true
+			}
+			continue
+		}
+
+		delete(desired, name)
+		s.reconfigureRepository(name, current, rc)
+	}
+
+	// add new repositories
+	for _, rc := range config.Repositories {
+		if _, ok := desired[repositoryName(rc.URL)]; ok {
+			s.addRepository(rc)
+		}
+	}
+
+	// remove indexes no longer in use
+	s.reposMutex.Lock()
+	s.indexes = config.Indexes
+	s.reposMutex.Unlock()
+	for _, indexName := range config.Indexes {
+		s.indexManager.Create(indexName)
+	}
+	s.removeUnusedIndexes()
+
+	// repositories in the config are no longer managed by the admin API
+	adopted := false
+	for _, rc := range config.Repositories {
+		if name := repositoryName(rc.URL); apiRepos[name] {
+			s.setAPIRepository(name, false)
+			adopted = true
+		}
+	}
+	if adopted {
+		if err := s.saveAPIRepositories(); err != nil {
+			level.Error(s.logger).Log("event", "reconfigure", "err", err)
+		}
+	}
+
+	s.reindex(affected, desired)
+	s.updateMetrics()
+}
+
+// replacement is a repository replacing the repository of the same name, and
+// the configuration it was created with
+type replacement struct {
+	repo   repository.Repository
+	config RepositoryConfig
+}
+
+// reconfigureRepository changes a repository's configuration. If its refs and
+// directories are unchanged, the repository is changed in place. Otherwise, a
+// replacement is created and scheduled to be updated, and is swapped in by its
+// first successful update.
+func (s *Server) reconfigureRepository(name string, current, config RepositoryConfig) {
+	s.reposMutex.RLock()
+	repo := s.repos[name]
+	pending, replacing := s.replacements[name]
+	s.reposMutex.RUnlock()
+
+	previous := current
+	if replacing {
+		previous = pending.config
+	}
+	if reflect.DeepEqual(previous, config) {
+		return
+	}
+
+	level.Info(s.logger).Log("event", "reconfigure-repository", "repository", config.URL, "auth", config.Credentials.String(), "interval", config.Interval, "refs", strings.Join(config.Refs, ","), "directories", strings.Join(config.Directories, ","))
+
+	s.setInterval(name, config.Interval)
+
+	switch {
+	case current.indexesSame(config):
+		// a pending replacement is no longer needed
+		s.reposMutex.Lock()
+		delete(s.replacements, name)
+		s.configs[name] = config
+		s.reposMutex.Unlock()
+
+		setCredentials(repo, config.Credentials)
+
+	case replacing && pending.config.indexesSame(config):
+		s.reposMutex.Lock()
+		s.replacements[name] = replacement{repo: pending.repo, config: config}
+		s.reposMutex.Unlock()
+
+		setCredentials(pending.repo, config.Credentials)
+
+	default:
+		indexRefs, indexDirectories := config.indexMappings()
+		for _, indexName := range config.indexNames() {
+			s.indexManager.Create(indexName)
+		}
+
+		s.reposMutex.Lock()
+		s.replacements[name] = replacement{
+			repo:   repository.NewGitBackedReplacement(s.logger, s.dependencyManager, name, config.URL, s.repositoryDir(name), config.Credentials, indexRefs, indexDirectories),
+			config: config,
+		}
+		s.reposMutex.Unlock()
+
+		s.scheduleUpdate(name)
+	}
+}
+
+// indexesSame returns whether two configurations index the same charts to the
+// same indexes
+func (c RepositoryConfig) indexesSame(other RepositoryConfig) bool {
+	refs, directories := c.indexMappings()
+	otherRefs, otherDirectories := other.indexMappings()
+
+	return c.URL == other.URL && reflect.DeepEqual(refs, otherRefs) && reflect.DeepEqual(directories, otherDirectories)
+}
+
+// setCredentials changes the credentials of a repository that supports it
+func setCredentials(repo repository.Repository, credentials repository.Credentials) {
+	if reauthenticator, ok := repo.(repository.Reauthenticator); ok {
+		reauthenticator.SetCredentials(credentials)
+	}
+}
+
+// replaceRepository swaps a repository for its replacement, once the
+// replacement has been successfully updated. The remaining repositories of the
+// indexes that changed are indexed again, and indexes no longer in use are
+// removed. The reload mutex must be held.
+func (s *Server) replaceRepository(name string, pending replacement) {
+	s.reposMutex.Lock()
+	if current, ok := s.replacements[name]; !ok || current.repo != pending.repo {
+		// already replaced by a concurrent update, or discarded by a reload
+		s.reposMutex.Unlock()
+		return
+	}
+	delete(s.replacements, name)
+	s.repos[name] = pending.repo
+	s.configs[name] = pending.config
+	s.reposMutex.Unlock()
+
+	affected := make(map[string]bool)
+	if replacer, ok := pending.repo.(repository.Replacer); ok {
+		for _, indexName := range replacer.Replace() {
+			affected[indexName] = true
+		}
+	}
+
+	level.Info(s.logger).Log("event", "replace-repository", "repository", pending.config.URL)
+
+	s.removeUnusedIndexes()
+	s.reindex(affected, map[string]RepositoryConfig{name: pending.config})
+}
+
+// removeUnusedIndexes removes the indexes that are neither configured, nor
+// indexed to by a repository or pending replacement
+func (s *Server) removeUnusedIndexes() {
+	used := make(map[string]bool)
+
+	s.reposMutex.RLock()
+	for _, indexName := range s.indexes {
+		used[indexName] = true
+	}
+	for _, rc := range s.configs {
+		for _, indexName := range rc.indexNames() {
+			used[indexName] = true
+		}
+	}
+	for _, pending := range s.replacements {
+		for _, indexName := range pending.config.indexNames() {
+			used[indexName] = true
+		}
+	}
+	s.reposMutex.RUnlock()
+
+	for _, indexName := range s.indexManager.Names() {
+		if !used[indexName] {
+			s.removeIndex(indexName)
+		}
+	}
+}
+
+// reindex indexes the repositories of affected indexes again, other than
+// those skipped. The reload mutex must be held.
+func (s *Server) reindex(affected map[string]bool, skip map[string]RepositoryConfig) {
+	for name, rc := range s.repositoryConfigs() {
+		if _, ok := skip[name]; ok {
+			continue
+		}
+
+		for _, indexName := range rc.indexNames() {
+			if !affected[indexName] {
+				continue
+			}
+
+			if repo, ok := s.repository(name); ok {
+				if reindexer, ok := repo.(repository.Reindexer); ok {
+					reindexer.Reindex()
+				}
+				s.TriggerUpdate(name)
+			}
+			break
+		}
+	}
+}
+
+// removeRepository removes a repository and its charts from every index,
+// returning the names of the indexes charts were removed from. If purge is
+// set, the repository's clone and indexing state are removed from the data
+// directory.
+func (s *Server) removeRepository(name string, purge bool) []string {
+	s.reposMutex.Lock()
+	repo, ok := s.repos[name]
+	delete(s.repos, name)
+	delete(s.configs, name)
+	delete(s.apiRepos, name)
+	delete(s.replacements, name)
+	s.reposMutex.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	s.statusMutex.Lock()
+	delete(s.status, name)
+	s.statusMutex.Unlock()
+
+	s.dependencyManager.RemoveRepository(name)
+	nextUpdateGauge.Delete(prometheus.Labels{"repository": repo.URL()})
+
+	level.Info(s.logger).Log("event", "remove-repository", "repository", repo.URL(), "purge", purge)
+
+	var affected []string
+	for _, indexName := range s.indexManager.Names() {
+		index, err := s.indexManager.Get(indexName)
+		if err != nil {
+			continue
+		}
+
+		if removed := index.RemoveRepository(name); len(removed) > 0 {
+			affected = append(affected, indexName)
+		}
+	}
+
+	if purge && s.dataDir != "" {
+		if err := os.RemoveAll(s.repositoryDir(name)); err != nil {
+			level.Error(s.logger).Log("event", "remove-repository", "repository", repo.URL(), "err", err)
+		}
+
+		s.snapshotMutex.Lock()
+		if err := os.Remove(s.repositorySnapshotPath(name)); err != nil && !os.IsNotExist(err) {
+			level.Error(s.logger).Log("event", "remove-repository", "repository", repo.URL(), "err", err)
+		}
+		s.snapshotMutex.Unlock()
+	}
+
+	return affected
+}
+
+// removeIndex removes an index, along with its snapshot
+func (s *Server) removeIndex(indexName string) {
+	// the snapshot mutex is held so that a snapshot being written doesn't
+	// write the index again once removed
+	s.snapshotMutex.Lock()
+	s.indexManager.Remove(indexName)
+	delete(s.snapshotETags, indexName)
+	if s.dataDir != "" {
+		if err := os.Remove(s.indexSnapshotPath(indexName)); err != nil && !os.IsNotExist(err) {
+			level.Error(s.logger).Log("event", "remove-index", "index", indexName, "err", err)
+		}
+	}
+	s.snapshotMutex.Unlock()
+
+	chartTotalGauge.Delete(prometheus.Labels{"index": indexName})
+	chartVersionTotalGauge.Delete(prometheus.Labels{"index": indexName})
+
+	level.Info(s.logger).Log("event", "remove-index", "index", indexName)
+}
+
+// apiRepositories returns the names of the repositories added with the admin
+// API
+func (s *Server) apiRepositories() map[string]bool {
+	s.reposMutex.RLock()
+	defer s.reposMutex.RUnlock()
+
+	names := make(map[string]bool, len(s.apiRepos))
+	for name := range s.apiRepos {
+		names[name] = true
+	}
+	return names
+}
+
+func (s *Server) setAPIRepository(name string, api bool) {
+	s.reposMutex.Lock()
+	defer s.reposMutex.Unlock()
+
+	if api {
+		s.apiRepos[name] = true
+	} else {
+		delete(s.apiRepos, name)
+	}
+}
+
+// repositoryConfigs returns a copy of the repository configurations by name
+func (s *Server) repositoryConfigs() map[string]RepositoryConfig {
+	s.reposMutex.RLock()
+	defer s.reposMutex.RUnlock()
+
+	configs := make(map[string]RepositoryConfig, len(s.configs))
+	for name, config := range s.configs {
+		configs[name] = config
+	}
+	return configs
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/saracen/navigator/repository"
+)
+
+type ConfigTestSuite struct {
+	suite.Suite
+	dataDir string
+}
+
+func (suite *ConfigTestSuite) SetupTest() {
+	var err error
+	suite.dataDir, err = ioutil.TempDir("", "navigator-config")
+	suite.Require().NoError(err)
+}
+
+func (suite *ConfigTestSuite) TearDownTest() {
+	os.RemoveAll(suite.dataDir)
+}
+
+func (suite *ConfigTestSuite) TestIndexNames() {
+	config := RepositoryConfig{
+		Refs:        []string{"master", "tags/v*@releases"},
+		Directories: []string{"charts@stable", "incubator"},
+	}
+	suite.Equal([]string{"releases", "stable", "default"}, config.indexNames())
+
+	suite.Equal([]string{"default"}, RepositoryConfig{}.indexNames())
+}
+
+func (suite *ConfigTestSuite) TestReconfigure() {
+	navigator := New(log.NewNopLogger(), DataDir(suite.dataDir))
+
+	removed := RepositoryConfig{URL: "../.git", Directories: []string{"repository/testdata/charts@removed"}}
+	shared := RepositoryConfig{URL: "./../.git", Directories: []string{"repository/testdata/charts@shared"}}
+	unshared := RepositoryConfig{URL: "../.git/", Directories: []string{"repository/testdata/charts@shared"}}
+
+	navigator.Reconfigure(Config{
+		Indexes:      []string{"empty"},
+		Repositories: []RepositoryConfig{removed, shared, unshared},
+	})
+	suite.Len(navigator.repositories(), 3)
+	suite.Equal([]string{"empty", "removed", "shared"}, navigator.indexManager.Names())
+
+	if !suite.NoError(navigator.UpdateRepositories()) {
+		return
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(navigator.ServeReady))
+	defer ts.Close()
+
+	// reconfiguring with the same configuration changes nothing
+	repos := navigator.repositories()
+	navigator.Reconfigure(Config{
+		Indexes:      []string{"empty"},
+		Repositories: []RepositoryConfig{removed, shared, unshared},
+	})
+	suite.Equal(repos, navigator.repositories())
+
+	replaced, _ := navigator.repository(repositoryName(shared.URL))
+	changed := RepositoryConfig{URL: "./../.git", Directories: []string{"repository/testdata/charts@changed"}}
+	added := RepositoryConfig{URL: "./.././.git", Directories: []string{"repository/testdata/charts@added"}}
+	navigator.Reconfigure(Config{
+		Repositories: []RepositoryConfig{changed, unshared, added},
+	})
+	waitForTriggers(navigator)
+
+	// removed repositories and unused indexes are removed, along with their data
+	suite.Equal([]string{"added", "changed", "shared"}, navigator.indexManager.Names())
+	_, ok := navigator.repository(repositoryName(removed.URL))
+	suite.False(ok)
+	_, err := os.Stat(navigator.repositoryDir(repositoryName(removed.URL)))
+	suite.True(os.IsNotExist(err))
+	_, err = os.Stat(navigator.repositorySnapshotPath(repositoryName(removed.URL)))
+	suite.True(os.IsNotExist(err))
+
+	// the changed repository continues to be served until its replacement
+	// has been indexed
+	repo, ok := navigator.repository(repositoryName(changed.URL))
+	suite.True(ok)
+	suite.Equal(replaced, repo)
+	suite.Equal(syncComplete, navigator.repositoryStatus(repositoryName(changed.URL)).State)
+	index, err := navigator.indexManager.Get("changed")
+	if suite.NoError(err) {
+		_, err = index.Get("mychart", "0.1.0")
+		suite.Error(err)
+	}
+
+	// the server remains ready while new repositories are synchronized
+	res, err := http.Get(ts.URL)
+	if suite.NoError(err) {
+		suite.Equal(http.StatusOK, res.StatusCode)
+		res.Body.Close()
+	}
+
+	if !suite.NoError(navigator.UpdateRepositories()) {
+		return
+	}
+	waitForTriggers(navigator)
+
+	// the replacement is swapped in, reusing the changed repository's clone
+	repo, _ = navigator.repository(repositoryName(changed.URL))
+	suite.NotEqual(replaced, repo)
+	_, err = os.Stat(navigator.repositoryDir(repositoryName(changed.URL)))
+	suite.NoError(err)
+
+	for _, indexName := range []string{"added", "changed"} {
+		index, err := navigator.indexManager.Get(indexName)
+		if suite.NoError(err) {
+			_, err = index.Get("mychart", "0.1.0")
+			suite.NoError(err, indexName)
+		}
+	}
+
+	// charts removed with the replaced repository are indexed again from the
+	// repository sharing its index
+	index, err = navigator.indexManager.Get("shared")
+	if suite.NoError(err) {
+		_, err = index.Get("mychart", "0.1.0")
+		suite.NoError(err)
+	}
+}
+
+func (suite *ConfigTestSuite) TestReconfigureInterval() {
+	navigator := New(log.NewNopLogger(), DataDir(suite.dataDir))
+
+	config := RepositoryConfig{URL: "../.git", Directories: []string{"repository/testdata/charts"}}
+	navigator.Reconfigure(Config{Repositories: []RepositoryConfig{config}})
+	if !suite.NoError(navigator.UpdateRepositories()) {
+		return
+	}
+
+	index, err := navigator.indexManager.Get("default")
+	suite.Require().NoError(err)
+	before, err := index.Serialize()
+	suite.Require().NoError(err)
+	repo, _ := navigator.repository(repositoryName(config.URL))
+
+	// changing the interval or credentials changes the repository in place,
+	// leaving its charts indexed
+	config.Interval = time.Hour
+	config.Credentials = repository.Credentials{Username: "user", Password: "pass"}
+	navigator.Reconfigure(Config{Repositories: []RepositoryConfig{config}})
+	waitForTriggers(navigator)
+
+	after, err := index.Serialize()
+	suite.Require().NoError(err)
+	suite.Equal(before.ETag, after.ETag)
+	charts, _ := index.Count()
+	suite.NotZero(charts)
+
+	current, _ := navigator.repository(repositoryName(config.URL))
+	suite.Equal(repo, current)
+	suite.Equal(config, navigator.repositoryConfigs()[repositoryName(config.URL)])
+
+	status := navigator.repositoryStatus(repositoryName(config.URL))
+	suite.Equal(syncComplete, status.State)
+	suite.Equal(time.Hour, status.Interval)
+	suite.False(status.NextUpdate.After(time.Now().Add(time.Hour)))
+}
+
+func TestConfigTestSuite(t *testing.T) {
+	suite.Run(t, new(ConfigTestSuite))
+}
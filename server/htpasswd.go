@@ -0,0 +1,70 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HtpasswdAuthenticator authenticates HTTP basic auth credentials against the
+// bcrypt hashed passwords of an htpasswd file
+type HtpasswdAuthenticator struct {
+	users map[string][]byte
+}
+
+// NewHtpasswdAuthenticator returns an authenticator for the users of an
+// htpasswd file. Only bcrypt hashed passwords (htpasswd -B) are supported.
+func NewHtpasswdAuthenticator(filename string) (*HtpasswdAuthenticator, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := parseHtpasswd(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return &HtpasswdAuthenticator{users: users}, nil
+}
+
+func parseHtpasswd(data []byte) (map[string][]byte, error) {
+	users := make(map[string][]byte)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		kv := strings.SplitN(entry, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("line %d: expected <username>:<password hash>", line)
+		}
+		if _, err := bcrypt.Cost([]byte(kv[1])); err != nil {
+			return nil, fmt.Errorf("line %d: user %q: password is not bcrypt hashed", line, kv[0])
+		}
+		users[kv[0]] = []byte(kv[1])
+	}
+
+	return users, scanner.Err()
+}
+
+// Authenticate authenticates a request's basic auth credentials
+func (a *HtpasswdAuthenticator) Authenticate(r *http.Request) (Identity, bool) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return Identity{}, false
+	}
+
+	hash, ok := a.users[username]
+	if !ok || bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return Identity{}, false
+	}
+	return Identity{Name: username}, true
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type HtpasswdTestSuite struct {
+	suite.Suite
+}
+
+func (suite *HtpasswdTestSuite) TestAuthenticate() {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	suite.Require().NoError(err)
+
+	f, err := ioutil.TempFile("", "navigator-htpasswd")
+	suite.Require().NoError(err)
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, "# users\nhelm:%s\n", hash)
+	f.Close()
+
+	authenticator, err := NewHtpasswdAuthenticator(f.Name())
+	suite.Require().NoError(err)
+
+	tests := []struct {
+		username, password string
+		ok                 bool
+	}{
+		{"helm", "secret", true},
+		{"helm", "wrong", false},
+		{"other", "secret", false},
+		{"", "", false},
+	}
+
+	for idx, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if test.username != "" {
+			req.SetBasicAuth(test.username, test.password)
+		}
+
+		identity, ok := authenticator.Authenticate(req)
+		suite.Equal(test.ok, ok, "test index: %v", idx)
+		if test.ok {
+			suite.Equal(Identity{Name: test.username}, identity, "test index: %v", idx)
+		}
+	}
+}
+
+func (suite *HtpasswdTestSuite) TestParseErrors() {
+	tests := []string{
+		"helm",
+		":$2y$05$abcdefghijklmnopqrstuv",
+		// apr1 and sha1 hashes aren't supported
+		"helm:$apr1$salt$hash",
+		"helm:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+	}
+
+	for idx, test := range tests {
+		_, err := parseHtpasswd([]byte(test))
+		suite.Error(err, "test index: %v", idx)
+	}
+
+	_, err := NewHtpasswdAuthenticator("testdata/missing.htpasswd")
+	suite.Error(err)
+}
+
+func TestHtpasswdTestSuite(t *testing.T) {
+	suite.Run(t, new(HtpasswdTestSuite))
+}
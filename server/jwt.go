@@ -0,0 +1,172 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// JWTAuthenticator authenticates bearer tokens that are JSON Web Tokens signed
+// by one of the keys of a JSON Web Key Set. The token's subject is the
+// identity's name, and its "groups" claim the identity's groups.
+type JWTAuthenticator struct {
+	keys     []jose.JSONWebKey
+	issuer   string
+	audience string
+	now      func() time.Time
+}
+
+// jwtClaims are the registered claims of a token, and the groups of its
+// subject
+type jwtClaims struct {
+	jwt.Claims
+	jwtGroups
+}
+
+type jwtGroups struct {
+	Groups []string `json:"groups"`
+}
+
+// jwtLeeway is the clock skew tolerated when checking token expiry
+const jwtLeeway = time.Minute
+
+// jwtAlgorithms are the supported JWS signing algorithms. Only asymmetric
+// algorithms are supported.
+var jwtAlgorithms = map[string]bool{
+	string(jose.RS256): true,
+	string(jose.RS384): true,
+	string(jose.RS512): true,
+	string(jose.PS256): true,
+	string(jose.PS384): true,
+	string(jose.PS512): true,
+	string(jose.ES256): true,
+	string(jose.ES384): true,
+	string(jose.ES512): true,
+}
+
+// NewJWTAuthenticator returns an authenticator for tokens signed by the keys
+// of a JWKS file. If issuer or audience are not empty, tokens must have been
+// issued by and for them.
+func NewJWTAuthenticator(jwksFile, issuer, audience string) (*JWTAuthenticator, error) {
+	data, err := ioutil.ReadFile(jwksFile)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", jwksFile, err)
+	}
+
+	return &JWTAuthenticator{keys: keys, issuer: issuer, audience: audience, now: time.Now}, nil
+}
+
+// parseJWKS returns the signing keys of a JSON Web Key Set. Keys for other
+// uses are ignored, and only RSA and elliptic curve public keys are supported.
+func parseJWKS(data []byte) ([]jose.JSONWebKey, error) {
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	var keys []jose.JSONWebKey
+	for idx, raw := range set.Keys {
+		var use struct {
+			Use string `json:"use"`
+		}
+		if err := json.Unmarshal(raw, &use); err != nil {
+			return nil, fmt.Errorf("keys[%d]: %v", idx, err)
+		}
+		if use.Use != "" && use.Use != "sig" {
+			continue
+		}
+
+		var key jose.JSONWebKey
+		if err := json.Unmarshal(raw, &key); err != nil {
+			return nil, fmt.Errorf("keys[%d]: %v", idx, err)
+		}
+
+		switch key.Key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+		default:
+			return nil, fmt.Errorf("keys[%d]: only RSA and elliptic curve public keys are supported", idx)
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys found")
+	}
+	return keys, nil
+}
+
+// Authenticate authenticates a request's bearer token, or basic auth password
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (Identity, bool) {
+	token, ok := requestToken(r)
+	if !ok {
+		return Identity{}, false
+	}
+
+	claims, err := a.verify(token)
+	if err != nil {
+		return Identity{}, false
+	}
+	return Identity{Name: claims.Subject, Groups: claims.Groups}, true
+}
+
+// verify verifies a token's signature and claims, returning the claims
+func (a *JWTAuthenticator) verify(token string) (*jwtClaims, error) {
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token: %v", err)
+	}
+
+	header := parsed.Headers[0]
+	if !jwtAlgorithms[header.Algorithm] {
+		return nil, errors.New("invalid signature: unsupported algorithm")
+	}
+
+	var (
+		claims   jwtClaims
+		verified bool
+	)
+	for _, key := range a.keys {
+		if header.KeyID != "" && key.KeyID != "" && header.KeyID != key.KeyID {
+			continue
+		}
+		if parsed.Claims(key.Key, &claims.Claims, &claims.jwtGroups) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid signature")
+	}
+
+	switch {
+	case claims.Subject == "":
+		return nil, errors.New("missing subject")
+	case claims.Expiry == 0:
+		return nil, errors.New("missing expiry")
+	}
+
+	expected := jwt.Expected{Issuer: a.issuer, Time: a.now()}
+	if a.audience != "" {
+		expected.Audience = jwt.Audience{a.audience}
+	}
+	if err = claims.ValidateWithLeeway(expected, jwtLeeway); err != nil {
+		return nil, err
+	}
+
+	return &claims, nil
+}
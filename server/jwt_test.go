@@ -0,0 +1,173 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type JWTTestSuite struct {
+	suite.Suite
+	rsaKey        *rsa.PrivateKey
+	ecKey         *ecdsa.PrivateKey
+	authenticator *JWTAuthenticator
+	now           time.Time
+}
+
+func (suite *JWTTestSuite) SetupSuite() {
+	var err error
+	suite.rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	suite.Require().NoError(err)
+	suite.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	suite.Require().NoError(err)
+
+	encode := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+	jwks, _ := json.Marshal(map[string][]map[string]string{
+		"keys": {
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": encode(suite.rsaKey.N), "e": encode(big.NewInt(int64(suite.rsaKey.E)))},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(suite.ecKey.X), "y": encode(suite.ecKey.Y)},
+			{"kty": "RSA", "kid": "encryption", "use": "enc", "n": "invalid"},
+		},
+	})
+
+	f, err := ioutil.TempFile("", "navigator-jwks")
+	suite.Require().NoError(err)
+	defer os.Remove(f.Name())
+	f.Write(jwks)
+	f.Close()
+
+	suite.authenticator, err = NewJWTAuthenticator(f.Name(), "https://issuer.example.com", "navigator")
+	suite.Require().NoError(err)
+	suite.Len(suite.authenticator.keys, 2)
+
+	suite.now = time.Now()
+	suite.authenticator.now = func() time.Time { return suite.now }
+}
+
+// sign returns a token with the claims, signed with alg by the key identified
+// by kid
+func (suite *JWTTestSuite) sign(alg, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch alg {
+	case "RS256":
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, suite.rsaKey, crypto.SHA256, digest[:])
+		suite.Require().NoError(err)
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, suite.ecKey, digest[:])
+		suite.Require().NoError(err)
+		signature = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(signature[32-len(rb):], rb)
+		copy(signature[64-len(sb):], sb)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (suite *JWTTestSuite) claims(overrides map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"sub":    "ci",
+		"iss":    "https://issuer.example.com",
+		"aud":    []string{"other", "navigator"},
+		"exp":    suite.now.Add(time.Hour).Unix(),
+		"groups": []string{"ops"},
+	}
+	for k, v := range overrides {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+	return claims
+}
+
+func (suite *JWTTestSuite) TestAuthenticate() {
+	for _, alg := range []string{"RS256", "ES256"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+suite.sign(alg, "", suite.claims(nil)))
+
+		identity, ok := suite.authenticator.Authenticate(req)
+		suite.True(ok, alg)
+		suite.Equal(Identity{Name: "ci", Groups: []string{"ops"}}, identity, alg)
+	}
+
+	// tokens can be provided as the basic auth password
+	req := httptest.NewRequest("GET", "/", nil)
+	req.SetBasicAuth("helm", suite.sign("ES256", "ec", suite.claims(map[string]interface{}{"aud": "navigator"})))
+	_, ok := suite.authenticator.Authenticate(req)
+	suite.True(ok)
+}
+
+func (suite *JWTTestSuite) TestVerifyErrors() {
+	valid := suite.sign("RS256", "rsa", suite.claims(nil))
+
+	tests := []struct {
+		token string
+		err   string
+	}{
+		{"not.a-token", "malformed token"},
+		{valid[:len(valid)-4] + "AAAA", "invalid signature"},
+		{suite.sign("RS256", "ec", suite.claims(nil)), "invalid signature"},
+		{suite.sign("ES256", "rsa", suite.claims(nil)), "invalid signature"},
+		{suite.sign("HS256", "", suite.claims(nil)), "invalid signature"},
+		{suite.sign("none", "", suite.claims(nil)), "invalid signature"},
+		{suite.sign("RS256", "", suite.claims(map[string]interface{}{"sub": nil})), "missing subject"},
+		{suite.sign("RS256", "", suite.claims(map[string]interface{}{"exp": nil})), "missing expiry"},
+		{suite.sign("RS256", "", suite.claims(map[string]interface{}{"exp": suite.now.Add(-time.Hour).Unix()})), "token is expired"},
+		{suite.sign("RS256", "", suite.claims(map[string]interface{}{"nbf": suite.now.Add(time.Hour).Unix()})), "token not valid yet"},
+		{suite.sign("RS256", "", suite.claims(map[string]interface{}{"iss": "https://other.example.com"})), "invalid issuer"},
+		{suite.sign("RS256", "", suite.claims(map[string]interface{}{"aud": "other"})), "invalid audience"},
+	}
+
+	for idx, test := range tests {
+		_, err := suite.authenticator.verify(test.token)
+		if suite.Error(err, "test index: %v", idx) {
+			suite.Contains(err.Error(), test.err, "test index: %v", idx)
+		}
+	}
+
+	// expiry tolerates clock skew
+	_, err := suite.authenticator.verify(suite.sign("RS256", "", suite.claims(map[string]interface{}{"exp": suite.now.Add(-time.Second).Unix()})))
+	suite.NoError(err)
+}
+
+func (suite *JWTTestSuite) TestParseJWKSErrors() {
+	tests := []string{
+		`{"keys": []}`,
+		`{"keys": [{"kty": "oct", "k": "c2VjcmV0"}]}`,
+		`{"keys": [{"kty": "EC", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`,
+		`{"keys": [{"kty": "EC", "crv": "secp256k1", "x": "AQ", "y": "AQ"}]}`,
+		`{"keys": [{"kty": "RSA", "n": "AQ"}]}`,
+		`not json`,
+	}
+
+	for idx, test := range tests {
+		_, err := parseJWKS([]byte(test))
+		suite.Error(err, "test index: %v", idx)
+	}
+}
+
+func TestJWTTestSuite(t *testing.T) {
+	suite.Run(t, new(JWTTestSuite))
+}
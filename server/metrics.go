@@ -62,6 +62,41 @@ var (
 		},
 		[]string{"index"},
 	)
+
+	nextUpdateGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "navigator",
+			Name:      "repository_next_update_timestamp_seconds",
+			Help:      "Time of the next scheduled update by repository",
+		},
+		[]string{"repository"},
+	)
+
+	archiveCacheHits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "navigator",
+			Name:      "archive_cache_hits_total",
+			Help:      "Chart package requests served from the cache, by cache",
+		},
+		[]string{"cache"},
+	)
+
+	archiveCacheMisses = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "navigator",
+			Name:      "archive_cache_misses_total",
+			Help:      "Chart package requests not in the cache, that the package was generated for",
+		},
+	)
+
+	archiveCacheSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "navigator",
+			Name:      "archive_cache_size_bytes",
+			Help:      "Size of the chart packages cached, by cache",
+		},
+		[]string{"cache"},
+	)
 )
 
 func init() {
@@ -71,7 +106,11 @@ func init() {
 		responseSize,
 		requestSize,
 		chartTotalGauge,
-		chartVersionTotalGauge)
+		chartVersionTotalGauge,
+		nextUpdateGauge,
+		archiveCacheHits,
+		archiveCacheMisses,
+		archiveCacheSize)
 }
 
 // MetricMiddleware wraps a http handler with prometheus metric instruments
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"k8s.io/helm/pkg/repo"
+
+	"github.com/saracen/navigator/repository"
+)
+
+// serveProvenance serves the provenance file of the chart package filename.
+// A provenance file committed alongside the chart is served if passthrough is
+// enabled, otherwise one is generated for chart packages that are indexed.
+func (s *Server) serveProvenance(w http.ResponseWriter, r *http.Request, dir, filename string) (int, error) {
+	chart := strings.SplitN(dir, "/", 2)
+	if len(chart) != 2 {
+		return http.StatusNotFound, repository.ErrInvalidPackageName
+	}
+
+	packageURL := strings.TrimSuffix(r.URL.Path, ".prov")
+	if !s.canReadPackage(r, packageURL) {
+		return http.StatusForbidden, errForbidden
+	}
+
+	repo, ok := s.repository(chart[0])
+	if !ok {
+		return http.StatusNotFound, repository.ErrRepositoryNotFound
+	}
+
+	var (
+		data []byte
+		err  error
+	)
+
+	if reader, ok := repo.(repository.ProvenanceReader); ok && s.passthroughProvenance {
+		data, err = reader.Provenance(chart[1], filename)
+	} else {
+		err = repository.ErrProvenanceNotFound
+	}
+
+	if err == repository.ErrProvenanceNotFound && s.signer != nil {
+		data, err = s.signProvenance(repo, chart[0], chart[1], packageURL, filename)
+	}
+
+	switch err {
+	case nil:
+	case repository.ErrProvenanceNotFound:
+		return http.StatusNotFound, err
+	case repository.ErrRepositoryNotReady:
+		return http.StatusServiceUnavailable, err
+	default:
+		return http.StatusInternalServerError, err
+	}
+
+	w.Header().Set("Content-Type", "application/pgp-signature")
+	if _, err = w.Write(data); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// signProvenance generates the provenance file of an indexed chart package
+func (s *Server) signProvenance(repo repository.Repository, repoName, name, packageURL, filename string) ([]byte, error) {
+	cv, ok := s.chartVersion(packageURL)
+	if !ok {
+		return nil, repository.ErrProvenanceNotFound
+	}
+
+	// the digest is only missing if it couldn't be computed when indexed
+	digest := cv.Digest
+	if digest == "" {
+		archiver, err := repo.ChartPackage(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if s.cache != nil {
+			data, err := s.cachedChartPackage(repoName, name, archiver)
+			if err != nil {
+				return nil, err
+			}
+
+			sum := sha256.Sum256(data)
+			digest = hex.EncodeToString(sum[:])
+		} else {
+			hash := sha256.New()
+			if err = archiver.Archive(hash); err != nil {
+				return nil, err
+			}
+			digest = hex.EncodeToString(hash.Sum(nil))
+		}
+	}
+
+	return s.signer.Sign(cv.Metadata, filename, digest)
+}
+
+// chartVersion returns the indexed chart version with the package URL
+func (s *Server) chartVersion(url string) (*repo.ChartVersion, bool) {
+	for _, indexName := range s.indexManager.Names() {
+		index, err := s.indexManager.Get(indexName)
+		if err != nil || !index.ContainsURL(url) {
+			continue
+		}
+
+		found := index.Find(func(cv *repo.ChartVersion) bool {
+			return len(cv.URLs) > 0 && cv.URLs[0] == url
+		})
+		if len(found) > 0 {
+			return found[0], true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+
+	"github.com/saracen/navigator/repository"
+)
+
+// provenanceRepository is a fake repository with committed provenance files
+type provenanceRepository struct {
+	*fakeRepository
+	provenance map[string]string
+}
+
+func (r *provenanceRepository) Provenance(name, filename string) ([]byte, error) {
+	if data, ok := r.provenance[name+"/"+filename]; ok {
+		return []byte(data), nil
+	}
+	return nil, repository.ErrProvenanceNotFound
+}
+
+type ProvenanceTestSuite struct {
+	suite.Suite
+	keyring string
+	signer  *repository.Signer
+}
+
+func (suite *ProvenanceTestSuite) SetupSuite() {
+	f, err := ioutil.TempFile("", "navigator-keyring")
+	suite.Require().NoError(err)
+	defer f.Close()
+	suite.keyring = f.Name()
+
+	entity, err := openpgp.NewEntity("navigator", "", "navigator@example.com", nil)
+	suite.Require().NoError(err)
+	suite.Require().NoError(entity.SerializePrivate(f, nil))
+
+	suite.signer, err = repository.NewSigner(suite.keyring, "", nil)
+	suite.Require().NoError(err)
+}
+
+func (suite *ProvenanceTestSuite) TearDownSuite() {
+	os.Remove(suite.keyring)
+}
+
+// newServer returns a server with a repository that has a signed chart
+// committed, and an unsigned chart
+func (suite *ProvenanceTestSuite) newServer(options ...Option) *Server {
+	navigator := New(log.NewNopLogger(), options...)
+
+	index := navigator.indexManager.Create("default")
+	index.Add(&chart.Metadata{Name: "signed", Version: "0.1.0"}, []string{"/repo/abc/charts/signed/signed-0.1.0.tgz"}, time.Now())
+	index.Add(&chart.Metadata{Name: "unsigned", Version: "0.1.0"}, []string{"/repo/abc/charts/unsigned/unsigned-0.1.0.tgz"}, time.Now())
+	index.SetDigest("/repo/abc/charts/signed/signed-0.1.0.tgz", "c0ffee")
+	index.SetDigest("/repo/abc/charts/unsigned/unsigned-0.1.0.tgz", "c0ffee")
+
+	navigator.repos["repo"] = &provenanceRepository{
+		fakeRepository: &fakeRepository{url: "repo"},
+		provenance:     map[string]string{"abc/charts/signed/signed-0.1.0.tgz": "committed"},
+	}
+
+	return navigator
+}
+
+func (suite *ProvenanceTestSuite) get(navigator *Server, path string) *httptest.ResponseRecorder {
+	res := httptest.NewRecorder()
+	navigator.ServeHTTP(res, httptest.NewRequest("GET", path, nil))
+	return res
+}
+
+func (suite *ProvenanceTestSuite) TestSigned() {
+	navigator := suite.newServer(Sign(suite.signer))
+
+	res := suite.get(navigator, "/repo/abc/charts/unsigned/unsigned-0.1.0.tgz.prov")
+	suite.Require().Equal(http.StatusOK, res.Code)
+
+	block, _ := clearsign.Decode(res.Body.Bytes())
+	if suite.NotNil(block) {
+		suite.Contains(string(block.Plaintext), "name: unsigned")
+		suite.Contains(string(block.Plaintext), "unsigned-0.1.0.tgz: sha256:c0ffee")
+	}
+
+	// committed provenance files are ignored without passthrough
+	res = suite.get(navigator, "/repo/abc/charts/signed/signed-0.1.0.tgz.prov")
+	suite.Equal(http.StatusOK, res.Code)
+	suite.True(strings.HasPrefix(res.Body.String(), "-----BEGIN PGP SIGNED MESSAGE-----"))
+
+	// packages that aren't indexed aren't signed
+	suite.Equal(http.StatusNotFound, suite.get(navigator, "/repo/def/charts/unsigned/unsigned-0.1.0.tgz.prov").Code)
+	suite.Equal(http.StatusNotFound, suite.get(navigator, "/other/abc/charts/unsigned/unsigned-0.1.0.tgz.prov").Code)
+}
+
+func (suite *ProvenanceTestSuite) TestPassthrough() {
+	navigator := suite.newServer(PassthroughProvenance(true))
+
+	res := suite.get(navigator, "/repo/abc/charts/signed/signed-0.1.0.tgz.prov")
+	suite.Equal(http.StatusOK, res.Code)
+	suite.Equal("committed", res.Body.String())
+
+	suite.Equal(http.StatusNotFound, suite.get(navigator, "/repo/abc/charts/unsigned/unsigned-0.1.0.tgz.prov").Code)
+
+	// charts without committed provenance files are signed
+	navigator = suite.newServer(PassthroughProvenance(true), Sign(suite.signer))
+	suite.Equal("committed", suite.get(navigator, "/repo/abc/charts/signed/signed-0.1.0.tgz.prov").Body.String())
+	suite.Equal(http.StatusOK, suite.get(navigator, "/repo/abc/charts/unsigned/unsigned-0.1.0.tgz.prov").Code)
+}
+
+func (suite *ProvenanceTestSuite) TestDisabled() {
+	navigator := suite.newServer()
+	suite.Equal(http.StatusNotFound, suite.get(navigator, "/repo/abc/charts/signed/signed-0.1.0.tgz.prov").Code)
+}
+
+func TestProvenanceTestSuite(t *testing.T) {
+	suite.Run(t, new(ProvenanceTestSuite))
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// maxBackoff is the longest a failing repository's updates are backed off
+	// to, unless its poll interval is longer
+	maxBackoff = time.Hour
+
+	// jitterFactor is the fraction of an update interval that updates are
+	// randomly spread across, so that repositories added together aren't all
+	// updated at the same moment
+	jitterFactor = 0.1
+)
+
+// backoff returns the delay before the next update of a repository that has
+// failed to update consecutively failures times. The first retry is after the
+// poll interval, with the delay doubling for each further failure up to
+// maxBackoff.
+func backoff(interval time.Duration, failures int) time.Duration {
+	delay := interval
+	for i := 1; i < failures && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > maxBackoff && interval < maxBackoff {
+		return maxBackoff
+	}
+	if delay < interval {
+		return interval
+	}
+	return delay
+}
+
+// jitter randomly adjusts a delay by up to jitterFactor in either direction
+func jitter(r *rand.Rand, delay time.Duration) time.Duration {
+	spread := int64(float64(delay) * jitterFactor)
+	if spread <= 0 {
+		return delay
+	}
+
+	return delay + time.Duration(r.Int63n(2*spread+1)-spread)
+}
+
+// Run updates repositories on their schedule until stop is closed, then waits
+// for in progress updates to complete, or the server to be shut down.
+// Repositories are first updated immediately, and then every poll interval.
+// Failed updates are retried with exponential backoff.
+func (s *Server) Run(stop <-chan struct{}) {
+	var wg sync.WaitGroup
+	defer func() {
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+
+		// updates not yet started when the server is shut down never complete
+		select {
+		case <-done:
+		case <-s.shutdown:
+		}
+	}()
+
+	for {
+		for _, name := range s.dueRepositories(time.Now()) {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+
+				s.UpdateRepository(name)
+				s.setUpdating(name, false)
+				s.wakeScheduler()
+			}(name)
+		}
+
+		timer := time.NewTimer(s.nextScheduled(time.Now()))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-s.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// dueRepositories returns repositories whose next update is due, marking them
+// as updating so they're only returned once.
+func (s *Server) dueRepositories(now time.Time) []string {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+
+	var names []string
+	for name, status := range s.status {
+		if !status.updating && !status.NextUpdate.After(now) {
+			status.updating = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// nextScheduled returns the time until the next scheduled update
+func (s *Server) nextScheduled(now time.Time) time.Duration {
+	s.statusMutex.RLock()
+	defer s.statusMutex.RUnlock()
+
+	wait := maxBackoff
+	for _, status := range s.status {
+		if status.updating {
+			continue
+		}
+		if delay := status.NextUpdate.Sub(now); delay < wait {
+			wait = delay
+		}
+	}
+
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+func (s *Server) setUpdating(name string, updating bool) {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+
+	// the repository may have been removed while updating
+	if status, ok := s.status[name]; ok {
+		status.updating = updating
+	}
+}
+
+func (s *Server) setActive(name string, active bool) {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+
+	// the repository may have been removed while updating
+	if status, ok := s.status[name]; ok {
+		status.active = active
+	}
+}
+
+// wakeScheduler notifies the scheduler that the schedule has changed
+func (s *Server) wakeScheduler() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
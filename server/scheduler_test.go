@@ -0,0 +1,89 @@
+package server
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/suite"
+)
+
+type SchedulerTestSuite struct {
+	suite.Suite
+}
+
+func (suite *SchedulerTestSuite) TestBackoff() {
+	tests := []struct {
+		interval time.Duration
+		failures int
+		delay    time.Duration
+	}{
+		{5 * time.Minute, 0, 5 * time.Minute},
+		{5 * time.Minute, 1, 5 * time.Minute},
+		{5 * time.Minute, 2, 10 * time.Minute},
+		{5 * time.Minute, 4, 40 * time.Minute},
+		{5 * time.Minute, 5, time.Hour},
+		{5 * time.Minute, 1000, time.Hour},
+		{2 * time.Hour, 3, 2 * time.Hour},
+	}
+
+	for idx, test := range tests {
+		suite.Equal(test.delay, backoff(test.interval, test.failures), "test index: %v", idx)
+	}
+}
+
+func (suite *SchedulerTestSuite) TestJitter() {
+	r := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 1000; i++ {
+		delay := jitter(r, time.Minute)
+		suite.True(delay >= 54*time.Second && delay <= 66*time.Second, "delay %v out of range", delay)
+	}
+
+	suite.Equal(time.Duration(0), jitter(r, 0))
+}
+
+func (suite *SchedulerTestSuite) TestRun() {
+	navigator := New(log.NewNopLogger(), PollInterval(time.Hour), UpdateConcurrency(2))
+
+	fast := &fakeRepository{url: "https://example.com/fast.git"}
+	slow := &fakeRepository{url: "https://example.com/slow.git"}
+	failing := &fakeRepository{url: "https://example.com/failing.git", err: errors.New("unavailable")}
+
+	addFakeRepository(navigator, "fast", fast)
+	addFakeRepository(navigator, "slow", slow)
+	addFakeRepository(navigator, "failing", failing)
+	navigator.status["fast"].Interval = 10 * time.Millisecond
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	begin := time.Now()
+	go func() {
+		navigator.Run(stop)
+		close(done)
+	}()
+
+	for fast.Updates() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	<-done
+
+	// repositories without an interval use the server's poll interval
+	suite.Equal(1, slow.Updates())
+	status := navigator.repositoryStatus("slow")
+	suite.Equal(syncComplete, status.State)
+	suite.WithinDuration(begin.Add(time.Hour), status.NextUpdate, 7*time.Minute)
+
+	suite.Equal(1, failing.Updates())
+	status = navigator.repositoryStatus("failing")
+	suite.Equal(1, status.Failures)
+	suite.Error(status.LastError)
+	suite.True(status.NextUpdate.After(begin))
+}
+
+func TestSchedulerTestSuite(t *testing.T) {
+	suite.Run(t, new(SchedulerTestSuite))
+}
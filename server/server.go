@@ -1,12 +1,20 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"hash/fnv"
+	"math/rand"
 	"net"
 	"net/http"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -19,20 +27,131 @@ import (
 // Server is the navigator server that handles HTTP requests for charts
 type Server struct {
 	logger            log.Logger
+	dataDir           string
+	pollInterval      time.Duration
+	updateConcurrency int
+	updateSem         chan struct{}
 	indexManager      *repository.IndexManager
 	dependencyManager *repository.DependencyManager
-	repos             map[string]repository.Repository
+	authenticators    []Authenticator
+
+	accessMutex sync.RWMutex
+	accessRules []AccessRule
+
+	signer                *repository.Signer
+	passthroughProvenance bool
+	cache                 *ArchiveCache
+
+	reposMutex sync.RWMutex
+	repos      map[string]repository.Repository
+	configs    map[string]RepositoryConfig
+	apiRepos   map[string]bool
+
+	// replacements are the repositories replacing those whose refs or
+	// directories changed, until their first successful update
+	replacements map[string]replacement
+	// indexes are the configured indexes, served even if no charts are
+	// indexed to them
+	indexes []string
+
+	// reloadMutex is held for writing while the server is reconfigured, and
+	// for reading while repositories are updated. It is never released once
+	// the server has been shut down.
+	reloadMutex  sync.RWMutex
+	shutdownOnce sync.Once
+	shutdown     chan struct{}
+
+	// snapshotMutex serializes writing snapshots, and guards the entity tags
+	// of the last saved snapshot of each index
+	snapshotMutex sync.Mutex
+	snapshotETags map[string]string
+
+	statusMutex sync.RWMutex
+	status      map[string]*repositoryStatus
+	ready       bool
+	rand        *rand.Rand
+
+	// wake signals the scheduler that the update schedule has changed
+	wake chan struct{}
+
+	triggers updateTriggers
+}
+
+// Option sets an optional parameter for the server
+type Option func(*Server)
+
+// DataDir stores git repositories and index snapshots on disk in dir, rather
+// than in memory.
+func DataDir(dir string) Option {
+	return func(s *Server) { s.dataDir = dir }
+}
+
+// PollInterval sets the default interval between repository updates. The
+// default is 5 minutes.
+func PollInterval(interval time.Duration) Option {
+	return func(s *Server) {
+		if interval > 0 {
+			s.pollInterval = interval
+		}
+	}
+}
+
+// UpdateConcurrency sets the maximum number of repositories that are fetched
+// and indexed at the same time. The default is 1.
+func UpdateConcurrency(n int) Option {
+	return func(s *Server) {
+		if n > 0 {
+			s.updateConcurrency = n
+		}
+	}
+}
+
+// Sign generates provenance files for chart packages, signed by signer. By
+// default, provenance files are not generated.
+func Sign(signer *repository.Signer) Option {
+	return func(s *Server) { s.signer = signer }
+}
+
+// PassthroughProvenance serves provenance files committed alongside charts,
+// in preference to generating them.
+func PassthroughProvenance(enabled bool) Option {
+	return func(s *Server) { s.passthroughProvenance = enabled }
+}
+
+// Cache serves chart packages from cache, so that a package is only
+// generated the first time it's requested. By default, packages are generated
+// for every request.
+func Cache(cache *ArchiveCache) Option {
+	return func(s *Server) { s.cache = cache }
 }
 
 // New returns a new server
-func New(logger log.Logger) *Server {
+func New(logger log.Logger, options ...Option) *Server {
 	indexManager := repository.NewIndexManager()
-	return &Server{
+	s := &Server{
 		logger:            logger,
+		pollInterval:      5 * time.Minute,
+		updateConcurrency: 1,
 		indexManager:      indexManager,
 		dependencyManager: repository.NewDependencyManager(logger, indexManager),
 		repos:             make(map[string]repository.Repository),
+		configs:           make(map[string]RepositoryConfig),
+		apiRepos:          make(map[string]bool),
+		replacements:      make(map[string]replacement),
+		snapshotETags:     make(map[string]string),
+		status:            make(map[string]*repositoryStatus),
+		rand:              rand.New(rand.NewSource(time.Now().UnixNano())),
+		wake:              make(chan struct{}, 1),
+		shutdown:          make(chan struct{}),
+		triggers:          updateTriggers{pending: make(map[string]bool)},
+	}
+
+	for _, option := range options {
+		option(s)
 	}
+	s.updateSem = make(chan struct{}, s.updateConcurrency)
+
+	return s
 }
 
 // Logger returns the server logger
@@ -40,6 +159,31 @@ func (s *Server) Logger() log.Logger {
 	return s.logger
 }
 
+// PollInterval returns the default interval between repository updates
+func (s *Server) PollInterval() time.Duration {
+	return s.pollInterval
+}
+
+// Shutdown stops repositories from being updated, waiting for in progress
+// updates to complete, and then saves a final snapshot. If ctx expires before
+// updates complete, its error is returned and updates are stopped once they
+// complete. The server continues to serve charts.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		go func() {
+			s.reloadMutex.Lock()
+			close(s.shutdown)
+		}()
+	})
+
+	select {
+	case <-s.shutdown:
+		return s.SaveSnapshot()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
@@ -48,15 +192,25 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	begin := time.Now()
 
-	code, err := s.serve(w, r)
+	identity, ok := s.authenticate(r)
+
+	var code int
+	if ok {
+		code, err = s.serve(w, r.WithContext(withIdentity(r.Context(), identity)))
+	} else {
+		// ask helm and browsers to retry with basic auth credentials
+		w.Header().Set("WWW-Authenticate", `Basic realm="navigator"`)
+		code, err = http.StatusUnauthorized, errUnauthorized
+	}
+
 	if err == nil {
 		if code != http.StatusOK {
 			w.WriteHeader(code)
 		}
-		level.Info(s.logger).Log("event", "request", "client", host, "method", r.Method, "path", r.URL.Path, "took", time.Since(begin))
+		level.Info(s.logger).Log("event", "request", "client", host, "user", identity.Name, "method", r.Method, "path", r.URL.Path, "took", time.Since(begin))
 	} else {
 		http.Error(w, err.Error(), code)
-		level.Error(s.logger).Log("event", "request", "client", host, "method", r.Method, "path", r.URL.Path, "took", time.Since(begin), "err", err)
+		level.Error(s.logger).Log("event", "request", "client", host, "user", identity.Name, "method", r.Method, "path", r.URL.Path, "took", time.Since(begin), "err", err)
 	}
 }
 
@@ -66,95 +220,373 @@ func (s *Server) serve(w http.ResponseWriter, r *http.Request) (code int, err er
 
 	// serve index.yaml
 	if file == "index.yaml" {
-		index, err := s.indexManager.Get(indexName)
-		if err != nil {
-			return http.StatusNotFound, repository.ErrIndexNotFound
-		}
+		return s.serveIndex(w, r, indexName)
+	}
 
-		w.Header().Set("Content-Type", "text/yaml")
-		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-			w.Header().Set("Content-Encoding", "gzip")
-			w.Header().Del("Content-Length")
+	// serve provenance file
+	if strings.HasSuffix(file, ".tgz.prov") {
+		return s.serveProvenance(w, r, indexName, strings.TrimSuffix(file, ".prov"))
+	}
 
-			if _, err = index.CompressedWriteTo(w); err != nil {
-				return http.StatusInternalServerError, err
-			}
-		} else {
-			if _, err = index.WriteTo(w); err != nil {
-				return http.StatusInternalServerError, err
-			}
-		}
+	// serve packaged chart
+	return s.servePackage(w, r, indexName)
+}
 
-		return http.StatusOK, nil
+// serveIndex serves an index. Clients revalidate the index on every request,
+// and are told it's not modified if their copy has the same entity tag, which
+// is derived from the indexed chart versions.
+func (s *Server) serveIndex(w http.ResponseWriter, r *http.Request, indexName string) (int, error) {
+	if !s.canReadIndex(r, indexName) {
+		return http.StatusForbidden, errForbidden
 	}
 
-	// serve packaged chart
-	chart := strings.SplitN(indexName, "/", 2)
+	index, err := s.indexManager.Get(indexName)
+	if err != nil {
+		return http.StatusNotFound, repository.ErrIndexNotFound
+	}
+
+	serialized, err := index.Serialize()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// the compressed index is a different representation, so has its own
+	// entity tag
+	data, etag := serialized.Data, serialized.ETag
+	compressed := strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
+	if compressed {
+		data, etag = serialized.Compressed, strings.TrimSuffix(etag, `"`)+`-gzip"`
+	}
+
+	w.Header().Set("Vary", "Accept-Encoding")
+	w.Header().Set("Cache-Control", s.cacheControl("no-cache"))
+	setValidators(w, etag, serialized.Generated)
+	if notModified(r, etag, serialized.Generated) {
+		return http.StatusNotModified, nil
+	}
+
+	w.Header().Set("Content-Type", "text/yaml")
+	if compressed {
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if _, err = w.Write(data); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+// servePackage serves a chart package. Package URLs include the commit, so
+// the content of charts without dependencies never changes and they can be
+// cached indefinitely. Charts with dependencies change when a dependency
+// resolves to a newer version, so they're revalidated instead. Indexed
+// packages have the digest of the package as their entity tag and the time of
+// the commit as their modification time, so that requests for packages
+// clients already have are answered without generating them.
+func (s *Server) servePackage(w http.ResponseWriter, r *http.Request, dir string) (int, error) {
+	chart := strings.SplitN(dir, "/", 2)
 	if len(chart) != 2 {
 		return http.StatusNotFound, repository.ErrInvalidPackageName
 	}
 
-	if repo, ok := s.repos[chart[0]]; ok {
-		vcp, err := repo.ChartPackage(chart[1])
+	if !s.canReadPackage(r, r.URL.Path) {
+		return http.StatusForbidden, errForbidden
+	}
+
+	repo, ok := s.repository(chart[0])
+	if !ok {
+		return http.StatusNotFound, repository.ErrRepositoryNotFound
+	}
+
+	var (
+		etag     string
+		modified time.Time
+	)
+	if cv, ok := s.chartVersion(r.URL.Path); ok {
+		modified = cv.Created
+		if cv.Digest != "" {
+			etag = `"` + cv.Digest + `"`
+		}
+	}
+
+	vcp, err := repo.ChartPackage(chart[1])
+	if err == repository.ErrRepositoryNotReady {
+		return http.StatusServiceUnavailable, err
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	cacheControl := "max-age=31536000, immutable"
+	if fingerprint(vcp) != "" {
+		cacheControl = "no-cache"
+	}
+
+	// the caching headers are only set on successful responses, so that errors
+	// aren't cached
+	setHeaders := func(etag string) {
+		w.Header().Set("Cache-Control", s.cacheControl(cacheControl))
+		setValidators(w, etag, modified)
+	}
+
+	if notModified(r, etag, modified) {
+		setHeaders(etag)
+		return http.StatusNotModified, nil
+	}
+
+	if s.cache != nil {
+		data, err := s.cachedChartPackage(chart[0], chart[1], vcp)
 		if err != nil {
 			return http.StatusInternalServerError, err
 		}
 
+		if etag == "" {
+			sum := sha256.Sum256(data)
+			etag = `"` + hex.EncodeToString(sum[:]) + `"`
+		}
+
+		setHeaders(etag)
 		w.Header().Set("Content-Type", "application/x-tar")
-		if err = vcp.Archive(w); err != nil {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if _, err = w.Write(data); err != nil {
 			return http.StatusInternalServerError, err
 		}
 
 		return http.StatusOK, nil
 	}
 
-	return http.StatusNotFound, repository.ErrRepositoryNotFound
+	// the package is streamed, so the headers are only set once it's first
+	// written to, in case archiving it fails before then
+	hw := &headerWriter{ResponseWriter: w, setHeaders: func() {
+		setHeaders(etag)
+		w.Header().Set("Content-Type", "application/x-tar")
+	}}
+	if err = vcp.Archive(hw); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
 }
 
-// AddGitBackedRepository adds a new git backed repository to the server
-func (s *Server) AddGitBackedRepository(url string, directories []string) {
-	hash := fnv.New32()
-	hash.Write([]byte(url))
-	name := fmt.Sprintf("%x", hash.Sum(nil))
+// cachedChartPackage returns a chart package of a repository from the cache,
+// generating it if it's not cached. Packages are cached by repository, commit
+// and chart path, and by the fingerprint of the packages their dependencies
+// resolved to, as the package changes when a dependency resolves to a newer
+// version.
+func (s *Server) cachedChartPackage(repoName, name string, vcp repository.Archiver) ([]byte, error) {
+	key := path.Join(repoName, name)
+	if fingerprint := fingerprint(vcp); fingerprint != "" {
+		key += "@" + fingerprint
+	}
 
-	level.Info(s.logger).Log("event", "add-repository", "repository", url, "directories", strings.Join(directories, ","))
+	return s.cache.Get(key, func() ([]byte, error) {
+		var buf bytes.Buffer
+		if err := vcp.Archive(&buf); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	})
+}
 
-	if len(directories) == 0 {
-		directories = append(directories, "")
+// fingerprint returns the fingerprint of the packages a chart package's
+// dependencies resolved to, or an empty string if it has none
+func fingerprint(vcp repository.Archiver) string {
+	if f, ok := vcp.(repository.Fingerprinter); ok {
+		return f.Fingerprint()
 	}
+	return ""
+}
 
-	var indexDirectories []repository.IndexDirectory
-	for _, directory := range directories {
-		di := strings.SplitN(directory, "@", 2)
+// AddGitBackedRepository adds a new git backed repository to the server. Refs
+// and directories can be mapped to a named index using the format
+// <selector>@<index>. The repository is polled for updates at interval, or the
+// server's poll interval if zero.
+func (s *Server) AddGitBackedRepository(url string, credentials repository.Credentials, interval time.Duration, refs, directories []string) {
+	s.addRepository(RepositoryConfig{
+		URL:         url,
+		Credentials: credentials,
+		Interval:    interval,
+		Refs:        refs,
+		Directories: directories,
+	})
+}
 
-		indexName := "default"
-		if len(di) == 2 {
-			indexName = di[1]
-		}
+func (s *Server) addRepository(config RepositoryConfig) {
+	name := repositoryName(config.URL)
+
+	level.Info(s.logger).Log("event", "add-repository", "repository", config.URL, "auth", config.Credentials.String(), "interval", config.Interval, "refs", strings.Join(config.Refs, ","), "directories", strings.Join(config.Directories, ","))
 
+	indexRefs, indexDirectories := config.indexMappings()
+	for _, indexName := range config.indexNames() {
 		s.indexManager.Create(indexName)
-		indexDirectories = append(indexDirectories, repository.IndexDirectory{Name: di[0], IndexName: indexName})
 	}
 
-	s.repos[name] = repository.NewGitBackedRepository(s.logger, s.dependencyManager, name, url, indexDirectories)
+	s.setStatus(name, &repositoryStatus{URL: config.URL, State: syncPending, Interval: config.Interval})
+
+	s.reposMutex.Lock()
+	s.repos[name] = repository.NewGitBackedRepository(s.logger, s.dependencyManager, name, config.URL, s.repositoryDir(name), config.Credentials, indexRefs, indexDirectories)
+	s.configs[name] = config
+	s.reposMutex.Unlock()
+
+	s.wakeScheduler()
+}
+
+// repositoryName returns the name of a repository, used in chart package
+// URLs, derived from its URL
+func repositoryName(url string) string {
+	hash := fnv.New32()
+	hash.Write([]byte(url))
+	return fmt.Sprintf("%x", hash.Sum(nil))
 }
 
-// UpdateRepositories fetches changes from the source repositories and indexes new updates
+// repositoryDir returns the directory a repository is cloned to, or an empty
+// string if repositories are stored in memory
+func (s *Server) repositoryDir(name string) string {
+	if s.dataDir == "" {
+		return ""
+	}
+	return filepath.Join(s.dataDir, "repositories", name)
+}
+
+// UpdateRepositories fetches changes from the source repositories and indexes
+// new updates. Repositories are updated concurrently, up to the server's update
+// concurrency. Every repository is updated, even if others fail, and the
+// failures are returned together as UpdateErrors.
 func (s *Server) UpdateRepositories() error {
-	for _, repo := range s.repos {
-		err := repo.Update()
-		if err != nil {
-			return err
-		}
+	var (
+		wg        sync.WaitGroup
+		errs      = make(UpdateErrors)
+		errsMutex sync.Mutex
+	)
+
+	for name, repo := range s.repositories() {
+		wg.Add(1)
+
+		go func(name string, repo repository.Repository) {
+			defer wg.Done()
+
+			if err := s.updateRepository(name, repo); err != nil {
+				errsMutex.Lock()
+				errs[repo.URL()] = err
+				errsMutex.Unlock()
+			}
+		}(name, repo)
+	}
+
+	wg.Wait()
+
+	s.updateMetrics()
+
+	if err := s.SaveSnapshot(); err != nil {
+		return err
 	}
 
-	// update prometheus metrics for indexed charts
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// UpdateRepository fetches changes from a single repository and indexes new
+// updates. Only the repository's state, and the indexes that changed, are
+// saved to the data directory.
+func (s *Server) UpdateRepository(name string) error {
+	repo, ok := s.repository(name)
+	if !ok {
+		return repository.ErrRepositoryNotFound
+	}
+
+	err := s.updateRepository(name, repo)
+
+	s.updateMetrics()
+
+	if serr := s.saveRepositorySnapshot(name); serr != nil && err == nil {
+		err = serr
+	}
+
+	return err
+}
+
+// updateRepository updates a repository, waiting for an update slot so that no
+// more than the server's update concurrency are updated at the same time,
+// however the update was started.
+func (s *Server) updateRepository(name string, repo repository.Repository) error {
+	// the read lock is only taken once the update can start, so that a reload
+	// or shutdown waits for updates in progress, but not those queued
+	s.updateSem <- struct{}{}
+	defer func() { <-s.updateSem }()
+
+	s.reloadMutex.RLock()
+	defer s.reloadMutex.RUnlock()
+
+	// skip repositories that have since been removed or replaced by a reload
+	if current, ok := s.repository(name); !ok || current != repo {
+		return nil
+	}
+
+	// a repository being replaced is updated by its replacement instead
+	pending, replacing := s.replacement(name)
+	if replacing {
+		repo = pending.repo
+	}
+
+	s.setActive(name, true)
+	err := repo.Update()
+	s.setActive(name, false)
+
+	if err != nil {
+		level.Error(s.logger).Log("event", "update", "repository", repo.URL(), "err", err)
+	} else if replacing {
+		s.replaceRepository(name, pending)
+	}
+	s.recordUpdate(name, time.Now(), err)
+
+	return err
+}
+
+// repository returns a repository by name
+func (s *Server) repository(name string) (repository.Repository, bool) {
+	s.reposMutex.RLock()
+	defer s.reposMutex.RUnlock()
+
+	repo, ok := s.repos[name]
+	return repo, ok
+}
+
+// replacement returns the pending replacement of a repository by name
+func (s *Server) replacement(name string) (replacement, bool) {
+	s.reposMutex.RLock()
+	defer s.reposMutex.RUnlock()
+
+	pending, ok := s.replacements[name]
+	return pending, ok
+}
+
+// repositories returns a copy of the repositories by name, so that they can
+// be iterated over while repositories are added.
+func (s *Server) repositories() map[string]repository.Repository {
+	s.reposMutex.RLock()
+	defer s.reposMutex.RUnlock()
+
+	repos := make(map[string]repository.Repository, len(s.repos))
+	for name, repo := range s.repos {
+		repos[name] = repo
+	}
+	return repos
+}
+
+// updateMetrics updates prometheus metrics for indexed charts
+func (s *Server) updateMetrics() {
 	for _, indexName := range s.indexManager.Names() {
-		index, _ := s.indexManager.Get(indexName)
+		// the index may have been removed by a concurrent reload
+		index, err := s.indexManager.Get(indexName)
+		if err != nil {
+			continue
+		}
 		charts, versions := index.Count()
 
 		chartTotalGauge.With(prometheus.Labels{"index": indexName}).Set(float64(charts))
 		chartVersionTotalGauge.With(prometheus.Labels{"index": indexName}).Set(float64(versions))
 	}
-	return nil
 }
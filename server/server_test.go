@@ -1,13 +1,20 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/stretchr/testify/suite"
+
+	"github.com/saracen/navigator/repository"
 )
 
 type ServerTestSuite struct {
@@ -20,8 +27,8 @@ func (suite *ServerTestSuite) SetupSuite() {
 	suite.navigator = New(log.NewNopLogger())
 	suite.NotNil(suite.navigator.Logger())
 
-	suite.navigator.AddGitBackedRepository("../.git", []string{})
-	suite.navigator.AddGitBackedRepository("../.git", []string{"repository/testdata/charts@test"})
+	suite.navigator.AddGitBackedRepository("../.git", repository.Credentials{}, 0, nil, []string{})
+	suite.navigator.AddGitBackedRepository("../.git", repository.Credentials{}, 0, nil, []string{"repository/testdata/charts@test"})
 
 	suite.ts = httptest.NewServer(MetricMiddleware(suite.navigator))
 }
@@ -83,6 +90,121 @@ func (suite *ServerTestSuite) TestServeHTTP() {
 	}
 }
 
+func (suite *ServerTestSuite) TestConcurrentMutation() {
+	navigator := New(log.NewNopLogger(), UpdateConcurrency(2))
+	navigator.AddGitBackedRepository("../.git", repository.Credentials{}, 0, nil, []string{"repository/testdata/charts@concurrent"})
+	if !suite.NoError(navigator.UpdateRepositories()) {
+		return
+	}
+
+	index, err := navigator.indexManager.Get("concurrent")
+	if !suite.NoError(err) {
+		return
+	}
+	chart, err := index.Get("mychart", "0.1.0")
+	if !suite.NoError(err) {
+		return
+	}
+
+	ts := httptest.NewServer(navigator)
+	defer ts.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+
+		// add repositories and indexes while serving
+		go func(i int) {
+			defer wg.Done()
+			navigator.AddGitBackedRepository("../"+strings.Repeat("./", i+1)+".git", repository.Credentials{}, 0, nil, []string{fmt.Sprintf("repository/testdata/charts@concurrent-%d", i)})
+		}(i)
+
+		go func() {
+			defer wg.Done()
+			navigator.UpdateRepositories()
+		}()
+
+		go func() {
+			defer wg.Done()
+			for _, path := range []string{"/concurrent/index.yaml", "/" + chart.URLs[0]} {
+				resp, err := http.Get(ts.URL + path)
+				if suite.NoError(err) {
+					suite.Equal(http.StatusOK, resp.StatusCode, path)
+					ioutil.ReadAll(resp.Body)
+					resp.Body.Close()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	suite.Len(navigator.repositories(), 5)
+}
+
+func (suite *ServerTestSuite) TestShutdown() {
+	navigator := New(log.NewNopLogger())
+
+	repo := &fakeRepository{url: "https://example.com/org/charts.git", started: make(chan struct{}), release: make(chan struct{})}
+	addFakeRepository(navigator, "charts", repo)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		navigator.Run(stop)
+		close(done)
+	}()
+	<-repo.started
+	close(stop)
+
+	// shutdown waits for the in progress update
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	suite.Equal(context.DeadlineExceeded, navigator.Shutdown(ctx))
+
+	repo.release <- struct{}{}
+	suite.NoError(navigator.Shutdown(context.Background()))
+	<-done
+
+	// no further updates are started
+	navigator.TriggerUpdate("charts")
+	time.Sleep(10 * time.Millisecond)
+	suite.Equal(1, repo.Updates())
+}
+
+func (suite *ServerTestSuite) TestQueuedUpdatesDontBlockReload() {
+	navigator := New(log.NewNopLogger(), UpdateConcurrency(1))
+
+	repo := &fakeRepository{url: "https://example.com/org/charts.git"}
+	addFakeRepository(navigator, "charts", repo)
+
+	// every update slot is taken, so the update is queued
+	navigator.updateSem <- struct{}{}
+	done := make(chan struct{})
+	go func() {
+		navigator.updateRepository("charts", repo)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	locked := make(chan struct{})
+	go func() {
+		navigator.reloadMutex.Lock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		suite.FailNow("reload waited for a queued update")
+	}
+
+	// the queued update starts once the reload has completed
+	navigator.reloadMutex.Unlock()
+	<-navigator.updateSem
+	<-done
+	suite.Equal(1, repo.Updates())
+}
+
 func TestServerTestSuite(t *testing.T) {
 	suite.Run(t, new(ServerTestSuite))
 }
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/saracen/navigator/repository"
+)
+
+// SaveSnapshot writes the indexes, and the indexing state of every repository,
+// to the data directory. Repositories being updated are skipped, rather than
+// waited for, as their state is saved once their update completes. Snapshots
+// are only taken when the server has a data directory.
+func (s *Server) SaveSnapshot() error {
+	if s.dataDir == "" {
+		return nil
+	}
+
+	states := make(map[string][]byte)
+	for name, repo := range s.repositories() {
+		if s.repositoryStatus(name).active {
+			continue
+		}
+
+		state, err := snapshotState(repo)
+		if err != nil {
+			return err
+		}
+		if state != nil {
+			states[name] = state
+		}
+	}
+
+	return s.writeSnapshot(states)
+}
+
+// saveRepositorySnapshot writes the indexing state of a repository, and the
+// indexes that have changed since they were last saved, to the data
+// directory.
+func (s *Server) saveRepositorySnapshot(name string) error {
+	if s.dataDir == "" {
+		return nil
+	}
+
+	repo, ok := s.repository(name)
+	if !ok {
+		return nil
+	}
+
+	state, err := snapshotState(repo)
+	if err != nil {
+		return err
+	}
+
+	states := make(map[string][]byte)
+	if state != nil {
+		states[name] = state
+	}
+	return s.writeSnapshot(states)
+}
+
+// snapshotState returns the indexing state of a repository, or nil if the
+// repository has no state.
+func snapshotState(repo repository.Repository) ([]byte, error) {
+	snapshotter, ok := repo.(repository.Snapshotter)
+	if !ok {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	if err := snapshotter.Snapshot(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeSnapshot writes the indexes that have changed since they were last
+// saved, and then the repository states, which must have been taken before.
+// This way the indexes on disk always contain at least the chart versions of
+// the commits the states cover; an update completing in between only adds
+// chart versions whose commits are walked again once restored. Snapshots are
+// written one at a time, so that an index is never replaced by an older one.
+func (s *Server) writeSnapshot(states map[string][]byte) error {
+	s.snapshotMutex.Lock()
+	defer s.snapshotMutex.Unlock()
+
+	for _, indexName := range s.indexManager.Names() {
+		index, err := s.indexManager.Get(indexName)
+		if err != nil {
+			// the index has been removed by a concurrent reload
+			continue
+		}
+
+		serialized, err := index.Serialize()
+		if err != nil {
+			return err
+		}
+		if s.snapshotETags[indexName] == serialized.ETag {
+			continue
+		}
+
+		err = writeSnapshotFile(s.indexSnapshotPath(indexName), func(w io.Writer) (int64, error) {
+			n, err := w.Write(serialized.Data)
+			return int64(n), err
+		})
+		if err != nil {
+			return err
+		}
+		s.snapshotETags[indexName] = serialized.ETag
+	}
+
+	for name, state := range states {
+		// the repository may have been removed by a concurrent reload
+		if _, ok := s.repository(name); !ok {
+			continue
+		}
+
+		err := writeSnapshotFile(s.repositorySnapshotPath(name), bytes.NewReader(state).WriteTo)
+		if err != nil {
+			return err
+		}
+	}
+
+	level.Debug(s.logger).Log("event", "snapshot", "dir", s.dataDir, "repositories", len(states))
+
+	return nil
+}
+
+// RestoreSnapshot restores the repositories added with the admin API, and
+// loads previously snapshotted indexes and repository indexing state from the
+// data directory, so that charts can be served before repositories have been
+// updated. Snapshots of indexes and repositories that are no longer configured
+// are ignored, and the chart versions indexed from repositories that are no
+// longer configured, or whose state no longer matches their configuration,
+// are removed from the restored indexes.
+func (s *Server) RestoreSnapshot() error {
+	if s.dataDir == "" {
+		return nil
+	}
+
+	if err := s.restoreAPIRepositories(); err != nil {
+		return err
+	}
+
+	for _, indexName := range s.indexManager.Names() {
+		data, err := ioutil.ReadFile(s.indexSnapshotPath(indexName))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		index, err := s.indexManager.Get(indexName)
+		if err != nil {
+			return err
+		}
+		if err = index.Unmarshal(data); err != nil {
+			return err
+		}
+	}
+
+	// chart versions of repositories that aren't configured can't be served,
+	// and those of repositories whose state is ignored may no longer be
+	// indexed by them
+	repos := s.repositories()
+	stale := make(map[string]bool)
+	for _, indexName := range s.indexManager.Names() {
+		index, err := s.indexManager.Get(indexName)
+		if err != nil {
+			return err
+		}
+		for _, name := range index.RepositoryNames() {
+			if _, ok := repos[name]; !ok {
+				stale[name] = true
+			}
+		}
+	}
+
+	for name, repo := range repos {
+		snapshotter, ok := repo.(repository.Snapshotter)
+		if !ok {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(s.repositorySnapshotPath(name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		err = snapshotter.Restore(bytes.NewReader(data))
+		if err == repository.ErrStateMismatch {
+			level.Info(s.logger).Log("event", "restore", "repository", repo.URL(), "err", err)
+			stale[name] = true
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		s.setSyncState(name, syncRestored)
+	}
+
+	for _, indexName := range s.indexManager.Names() {
+		index, err := s.indexManager.Get(indexName)
+		if err != nil {
+			return err
+		}
+		for name := range stale {
+			index.RemoveRepository(name)
+		}
+	}
+
+	s.updateMetrics()
+
+	return nil
+}
+
+func (s *Server) indexSnapshotPath(indexName string) string {
+	return filepath.Join(s.dataDir, "indexes", url.PathEscape(indexName)+".yaml")
+}
+
+func (s *Server) repositorySnapshotPath(name string) string {
+	return filepath.Join(s.dataDir, "state", name+".json")
+}
+
+// writeSnapshotFile atomically replaces a snapshot file, so that a crash
+// mid-write never leaves a partial snapshot behind.
+func writeSnapshotFile(filename string, writeTo func(io.Writer) (int64, error)) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = writeTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filename)
+}
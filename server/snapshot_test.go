@@ -0,0 +1,275 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/suite"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+
+	"github.com/saracen/navigator/repository"
+)
+
+// snapshotRepository is a fake repository whose indexing state is the number
+// of updates indexed, each of which adds a chart version. If updateOnSnapshot
+// is set, an update completes while the snapshot waits for it. If mismatch is
+// set, restored state is ignored.
+type snapshotRepository struct {
+	*fakeRepository
+	index            *repository.Index
+	heads            int
+	updateOnSnapshot bool
+	mismatch         bool
+
+	// updateMutex is held while updating, and waited for by snapshots
+	updateMutex sync.Mutex
+}
+
+func (r *snapshotRepository) Update() error {
+	r.updateMutex.Lock()
+	defer r.updateMutex.Unlock()
+
+	r.fakeRepository.Update()
+	r.heads++
+	r.index.Add(&chart.Metadata{Name: r.Name(), Version: fmt.Sprintf("0.%d.0", r.heads)}, []string{fmt.Sprintf("/%s/%d/%s-0.%d.0.tgz", r.Name(), r.heads, r.Name(), r.heads)}, time.Now())
+	return nil
+}
+
+func (r *snapshotRepository) Snapshot(w io.Writer) error {
+	if r.updateOnSnapshot {
+		r.Update()
+	}
+
+	r.updateMutex.Lock()
+	defer r.updateMutex.Unlock()
+
+	_, err := fmt.Fprint(w, r.heads)
+	return err
+}
+
+func (r *snapshotRepository) Restore(rd io.Reader) error {
+	if r.mismatch {
+		return repository.ErrStateMismatch
+	}
+	_, err := fmt.Fscan(rd, &r.heads)
+	return err
+}
+
+type SnapshotTestSuite struct {
+	suite.Suite
+	dataDir string
+}
+
+func (suite *SnapshotTestSuite) SetupTest() {
+	var err error
+	suite.dataDir, err = ioutil.TempDir("", "navigator-snapshot")
+	suite.Require().NoError(err)
+}
+
+func (suite *SnapshotTestSuite) TearDownTest() {
+	os.RemoveAll(suite.dataDir)
+}
+
+func (suite *SnapshotTestSuite) newServer() *Server {
+	navigator := New(log.NewNopLogger(), DataDir(suite.dataDir))
+	navigator.AddGitBackedRepository("../.git", repository.Credentials{}, 0, nil, []string{"repository/testdata/charts@test"})
+
+	return navigator
+}
+
+func (suite *SnapshotTestSuite) TestSaveAndRestore() {
+	if !suite.NoError(suite.newServer().UpdateRepositories()) {
+		return
+	}
+
+	// a new server restores the indexes without updating its repositories
+	navigator := suite.newServer()
+	if !suite.NoError(navigator.RestoreSnapshot()) {
+		return
+	}
+
+	index, err := navigator.indexManager.Get("test")
+	if !suite.NoError(err) {
+		return
+	}
+
+	chart, err := index.Get("mychart", "0.1.0")
+	if !suite.NoError(err) {
+		return
+	}
+
+	ts := httptest.NewServer(navigator)
+	defer ts.Close()
+
+	ready := httptest.NewRecorder()
+	navigator.ServeReady(ready, httptest.NewRequest("GET", "/ready", nil))
+	suite.Equal(http.StatusOK, ready.Code)
+
+	for _, path := range []string{"/test/index.yaml", "/" + chart.URLs[0]} {
+		resp, err := http.Get(ts.URL + path)
+		if suite.NoError(err, path) {
+			suite.Equal(http.StatusOK, resp.StatusCode, path)
+			suite.NoError(resp.Body.Close())
+		}
+	}
+
+	suite.NoError(navigator.UpdateRepositories())
+}
+
+func (suite *SnapshotTestSuite) TestRestoreWithoutSnapshot() {
+	navigator := suite.newServer()
+	suite.NoError(navigator.RestoreSnapshot())
+
+	index, err := navigator.indexManager.Get("test")
+	if suite.NoError(err) {
+		charts, _ := index.Count()
+		suite.Equal(0, charts)
+	}
+
+	// packages can't be served until the repository has been cloned
+	ts := httptest.NewServer(navigator)
+	defer ts.Close()
+
+	for name := range navigator.repos {
+		resp, err := http.Get(ts.URL + "/" + name + "/0000000000000000000000000000000000000000/repository/testdata/charts/mychart/mychart-0.1.0.tgz")
+		if suite.NoError(err) {
+			suite.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+			suite.NoError(resp.Body.Close())
+		}
+	}
+}
+
+// addSnapshotRepository registers a snapshot repository, indexed to the test
+// index, with the server
+func addSnapshotRepository(s *Server, name string) *snapshotRepository {
+	repo := &snapshotRepository{
+		fakeRepository: &fakeRepository{url: name},
+		index:          s.indexManager.Create("test"),
+	}
+	s.setStatus(name, &repositoryStatus{URL: repo.URL(), State: syncPending})
+	s.repos[name] = repo
+
+	return repo
+}
+
+func (suite *SnapshotTestSuite) TestConcurrentUpdate() {
+	newServer := func() (*Server, *snapshotRepository) {
+		navigator := New(log.NewNopLogger(), DataDir(suite.dataDir))
+		return navigator, addSnapshotRepository(navigator, "repo")
+	}
+
+	navigator, repo := newServer()
+	suite.NoError(repo.Update())
+
+	repo.updateOnSnapshot = true
+	suite.Require().NoError(navigator.SaveSnapshot())
+
+	// every chart version of the updates the restored state covers is restored
+	navigator, repo = newServer()
+	suite.Require().NoError(navigator.RestoreSnapshot())
+	suite.Equal(2, repo.heads)
+
+	for _, version := range []string{"0.1.0", "0.2.0"} {
+		_, err := repo.index.Get("repo", version)
+		suite.NoError(err, version)
+	}
+}
+
+func (suite *SnapshotTestSuite) TestRestoreStale() {
+	navigator := New(log.NewNopLogger(), DataDir(suite.dataDir))
+	for _, name := range []string{"kept", "removed", "changed"} {
+		suite.Require().NoError(addSnapshotRepository(navigator, name).Update())
+	}
+	suite.Require().NoError(navigator.SaveSnapshot())
+
+	// the removed repository is no longer configured, and the changed
+	// repository's state no longer matches its configuration
+	navigator = New(log.NewNopLogger(), DataDir(suite.dataDir))
+	kept := addSnapshotRepository(navigator, "kept")
+	changed := addSnapshotRepository(navigator, "changed")
+	changed.mismatch = true
+	suite.Require().NoError(navigator.RestoreSnapshot())
+
+	index, err := navigator.indexManager.Get("test")
+	suite.Require().NoError(err)
+	suite.Equal([]string{"kept"}, index.RepositoryNames())
+
+	suite.Equal(1, kept.heads)
+	suite.Equal(syncRestored, navigator.repositoryStatus("kept").State)
+	suite.Equal(0, changed.heads)
+	suite.Equal(syncPending, navigator.repositoryStatus("changed").State)
+}
+
+func (suite *SnapshotTestSuite) TestSaveUpdatedRepository() {
+	navigator := New(log.NewNopLogger(), DataDir(suite.dataDir))
+	addSnapshotRepository(navigator, "updated")
+	addSnapshotRepository(navigator, "other")
+	navigator.indexManager.Create("unchanged")
+
+	// only the updated repository's state and the indexes that changed are
+	// written
+	suite.Require().NoError(navigator.UpdateRepository("updated"))
+	suite.FileExists(navigator.repositorySnapshotPath("updated"))
+	suite.FileExists(navigator.indexSnapshotPath("test"))
+	suite.FileExists(navigator.indexSnapshotPath("unchanged"))
+	suite.noFile(navigator.repositorySnapshotPath("other"))
+
+	suite.Require().NoError(os.Remove(navigator.indexSnapshotPath("unchanged")))
+	suite.Require().NoError(navigator.UpdateRepository("other"))
+	suite.FileExists(navigator.repositorySnapshotPath("other"))
+	suite.noFile(navigator.indexSnapshotPath("unchanged"))
+
+	// indexes are written again once removed and recreated
+	navigator.removeIndex("test")
+	navigator.indexManager.Create("test")
+	suite.Require().NoError(navigator.SaveSnapshot())
+	suite.FileExists(navigator.indexSnapshotPath("test"))
+}
+
+func (suite *SnapshotTestSuite) TestSaveDuringUpdate() {
+	navigator := New(log.NewNopLogger(), DataDir(suite.dataDir))
+	addSnapshotRepository(navigator, "idle")
+	busy := addSnapshotRepository(navigator, "busy")
+	busy.started = make(chan struct{})
+	busy.release = make(chan struct{})
+
+	done := make(chan error)
+	go func() { done <- navigator.UpdateRepository("busy") }()
+	<-busy.started
+
+	// snapshots don't wait for repositories being updated
+	saved := make(chan error)
+	go func() { saved <- navigator.SaveSnapshot() }()
+	select {
+	case err := <-saved:
+		suite.NoError(err)
+	case <-time.After(5 * time.Second):
+		suite.FailNow("snapshot waited for the update")
+	}
+	suite.FileExists(navigator.repositorySnapshotPath("idle"))
+	suite.noFile(navigator.repositorySnapshotPath("busy"))
+
+	// its state is saved once its update completes
+	close(busy.release)
+	suite.NoError(<-done)
+	suite.FileExists(navigator.repositorySnapshotPath("busy"))
+}
+
+// noFile asserts that a file doesn't exist
+func (suite *SnapshotTestSuite) noFile(filename string) {
+	_, err := os.Stat(filename)
+	suite.True(os.IsNotExist(err), filepath.Base(filename))
+}
+
+func TestSnapshotTestSuite(t *testing.T) {
+	suite.Run(t, new(SnapshotTestSuite))
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/saracen/navigator/repository"
+)
+
+// UpdateErrors are the errors of the repositories that failed to update, by
+// repository URL.
+type UpdateErrors map[string]error
+
+func (e UpdateErrors) Error() string {
+	urls := make([]string, 0, len(e))
+	for url := range e {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+
+	msgs := make([]string, 0, len(urls))
+	for _, url := range urls {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", url, e[url]))
+	}
+
+	return fmt.Sprintf("%d repositories failed to update: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// syncState is the initial synchronization state of a repository
+type syncState string
+
+const (
+	// syncPending repositories have neither been updated or restored
+	syncPending syncState = "pending"
+	// syncRestored repositories are serving charts restored from a snapshot
+	syncRestored syncState = "restored"
+	// syncComplete repositories have been successfully updated at least once
+	syncComplete syncState = "synced"
+)
+
+// repositoryStatus is the update status of a repository
+type repositoryStatus struct {
+	URL           string
+	State         syncState
+	LastSuccess   time.Time
+	LastError     error
+	LastErrorTime time.Time
+
+	// Interval is the repository's poll interval, or zero for the server's
+	// poll interval. Failures is the number of consecutive failed updates,
+	// and NextUpdate the time the repository's next update is scheduled for.
+	Interval   time.Duration
+	Failures   int
+	NextUpdate time.Time
+
+	// updating is set while an update is scheduled or in progress, and active
+	// only while it's in progress
+	updating bool
+	active   bool
+}
+
+func (s *Server) setStatus(name string, status *repositoryStatus) {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+
+	s.status[name] = status
+}
+
+func (s *Server) setSyncState(name string, state syncState) {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+
+	// the repository may have been removed while it was updated
+	if status, ok := s.status[name]; ok {
+		status.State = state
+	}
+
+	if s.synchronized() {
+		s.ready = true
+	}
+}
+
+// synchronized returns whether every repository has completed its initial
+// synchronization, or has been restored from a snapshot. The status mutex must
+// be held.
+func (s *Server) synchronized() bool {
+	for _, status := range s.status {
+		if status.State == syncPending {
+			return false
+		}
+	}
+	return true
+}
+
+// recordUpdate records the outcome of a repository update and schedules the
+// repository's next update. The last error is kept after a successful update,
+// so it can be compared with the last success.
+func (s *Server) recordUpdate(name string, when time.Time, err error) {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+
+	// the repository may have been removed while it was updated
+	status, ok := s.status[name]
+	if !ok {
+		return
+	}
+
+	if err != nil {
+		status.LastError = err
+		status.LastErrorTime = when
+		status.Failures++
+	} else {
+		status.State = syncComplete
+		status.LastSuccess = when
+		status.Failures = 0
+	}
+
+	interval := status.Interval
+	if interval == 0 {
+		interval = s.pollInterval
+	}
+	status.NextUpdate = when.Add(jitter(s.rand, backoff(interval, status.Failures)))
+
+	nextUpdateGauge.With(prometheus.Labels{"repository": status.URL}).Set(float64(status.NextUpdate.Unix()))
+	level.Debug(s.logger).Log("event", "scheduled", "repository", status.URL, "next", status.NextUpdate)
+
+	if s.synchronized() {
+		s.ready = true
+	}
+}
+
+// setInterval changes a repository's poll interval. Its next update is
+// brought forward if the new interval has already elapsed.
+func (s *Server) setInterval(name string, interval time.Duration) {
+	s.statusMutex.Lock()
+	status, ok := s.status[name]
+	if !ok || status.Interval == interval {
+		s.statusMutex.Unlock()
+		return
+	}
+
+	status.Interval = interval
+	if interval == 0 {
+		interval = s.pollInterval
+	}
+	if next := time.Now().Add(interval); status.NextUpdate.After(next) {
+		status.NextUpdate = next
+		nextUpdateGauge.With(prometheus.Labels{"repository": status.URL}).Set(float64(status.NextUpdate.Unix()))
+	}
+	s.statusMutex.Unlock()
+
+	s.wakeScheduler()
+}
+
+// scheduleUpdate schedules a repository's next update for now
+func (s *Server) scheduleUpdate(name string) {
+	s.statusMutex.Lock()
+	if status, ok := s.status[name]; ok {
+		status.NextUpdate = time.Now()
+		nextUpdateGauge.With(prometheus.Labels{"repository": status.URL}).Set(float64(status.NextUpdate.Unix()))
+	}
+	s.statusMutex.Unlock()
+
+	s.wakeScheduler()
+}
+
+// repositoryStatus returns a copy of a repository's update status, which is
+// empty if the repository has been removed
+func (s *Server) repositoryStatus(name string) repositoryStatus {
+	s.statusMutex.RLock()
+	defer s.statusMutex.RUnlock()
+
+	if status, ok := s.status[name]; ok {
+		return *status
+	}
+	return repositoryStatus{}
+}
+
+// ServeReady reports whether every repository has completed its initial
+// synchronization, or has been restored from a snapshot, and so is serving
+// valid charts. Once ready, the server remains ready while repositories added
+// by a reconfiguration are synchronized, as existing charts continue to be
+// served. The sync state of each repository is returned by its URL.
+func (s *Server) ServeReady(w http.ResponseWriter, r *http.Request) {
+	s.statusMutex.RLock()
+	ready := s.ready || s.synchronized()
+	states := make(map[string]syncState, len(s.status))
+	for _, status := range s.status {
+		states[status.URL] = status.State
+	}
+	s.statusMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		Ready        bool                 `json:"ready"`
+		Repositories map[string]syncState `json:"repositories"`
+	}{ready, states})
+}
+
+// repositoryStatusResponse describes a repository and its update status
+type repositoryStatusResponse struct {
+	repositoryResponse
+
+	Heads             map[string]string `json:"heads,omitempty"`
+	LastSuccess       *time.Time        `json:"lastSuccess,omitempty"`
+	LastError         string            `json:"lastError,omitempty"`
+	LastErrorTime     *time.Time        `json:"lastErrorTime,omitempty"`
+	LastFetchDuration string            `json:"lastFetchDuration,omitempty"`
+	LastIndexDuration string            `json:"lastIndexDuration,omitempty"`
+	Failures          int               `json:"failures"`
+	NextUpdate        *time.Time        `json:"nextUpdate,omitempty"`
+}
+
+// indexStatusResponse describes an index
+type indexStatusResponse struct {
+	Name     string `json:"name"`
+	Charts   int    `json:"charts"`
+	Versions int    `json:"versions"`
+}
+
+// ServeStatus describes every repository, with its update status and indexed
+// heads, and every index, with the number of charts and chart versions it
+// contains. Requests are authenticated in the same way as requests for chart
+// indexes, and only the indexes the client can read, and the repositories
+// indexed into them, are described.
+func (s *Server) ServeStatus(w http.ResponseWriter, r *http.Request) {
+	identity, ok := s.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="navigator"`)
+		http.Error(w, errUnauthorized.Error(), http.StatusUnauthorized)
+		return
+	}
+	r = r.WithContext(withIdentity(r.Context(), identity))
+
+	var response struct {
+		Repositories []repositoryStatusResponse `json:"repositories"`
+		Indexes      []indexStatusResponse      `json:"indexes"`
+	}
+
+	response.Repositories = []repositoryStatusResponse{}
+	for _, repo := range s.repositoryResponses() {
+		if !s.canReadRepository(r, repo) {
+			continue
+		}
+		response.Repositories = append(response.Repositories, s.repositoryStatusResponse(repo))
+	}
+
+	response.Indexes = []indexStatusResponse{}
+	for _, indexName := range s.indexManager.Names() {
+		if !s.canReadIndex(r, indexName) {
+			continue
+		}
+
+		index, err := s.indexManager.Get(indexName)
+		if err != nil {
+			continue
+		}
+
+		charts, versions := index.Count()
+		response.Indexes = append(response.Indexes, indexStatusResponse{Name: indexName, Charts: charts, Versions: versions})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) repositoryStatusResponse(repo repositoryResponse) repositoryStatusResponse {
+	response := repositoryStatusResponse{repositoryResponse: repo}
+
+	s.statusMutex.RLock()
+	if status, ok := s.status[repo.Name]; ok {
+		response.LastSuccess = optionalTime(status.LastSuccess)
+		response.LastErrorTime = optionalTime(status.LastErrorTime)
+		response.Failures = status.Failures
+		if status.LastError != nil {
+			response.LastError = status.LastError.Error()
+		}
+		if !status.updating {
+			response.NextUpdate = optionalTime(status.NextUpdate)
+		}
+	}
+	s.statusMutex.RUnlock()
+
+	if r, ok := s.repository(repo.Name); ok {
+		if reporter, ok := r.(repository.StatsReporter); ok {
+			stats := reporter.Stats()
+
+			response.Heads = stats.Heads
+			if stats.FetchDuration > 0 {
+				response.LastFetchDuration = stats.FetchDuration.String()
+				response.LastIndexDuration = stats.IndexDuration.String()
+			}
+		}
+	}
+
+	return response
+}
+
+// optionalTime returns nil for the zero time, so that it's omitted from JSON
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/saracen/navigator/repository"
+)
+
+type StatusTestSuite struct {
+	suite.Suite
+}
+
+func (suite *StatusTestSuite) TestUpdateFailureIsolation() {
+	navigator := New(log.NewNopLogger())
+
+	missing := filepath.Join("testdata", "does-not-exist")
+	navigator.AddGitBackedRepository(missing, repository.Credentials{}, 0, nil, []string{"repository/testdata/charts@broken"})
+	navigator.AddGitBackedRepository("../.git", repository.Credentials{}, 0, nil, []string{"repository/testdata/charts@working"})
+
+	err := navigator.UpdateRepositories()
+	if suite.IsType(UpdateErrors{}, err) {
+		suite.Len(err, 1)
+		suite.Contains(err.(UpdateErrors), missing)
+		suite.Contains(err.Error(), missing)
+	}
+
+	// the working repository is updated regardless of the broken one
+	index, err := navigator.indexManager.Get("working")
+	if suite.NoError(err) {
+		_, err = index.Get("mychart", "0.1.0")
+		suite.NoError(err)
+	}
+
+	for name, repo := range navigator.repos {
+		status := navigator.repositoryStatus(name)
+		if repo.URL() == missing {
+			suite.Equal(syncPending, status.State)
+			suite.Error(status.LastError)
+			suite.False(status.LastErrorTime.IsZero())
+			suite.True(status.LastSuccess.IsZero())
+		} else {
+			suite.Equal(syncComplete, status.State)
+			suite.NoError(status.LastError)
+			suite.False(status.LastSuccess.IsZero())
+		}
+	}
+}
+
+func (suite *StatusTestSuite) TestConcurrentUpdates() {
+	navigator := New(log.NewNopLogger(), UpdateConcurrency(3))
+
+	abs, err := filepath.Abs("../.git")
+	if !suite.NoError(err) {
+		return
+	}
+
+	// distinct urls of the same repository, indexed to a shared index
+	for _, url := range []string{"../.git", "./../.git", "../.git/", abs} {
+		navigator.AddGitBackedRepository(url, repository.Credentials{}, 0, nil, []string{"repository/testdata/charts@shared"})
+	}
+	suite.Len(navigator.repos, 4)
+
+	if !suite.NoError(navigator.UpdateRepositories()) {
+		return
+	}
+
+	index, err := navigator.indexManager.Get("shared")
+	if suite.NoError(err) {
+		charts, _ := index.Count()
+		suite.Equal(2, charts)
+	}
+}
+
+func (suite *StatusTestSuite) TestRemovedDuringUpdate() {
+	navigator := New(log.NewNopLogger())
+
+	repo := &fakeRepository{url: "https://example.com/org/charts.git", started: make(chan struct{}), release: make(chan struct{})}
+	addFakeRepository(navigator, "charts", repo)
+
+	done := make(chan struct{})
+	go func() {
+		navigator.updateRepository("charts", repo)
+		close(done)
+	}()
+	<-repo.started
+
+	// the repository's status is removed, as it is by a reload, while the
+	// update is in progress
+	navigator.statusMutex.Lock()
+	delete(navigator.status, "charts")
+	navigator.statusMutex.Unlock()
+
+	repo.release <- struct{}{}
+	<-done
+
+	suite.NotPanics(func() { navigator.setSyncState("charts", syncRestored) })
+	suite.Equal(repositoryStatus{}, navigator.repositoryStatus("charts"))
+}
+
+func (suite *StatusTestSuite) TestServeStatus() {
+	navigator := New(log.NewNopLogger())
+
+	missing := filepath.Join("testdata", "does-not-exist")
+	navigator.AddGitBackedRepository(missing, repository.Credentials{}, 0, nil, []string{"repository/testdata/charts@broken"})
+	navigator.AddGitBackedRepository("../.git", repository.Credentials{}, 0, nil, []string{"repository/testdata/charts@working"})
+	navigator.UpdateRepositories()
+
+	res := httptest.NewRecorder()
+	navigator.ServeStatus(res, httptest.NewRequest("GET", "/api/status", nil))
+	suite.Equal(http.StatusOK, res.Code)
+	suite.Equal("application/json", res.Header().Get("Content-Type"))
+
+	var status struct {
+		Repositories []repositoryStatusResponse
+		Indexes      []indexStatusResponse
+	}
+	if !suite.NoError(json.NewDecoder(res.Body).Decode(&status)) || !suite.Len(status.Repositories, 2) {
+		return
+	}
+
+	// repositories are sorted by url
+	working, broken := status.Repositories[0], status.Repositories[1]
+
+	suite.Equal(repositoryName("../.git"), working.Name)
+	suite.Equal("../.git", working.URL)
+	suite.Equal([]apiDirectory{{Path: "repository/testdata/charts", Index: "working"}}, working.Directories)
+	suite.Equal(syncComplete, working.State)
+	suite.Len(working.Heads, 1)
+	suite.NotEmpty(working.LastFetchDuration)
+	suite.NotEmpty(working.LastIndexDuration)
+	suite.NotNil(working.LastSuccess)
+	suite.NotNil(working.NextUpdate)
+	suite.Empty(working.LastError)
+
+	suite.Equal(missing, broken.URL)
+	suite.Equal(syncPending, broken.State)
+	suite.Empty(broken.Heads)
+	suite.NotEmpty(broken.LastError)
+	suite.NotNil(broken.LastErrorTime)
+	suite.Nil(broken.LastSuccess)
+	suite.Equal(1, broken.Failures)
+
+	suite.Equal([]indexStatusResponse{
+		{Name: "broken"},
+		{Name: "working", Charts: 2, Versions: 2},
+	}, status.Indexes)
+}
+
+func TestStatusTestSuite(t *testing.T) {
+	suite.Run(t, new(StatusTestSuite))
+}
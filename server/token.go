@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// TokenAuthenticator authenticates requests with a static list of bearer
+// tokens
+type TokenAuthenticator struct {
+	tokens []staticToken
+}
+
+type staticToken struct {
+	token    []byte
+	identity Identity
+}
+
+// NewTokenAuthenticator returns an authenticator for the tokens of a file. Each
+// line of the file is a token followed by the name of the identity it
+// authenticates, and optionally a comma separated list of groups:
+//
+//	<token> <name> [<group>,...]
+func NewTokenAuthenticator(filename string) (*TokenAuthenticator, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := parseTokens(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return &TokenAuthenticator{tokens: tokens}, nil
+}
+
+func parseTokens(data []byte) ([]staticToken, error) {
+	var tokens []staticToken
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		fields := strings.Fields(entry)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: expected <token> <name> [<group>,...]", line)
+		}
+
+		token := staticToken{token: []byte(fields[0]), identity: Identity{Name: fields[1]}}
+		if len(fields) == 3 {
+			token.identity.Groups = strings.Split(fields[2], ",")
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, scanner.Err()
+}
+
+// Authenticate authenticates a request's bearer token, or basic auth password
+func (a *TokenAuthenticator) Authenticate(r *http.Request) (Identity, bool) {
+	token, ok := requestToken(r)
+	if !ok {
+		return Identity{}, false
+	}
+
+	// every token is compared, so that the time taken doesn't reveal which
+	// token matched
+	var identity Identity
+	found := false
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare(t.token, []byte(token)) == 1 {
+			identity, found = t.identity, true
+		}
+	}
+	return identity, found
+}
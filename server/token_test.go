@@ -0,0 +1,56 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type TokenTestSuite struct {
+	suite.Suite
+}
+
+func (suite *TokenTestSuite) TestAuthenticate() {
+	f, err := ioutil.TempFile("", "navigator-tokens")
+	suite.Require().NoError(err)
+	defer os.Remove(f.Name())
+	f.WriteString("# ci tokens\nci-token ci\n\nops-token ops-bot ops,admins\n")
+	f.Close()
+
+	authenticator, err := NewTokenAuthenticator(f.Name())
+	suite.Require().NoError(err)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer ci-token")
+	identity, ok := authenticator.Authenticate(req)
+	suite.True(ok)
+	suite.Equal(Identity{Name: "ci"}, identity)
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.SetBasicAuth("helm", "ops-token")
+	identity, ok = authenticator.Authenticate(req)
+	suite.True(ok)
+	suite.Equal(Identity{Name: "ops-bot", Groups: []string{"ops", "admins"}}, identity)
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer ci")
+	_, ok = authenticator.Authenticate(req)
+	suite.False(ok)
+
+	_, ok = authenticator.Authenticate(httptest.NewRequest("GET", "/", nil))
+	suite.False(ok)
+}
+
+func (suite *TokenTestSuite) TestParseErrors() {
+	for idx, test := range []string{"token", "token name groups extra"} {
+		_, err := parseTokens([]byte(test))
+		suite.Error(err, "test index: %v", idx)
+	}
+}
+
+func TestTokenTestSuite(t *testing.T) {
+	suite.Run(t, new(TokenTestSuite))
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// maxWebhookPayloadSize is the largest webhook payload accepted, the same
+// limit GitHub caps payloads at
+const maxWebhookPayloadSize = 25 << 20
+
+var (
+	errWebhookProviderNotFound = errors.New("webhook provider not found")
+	errWebhookInvalidSignature = errors.New("invalid webhook signature")
+	errRepositoryNotRegistered = errors.New("pushed repository is not registered")
+)
+
+// webhookProvider describes how a git host's push webhooks are verified and
+// identified.
+type webhookProvider struct {
+	eventHeader string
+	pushEvents  []string
+	pingEvents  []string
+	verify      func(r *http.Request, body, secret []byte) bool
+}
+
+var webhookProviders = map[string]webhookProvider{
+	"github": {
+		eventHeader: "X-GitHub-Event",
+		pushEvents:  []string{"push"},
+		pingEvents:  []string{"ping"},
+		verify: func(r *http.Request, body, secret []byte) bool {
+			if signature := r.Header.Get("X-Hub-Signature-256"); signature != "" {
+				return validHMAC(sha256.New, "sha256=", signature, body, secret)
+			}
+			return validHMAC(sha1.New, "sha1=", r.Header.Get("X-Hub-Signature"), body, secret)
+		},
+	},
+	"gitlab": {
+		eventHeader: "X-Gitlab-Event",
+		pushEvents:  []string{"Push Hook", "Tag Push Hook"},
+		verify: func(r *http.Request, body, secret []byte) bool {
+			return subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), secret) == 1
+		},
+	},
+	"gitea": {
+		eventHeader: "X-Gitea-Event",
+		pushEvents:  []string{"push"},
+		verify: func(r *http.Request, body, secret []byte) bool {
+			return validHMAC(sha256.New, "", r.Header.Get("X-Gitea-Signature"), body, secret)
+		},
+	},
+	"bitbucket": {
+		eventHeader: "X-Event-Key",
+		pushEvents:  []string{"repo:push", "repo:refs_changed"},
+		pingEvents:  []string{"diagnostics:ping"},
+		verify: func(r *http.Request, body, secret []byte) bool {
+			return validHMAC(sha256.New, "sha256=", r.Header.Get("X-Hub-Signature"), body, secret)
+		},
+	},
+}
+
+// validHMAC checks a hex encoded HMAC signature of the body.
+func validHMAC(fn func() hash.Hash, prefix, signature string, body, secret []byte) bool {
+	if !strings.HasPrefix(signature, prefix) {
+		return false
+	}
+
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, prefix))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(fn, secret)
+	mac.Write(body)
+
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// webhookPayload contains the repository URL fields of GitHub, GitLab, Gitea
+// and Bitbucket push event payloads.
+type webhookPayload struct {
+	Repository struct {
+		CloneURL   string `json:"clone_url"`
+		SSHURL     string `json:"ssh_url"`
+		GitURL     string `json:"git_url"`
+		HTMLURL    string `json:"html_url"`
+		GitHTTPURL string `json:"git_http_url"`
+		GitSSHURL  string `json:"git_ssh_url"`
+		Homepage   string `json:"homepage"`
+		Links      struct {
+			HTML struct {
+				Href string `json:"href"`
+			} `json:"html"`
+			Clone []struct {
+				Href string `json:"href"`
+			} `json:"clone"`
+		} `json:"links"`
+	} `json:"repository"`
+	Project struct {
+		GitHTTPURL string `json:"git_http_url"`
+		GitSSHURL  string `json:"git_ssh_url"`
+		WebURL     string `json:"web_url"`
+	} `json:"project"`
+}
+
+// urls returns every URL of the pushed repository found in the payload
+func (p *webhookPayload) urls() []string {
+	urls := []string{
+		p.Repository.CloneURL,
+		p.Repository.SSHURL,
+		p.Repository.GitURL,
+		p.Repository.HTMLURL,
+		p.Repository.GitHTTPURL,
+		p.Repository.GitSSHURL,
+		p.Repository.Homepage,
+		p.Repository.Links.HTML.Href,
+		p.Project.GitHTTPURL,
+		p.Project.GitSSHURL,
+		p.Project.WebURL,
+	}
+	for _, clone := range p.Repository.Links.Clone {
+		urls = append(urls, clone.Href)
+	}
+
+	return urls
+}
+
+// normalizeRepositoryURL reduces a git repository URL to its lowercased host
+// and path, without a .git suffix, so that the HTTP and SSH URLs of a
+// repository compare equal. An empty string is returned for local paths and
+// invalid URLs.
+func normalizeRepositoryURL(rawurl string) string {
+	// scp-like ssh syntax: [user@]host:path
+	if !strings.Contains(rawurl, "://") {
+		i := strings.Index(rawurl, ":")
+		if i <= 0 || strings.Contains(rawurl[:i], "/") {
+			return ""
+		}
+		rawurl = "ssh://" + rawurl[:i] + "/" + rawurl[i+1:]
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Hostname() == "" {
+		return ""
+	}
+
+	p := strings.TrimSuffix(strings.Trim(u.Path, "/"), ".git")
+	return strings.ToLower(u.Hostname() + "/" + p)
+}
+
+// WebhookHandler returns a handler for push event webhooks sent by GitHub
+// (/hooks/github), GitLab (/hooks/gitlab), Gitea (/hooks/gitea) and Bitbucket
+// (/hooks/bitbucket). Payloads are verified with the secret, and an update is
+// triggered for every repository with the same URL as the pushed repository.
+func (s *Server) WebhookHandler(secret []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Base(r.URL.Path)
+
+		code, urls, err := s.serveWebhook(w, r, name, secret)
+		if err != nil {
+			http.Error(w, err.Error(), code)
+			level.Error(s.logger).Log("event", "webhook", "provider", name, "err", err)
+			return
+		}
+
+		w.WriteHeader(code)
+		for _, url := range urls {
+			w.Write([]byte(url + "\n"))
+		}
+	})
+}
+
+func (s *Server) serveWebhook(w http.ResponseWriter, r *http.Request, name string, secret []byte) (int, []string, error) {
+	provider, ok := webhookProviders[name]
+	if !ok {
+		return http.StatusNotFound, nil, errWebhookProviderNotFound
+	}
+
+	if r.Method != http.MethodPost {
+		return http.StatusMethodNotAllowed, nil, errors.New(http.StatusText(http.StatusMethodNotAllowed))
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookPayloadSize))
+	if err != nil {
+		return http.StatusBadRequest, nil, err
+	}
+
+	// an empty secret would accept requests without a token, or with
+	// signatures anyone can compute
+	if len(secret) == 0 || !provider.verify(r, body, secret) {
+		return http.StatusUnauthorized, nil, errWebhookInvalidSignature
+	}
+
+	event := r.Header.Get(provider.eventHeader)
+	if containsString(provider.pingEvents, event) {
+		return http.StatusOK, nil, nil
+	}
+	if !containsString(provider.pushEvents, event) {
+		level.Debug(s.logger).Log("event", "webhook", "provider", name, "ignored", event)
+		return http.StatusOK, nil, nil
+	}
+
+	var payload webhookPayload
+	if err = json.Unmarshal(body, &payload); err != nil {
+		return http.StatusBadRequest, nil, err
+	}
+
+	pushed := make(map[string]struct{})
+	for _, url := range payload.urls() {
+		if normalized := normalizeRepositoryURL(url); normalized != "" {
+			pushed[normalized] = struct{}{}
+		}
+	}
+
+	var urls []string
+	for repoName, repo := range s.repositories() {
+		if _, ok := pushed[normalizeRepositoryURL(repo.URL())]; ok {
+			level.Info(s.logger).Log("event", "webhook", "provider", name, "repository", repo.URL())
+
+			s.TriggerUpdate(repoName)
+			urls = append(urls, repo.URL())
+		}
+	}
+
+	if len(urls) == 0 {
+		return http.StatusNotFound, nil, errRepositoryNotRegistered
+	}
+
+	return http.StatusAccepted, urls, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// updateTriggers coalesces out-of-band repository updates. While a
+// repository is updating, any number of further triggers result in a single
+// follow-up update.
+type updateTriggers struct {
+	mutex sync.Mutex
+	// updating repositories, and whether a follow-up update is pending
+	pending map[string]bool
+}
+
+// TriggerUpdate updates a repository in the background. Triggers received
+// while the repository is already updating are coalesced into one further
+// update, so that bursts of pushes don't queue up redundant updates.
+func (s *Server) TriggerUpdate(name string) {
+	s.triggers.mutex.Lock()
+	defer s.triggers.mutex.Unlock()
+
+	if _, updating := s.triggers.pending[name]; updating {
+		s.triggers.pending[name] = true
+		return
+	}
+	s.triggers.pending[name] = false
+
+	go func() {
+		for {
+			s.UpdateRepository(name)
+
+			s.triggers.mutex.Lock()
+			if !s.triggers.pending[name] {
+				delete(s.triggers.pending, name)
+				s.triggers.mutex.Unlock()
+				return
+			}
+			s.triggers.pending[name] = false
+			s.triggers.mutex.Unlock()
+		}
+	}()
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/saracen/navigator/repository"
+)
+
+// fakeRepository counts updates, optionally blocking each update until it is
+// released, and fails to update if err is set.
+type fakeRepository struct {
+	url     string
+	err     error
+	started chan struct{}
+	release chan struct{}
+
+	mutex   sync.Mutex
+	updates int
+}
+
+func (r *fakeRepository) URL() string {
+	return r.url
+}
+
+func (r *fakeRepository) Name() string {
+	return r.url
+}
+
+func (r *fakeRepository) ChartPackage(string) (repository.Archiver, error) {
+	return nil, repository.ErrInvalidPackageName
+}
+
+func (r *fakeRepository) Update() error {
+	r.mutex.Lock()
+	r.updates++
+	r.mutex.Unlock()
+
+	if r.started != nil {
+		r.started <- struct{}{}
+		<-r.release
+	}
+	return r.err
+}
+
+func (r *fakeRepository) Updates() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.updates
+}
+
+// addFakeRepository registers a fake repository with the server
+func addFakeRepository(s *Server, name string, repo *fakeRepository) {
+	s.setStatus(name, &repositoryStatus{URL: repo.URL(), State: syncPending})
+
+	s.reposMutex.Lock()
+	defer s.reposMutex.Unlock()
+	s.repos[name] = repo
+}
+
+// waitForTriggers waits for triggered updates to complete
+func waitForTriggers(s *Server) {
+	for {
+		s.triggers.mutex.Lock()
+		pending := len(s.triggers.pending)
+		s.triggers.mutex.Unlock()
+
+		if pending == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func signature(fn func() hash.Hash, body, secret []byte) string {
+	mac := hmac.New(fn, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type WebhookTestSuite struct {
+	suite.Suite
+	navigator *Server
+	repo      *fakeRepository
+	secret    []byte
+	ts        *httptest.Server
+}
+
+func (suite *WebhookTestSuite) SetupTest() {
+	suite.navigator = New(log.NewNopLogger())
+	suite.repo = &fakeRepository{url: "ssh://git@example.com/org/charts.git"}
+	addFakeRepository(suite.navigator, "charts", suite.repo)
+
+	suite.secret = []byte("secret")
+	suite.ts = httptest.NewServer(suite.navigator.WebhookHandler(suite.secret))
+}
+
+func (suite *WebhookTestSuite) TearDownTest() {
+	suite.ts.Close()
+}
+
+func (suite *WebhookTestSuite) post(provider string, headers map[string]string, body string) int {
+	req, _ := http.NewRequest("POST", suite.ts.URL+"/hooks/"+provider, bytes.NewBufferString(body))
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if !suite.NoError(err) {
+		return 0
+	}
+	resp.Body.Close()
+
+	waitForTriggers(suite.navigator)
+	return resp.StatusCode
+}
+
+func (suite *WebhookTestSuite) TestProviders() {
+	github := `{"repository": {"clone_url": "https://example.com/org/charts.git", "ssh_url": "git@example.com:org/charts.git"}}`
+	gitlab := `{"project": {"git_http_url": "https://example.com/org/charts.git"}, "repository": {"git_ssh_url": "git@example.com:org/charts.git"}}`
+	gitea := `{"repository": {"clone_url": "https://EXAMPLE.com/org/charts.git"}}`
+	bitbucket := `{"repository": {"links": {"html": {"href": "https://example.com/org/charts"}}}}`
+
+	tests := []struct {
+		provider string
+		headers  map[string]string
+		body     string
+		code     int
+	}{
+		{"github", map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + signature(sha256.New, []byte(github), suite.secret)}, github, http.StatusAccepted},
+		{"github", map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature": "sha1=" + signature(sha1.New, []byte(github), suite.secret)}, github, http.StatusAccepted},
+		{"github", map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature": "sha1=" + signature(sha1.New, []byte(github), []byte("wrong"))}, github, http.StatusUnauthorized},
+		{"github", map[string]string{"X-GitHub-Event": "ping", "X-Hub-Signature": "sha1=" + signature(sha1.New, []byte("{}"), suite.secret)}, "{}", http.StatusOK},
+		{"gitlab", map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "secret"}, gitlab, http.StatusAccepted},
+		{"gitlab", map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "wrong"}, gitlab, http.StatusUnauthorized},
+		{"gitlab", map[string]string{"X-Gitlab-Event": "Issue Hook", "X-Gitlab-Token": "secret"}, gitlab, http.StatusOK},
+		{"gitea", map[string]string{"X-Gitea-Event": "push", "X-Gitea-Signature": signature(sha256.New, []byte(gitea), suite.secret)}, gitea, http.StatusAccepted},
+		{"gitea", map[string]string{"X-Gitea-Event": "push"}, gitea, http.StatusUnauthorized},
+		{"bitbucket", map[string]string{"X-Event-Key": "repo:push", "X-Hub-Signature": "sha256=" + signature(sha256.New, []byte(bitbucket), suite.secret)}, bitbucket, http.StatusAccepted},
+		{"bitbucket", map[string]string{"X-Event-Key": "repo:push", "X-Hub-Signature": "sha256=invalid"}, bitbucket, http.StatusUnauthorized},
+		{"unknown", nil, "{}", http.StatusNotFound},
+	}
+
+	updates := 0
+	for idx, test := range tests {
+		suite.Equal(test.code, suite.post(test.provider, test.headers, test.body), "test index: %v", idx)
+
+		if test.code == http.StatusAccepted {
+			updates++
+		}
+		suite.Equal(updates, suite.repo.Updates(), "test index: %v", idx)
+	}
+}
+
+func (suite *WebhookTestSuite) TestEmptySecret() {
+	suite.ts.Close()
+	suite.ts = httptest.NewServer(suite.navigator.WebhookHandler(nil))
+
+	body := `{"project": {"git_http_url": "https://example.com/org/charts.git"}}`
+	suite.Equal(http.StatusUnauthorized, suite.post("gitlab", map[string]string{"X-Gitlab-Event": "Push Hook"}, body))
+	suite.Equal(http.StatusUnauthorized, suite.post("gitea", map[string]string{"X-Gitea-Event": "push", "X-Gitea-Signature": signature(sha256.New, []byte(body), nil)}, body))
+	suite.Equal(0, suite.repo.Updates())
+}
+
+func (suite *WebhookTestSuite) TestUnregisteredRepository() {
+	body := `{"repository": {"clone_url": "https://example.com/org/other.git"}}`
+	headers := map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "secret"}
+
+	suite.Equal(http.StatusNotFound, suite.post("gitlab", headers, body))
+	suite.Equal(0, suite.repo.Updates())
+
+	suite.Equal(http.StatusBadRequest, suite.post("gitlab", headers, "{"))
+}
+
+func (suite *WebhookTestSuite) TestCoalescedTriggers() {
+	repo := &fakeRepository{url: "https://example.com/org/busy.git", started: make(chan struct{}), release: make(chan struct{})}
+	addFakeRepository(suite.navigator, "busy", repo)
+
+	suite.navigator.TriggerUpdate("busy")
+	<-repo.started
+
+	// triggers while updating are coalesced into a single follow-up update
+	for i := 0; i < 5; i++ {
+		suite.navigator.TriggerUpdate("busy")
+	}
+
+	repo.release <- struct{}{}
+	<-repo.started
+	repo.release <- struct{}{}
+
+	waitForTriggers(suite.navigator)
+	suite.Equal(2, repo.Updates())
+}
+
+func (suite *WebhookTestSuite) TestNormalizeRepositoryURL() {
+	urls := map[string]string{
+		"https://github.com/Org/Charts.git":      "github.com/org/charts",
+		"https://user@github.com/org/charts/":    "github.com/org/charts",
+		"ssh://git@github.com:22/org/charts.git": "github.com/org/charts",
+		"git@github.com:org/charts.git":          "github.com/org/charts",
+		"../.git":                                "",
+		"/var/git/charts.git":                    "",
+	}
+
+	for url, normalized := range urls {
+		suite.Equal(normalized, normalizeRepositoryURL(url), url)
+	}
+}
+
+func TestWebhookTestSuite(t *testing.T) {
+	suite.Run(t, new(WebhookTestSuite))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// certificateReloader provides the certificate of a TLS listener, loading it
+// again whenever the certificate or key file is modified, so that rotated
+// certificates are used without restarting the server.
+type certificateReloader struct {
+	logger   log.Logger
+	certFile string
+	keyFile  string
+
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func newCertificateReloader(logger log.Logger, certFile, keyFile string) (*certificateReloader, error) {
+	r := &certificateReloader{logger: logger, certFile: certFile, keyFile: keyFile}
+	if _, err := r.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, implementing
+// tls.Config.GetCertificate. If the files have changed but can't be loaded,
+// for example because only one of them has been replaced so far, the previous
+// certificate continues to be used.
+func (r *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	certMod, certErr := modTime(r.certFile)
+	keyMod, keyErr := modTime(r.keyFile)
+	if r.cert != nil && certErr == nil && keyErr == nil && certMod.Equal(r.certMod) && keyMod.Equal(r.keyMod) {
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert == nil {
+			return nil, fmt.Errorf("tls: %v", err)
+		}
+		level.Error(r.logger).Log("event", "tls-reload", "cert", r.certFile, "key", r.keyFile, "err", err)
+		return r.cert, nil
+	}
+
+	if r.cert != nil {
+		level.Info(r.logger).Log("event", "tls-reload", "cert", r.certFile, "key", r.keyFile)
+	}
+	r.cert, r.certMod, r.keyMod = &cert, certMod, keyMod
+
+	return r.cert, nil
+}
+
+func modTime(filename string) (time.Time, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// newTLSConfig returns the TLS configuration of the HTTP listener, or nil if
+// TLS is not enabled. If a client CA file is provided, clients must present a
+// certificate signed by one of its certificates.
+func newTLSConfig(logger log.Logger, certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, errors.New("tls-client-ca-file: requires tls-cert-file and tls-key-file")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("tls-cert-file and tls-key-file must both be set")
+	}
+
+	reloader, err := newCertificateReloader(logger, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if clientCAFile != "" {
+		data, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls-client-ca-file: %v", err)
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("tls-client-ca-file: no certificates found in %s", clientCAFile)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
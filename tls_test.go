@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/suite"
+)
+
+type TLSTestSuite struct {
+	suite.Suite
+	dir string
+	ca  *testCertificate
+}
+
+// testCertificate is a generated certificate and its private key
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func (suite *TLSTestSuite) SetupTest() {
+	var err error
+	suite.dir, err = ioutil.TempDir("", "navigator-tls")
+	suite.Require().NoError(err)
+
+	suite.ca = suite.generate("navigator-test-ca", nil)
+}
+
+func (suite *TLSTestSuite) TearDownTest() {
+	os.RemoveAll(suite.dir)
+}
+
+// generate generates a certificate for localhost signed by parent, or a CA
+// certificate if parent is nil
+func (suite *TLSTestSuite) generate(commonName string, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	suite.Require().NoError(err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	suite.Require().NoError(err)
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	suite.Require().NoError(err)
+
+	cert, err := x509.ParseCertificate(der)
+	suite.Require().NoError(err)
+
+	return &testCertificate{cert: cert, key: key, der: der}
+}
+
+// write writes the certificate and key to PEM files named after name, setting
+// their modification time to modTime
+func (suite *TLSTestSuite) write(name string, cert *testCertificate, modTime time.Time) (certFile, keyFile string) {
+	keyDER, err := x509.MarshalECPrivateKey(cert.key)
+	suite.Require().NoError(err)
+
+	certFile = filepath.Join(suite.dir, name+".crt")
+	keyFile = filepath.Join(suite.dir, name+".key")
+	suite.Require().NoError(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.der}), 0644))
+	suite.Require().NoError(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	suite.Require().NoError(os.Chtimes(certFile, modTime, modTime))
+	suite.Require().NoError(os.Chtimes(keyFile, modTime, modTime))
+
+	return certFile, keyFile
+}
+
+func (suite *TLSTestSuite) TestNewTLSConfig() {
+	certFile, keyFile := suite.write("server", suite.generate("localhost", suite.ca), time.Now())
+	caFile, _ := suite.write("ca", suite.ca, time.Now())
+
+	config, err := newTLSConfig(log.NewNopLogger(), "", "", "")
+	suite.NoError(err)
+	suite.Nil(config)
+
+	config, err = newTLSConfig(log.NewNopLogger(), certFile, keyFile, "")
+	if suite.NoError(err) {
+		suite.Equal(tls.NoClientCert, config.ClientAuth)
+	}
+
+	config, err = newTLSConfig(log.NewNopLogger(), certFile, keyFile, caFile)
+	if suite.NoError(err) {
+		suite.Equal(tls.RequireAndVerifyClientCert, config.ClientAuth)
+	}
+
+	tests := []struct {
+		certFile, keyFile, clientCAFile string
+	}{
+		{certFile, "", ""},
+		{"", keyFile, ""},
+		{"", "", caFile},
+		{certFile, keyFile, keyFile},
+		{keyFile, certFile, ""},
+		{certFile, keyFile, filepath.Join(suite.dir, "missing.crt")},
+	}
+
+	for idx, test := range tests {
+		_, err := newTLSConfig(log.NewNopLogger(), test.certFile, test.keyFile, test.clientCAFile)
+		suite.Error(err, "test index: %v", idx)
+	}
+}
+
+func (suite *TLSTestSuite) TestCertificateReload() {
+	first := suite.generate("first", suite.ca)
+	certFile, keyFile := suite.write("server", first, time.Now().Add(-time.Minute))
+
+	reloader, err := newCertificateReloader(log.NewNopLogger(), certFile, keyFile)
+	suite.Require().NoError(err)
+
+	cert, err := reloader.GetCertificate(nil)
+	if suite.NoError(err) {
+		suite.Equal(first.der, cert.Certificate[0])
+	}
+
+	// rotated certificates are loaded on the next handshake
+	second := suite.generate("second", suite.ca)
+	suite.write("server", second, time.Now())
+
+	cert, err = reloader.GetCertificate(nil)
+	if suite.NoError(err) {
+		suite.Equal(second.der, cert.Certificate[0])
+	}
+
+	// a partially rotated pair continues to use the previous certificate
+	third := suite.generate("third", suite.ca)
+	thirdCert, _ := suite.write("third", third, time.Now())
+	data, err := ioutil.ReadFile(thirdCert)
+	suite.Require().NoError(err)
+	suite.Require().NoError(ioutil.WriteFile(certFile, data, 0644))
+	suite.Require().NoError(os.Chtimes(certFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute)))
+
+	cert, err = reloader.GetCertificate(nil)
+	if suite.NoError(err) {
+		suite.Equal(second.der, cert.Certificate[0])
+	}
+}
+
+func (suite *TLSTestSuite) TestMutualTLS() {
+	certFile, keyFile := suite.write("server", suite.generate("localhost", suite.ca), time.Now())
+	caFile, _ := suite.write("ca", suite.ca, time.Now())
+	client := suite.generate("client", suite.ca)
+
+	app := configure([]string{
+		"--url", "./.git#repository/testdata/charts",
+		"--tls-cert-file", certFile,
+		"--tls-key-file", keyFile,
+		"--tls-client-ca-file", caFile,
+		"--metrics-addr", ":0",
+	})
+	suite.Require().NotNil(app.srv.TLSConfig)
+	suite.Require().NotNil(app.metricsSrv)
+	suite.Len(app.servers(), 2)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	suite.Require().NoError(err)
+	go app.srv.ServeTLS(ln, "", "")
+	defer app.srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(suite.ca.cert)
+
+	get := func(certificates []tls.Certificate, path string) (int, error) {
+		c := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certificates},
+		}}
+		res, err := c.Get("https://" + ln.Addr().String() + path)
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return res.StatusCode, nil
+	}
+
+	// clients without a certificate are rejected
+	_, err = get(nil, "/api/status")
+	suite.Error(err)
+
+	clientCert := tls.Certificate{Certificate: [][]byte{client.der}, PrivateKey: client.key}
+	code, err := get([]tls.Certificate{clientCert}, "/api/status")
+	if suite.NoError(err) {
+		suite.Equal(http.StatusOK, code)
+	}
+
+	// metrics and health checks are only served by the plaintext listener
+	code, err = get([]tls.Certificate{clientCert}, "/metrics")
+	if suite.NoError(err) {
+		suite.Equal(http.StatusNotFound, code)
+	}
+
+	ts := httptest.NewServer(app.metricsSrv.Handler)
+	defer ts.Close()
+
+	for _, path := range []string{"/metrics", "/health", "/ready"} {
+		res, err := http.Get(ts.URL + path)
+		if suite.NoError(err, path) {
+			suite.NotEqual(http.StatusNotFound, res.StatusCode, path)
+			suite.NoError(res.Body.Close())
+		}
+	}
+}
+
+func TestTLSTestSuite(t *testing.T) {
+	suite.Run(t, new(TLSTestSuite))
+}